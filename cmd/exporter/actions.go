@@ -0,0 +1,277 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// runAction runs an admin action of the generated script on the target, and
+// decodes its result.
+func (e *Exporter) runAction(action string, args interface{}, result interface{}) error {
+	rawArgs, err := json.Marshal(args)
+	if err != nil {
+		return err
+	}
+
+	content, err := e.fetch(map[string]string{
+		scriptActionHeader: action,
+		scriptArgsHeader:   string(rawArgs),
+	})
+	if err != nil {
+		return err
+	}
+
+	var response struct {
+		Action string          `json:"action"`
+		Result json.RawMessage `json:"result"`
+	}
+	if err := json.Unmarshal(content, &response); err != nil || response.Action != action {
+		return fmt.Errorf("action %s not supported by the status script of %s", action, e.target)
+	}
+
+	return json.Unmarshal(response.Result, result)
+}
+
+// Reset resets the OPcache of the target.
+func (e *Exporter) Reset() error {
+	var reset bool
+	if err := e.runAction("reset", struct{}{}, &reset); err != nil {
+		return err
+	}
+	if !reset {
+		return errors.New("OPcache is disabled")
+	}
+	return nil
+}
+
+// Invalidate invalidates cached scripts, even if they are unchanged when
+// force is set, and returns whether each one was invalidated.
+func (e *Exporter) Invalidate(scripts []string, force bool) (map[string]bool, error) {
+	args := struct {
+		Scripts []string `json:"scripts"`
+		Force   bool     `json:"force"`
+	}{scripts, force}
+
+	var invalidated map[string]bool
+	if err := e.runAction("invalidate", args, &invalidated); err != nil {
+		return nil, err
+	}
+	return invalidated, nil
+}
+
+// Compile compiles scripts into the OPcache without running them, and
+// returns whether each one was compiled.
+func (e *Exporter) Compile(scripts []string) (map[string]bool, error) {
+	args := struct {
+		Scripts []string `json:"scripts"`
+	}{scripts}
+
+	var compiled map[string]bool
+	if err := e.runAction("compile", args, &compiled); err != nil {
+		return nil, err
+	}
+	return compiled, nil
+}
+
+// actionResult describes the outcome of an admin action, or what it would
+// affect in dry-run mode.
+type actionResult struct {
+	Target string `json:"target"`
+	Action string `json:"action"`
+	DryRun bool   `json:"dry_run"`
+	// Affected is the number of cached scripts affected by the action.
+	Affected int `json:"affected"`
+	// Scripts tells, for actions on given scripts, whether each one is
+	// affected.
+	Scripts map[string]bool `json:"scripts,omitempty"`
+}
+
+// boolParam returns the boolean value of a query parameter, false when it is
+// not set.
+func boolParam(r *http.Request, name string) (bool, error) {
+	raw := r.URL.Query().Get(name)
+	if raw == "" {
+		return false, nil
+	}
+
+	value, err := strconv.ParseBool(raw)
+	if err != nil {
+		return false, fmt.Errorf("invalid %s parameter %q", name, raw)
+	}
+	return value, nil
+}
+
+// actionRequest checks an admin action request, and returns its target and
+// whether it is a dry run, validating the parameters and the connectivity to
+// the target without running the action.
+func (a *api) actionRequest(w http.ResponseWriter, r *http.Request) (*Exporter, bool, bool) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "Only POST requests allowed", http.StatusMethodNotAllowed)
+		return nil, false, false
+	}
+
+	e, err := a.target(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, false, false
+	}
+
+	dryRun, err := boolParam(r, "dry_run")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, false, false
+	}
+
+	return e, dryRun, true
+}
+
+// reset resets the OPcache of a target. With "dry_run=true", it only reports
+// the number of cached scripts which would be dropped.
+func (a *api) reset(w http.ResponseWriter, r *http.Request) {
+	e, dryRun, ok := a.actionRequest(w, r)
+	if !ok {
+		return
+	}
+
+	ctx, cancel := a.context(r)
+	defer cancel()
+
+	status, err := e.getOpcacheStatus(ctx)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	if !dryRun {
+		if err := e.Reset(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		event := newEvent(e.Target(), "reset", "admin API")
+		event.Principal = requestPrincipal(r)
+		e.events.Record(event)
+	}
+
+	writeJSON(w, actionResult{
+		Target:   e.Target(),
+		Action:   "reset",
+		DryRun:   dryRun,
+		Affected: len(status.Scripts),
+	})
+}
+
+// invalidate invalidates the scripts given by the "script" query parameters
+// on a target, and the cached scripts matching the glob patterns given by the
+// "pattern" query parameters, even if they are unchanged with "force=true".
+// With "dry_run=true", it only reports which of them are cached.
+func (a *api) invalidate(w http.ResponseWriter, r *http.Request) {
+	e, dryRun, ok := a.actionRequest(w, r)
+	if !ok {
+		return
+	}
+
+	scripts := r.URL.Query()["script"]
+	var patterns []*regexp.Regexp
+	for _, pattern := range r.URL.Query()["pattern"] {
+		re, err := globRegexp(pattern)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid pattern %q: %s", pattern, err), http.StatusBadRequest)
+			return
+		}
+		patterns = append(patterns, re)
+	}
+	if len(scripts) == 0 && len(patterns) == 0 {
+		http.Error(w, "missing script or pattern parameter", http.StatusBadRequest)
+		return
+	}
+
+	force, err := boolParam(r, "force")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var status *OPcacheStatus
+	if dryRun || len(patterns) > 0 {
+		ctx, cancel := a.context(r)
+		defer cancel()
+		if status, err = e.getOpcacheStatus(ctx); err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+	}
+
+	// Patterns are expanded against the cached scripts.
+	if len(patterns) > 0 {
+		for _, script := range status.Scripts.Sorted() {
+			for _, re := range patterns {
+				if re.MatchString(script.FullPath) {
+					scripts = append(scripts, script.FullPath)
+					break
+				}
+			}
+		}
+	}
+	if len(scripts) == 0 {
+		writeJSON(w, actionResult{Target: e.Target(), Action: "invalidate", DryRun: dryRun})
+		return
+	}
+
+	var affected map[string]bool
+	if dryRun {
+		affected = make(map[string]bool, len(scripts))
+		for _, script := range scripts {
+			_, affected[script] = status.Scripts[script]
+		}
+	} else {
+		if affected, err = e.Invalidate(scripts, force); err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+	}
+
+	result := actionResult{
+		Target:  e.Target(),
+		Action:  "invalidate",
+		DryRun:  dryRun,
+		Scripts: affected,
+	}
+	for _, invalidated := range affected {
+		if invalidated {
+			result.Affected++
+		}
+	}
+	writeJSON(w, result)
+}
+
+// globRegexp compiles a glob pattern matching paths: "*" matches any sequence
+// of characters but "/", "?" any character but "/", and "**" any sequence of
+// characters, including "/".
+func globRegexp(pattern string) (*regexp.Regexp, error) {
+	var b strings.Builder
+	b.WriteString("^")
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; c {
+		case '*':
+			if i+1 < len(pattern) && pattern[i+1] == '*' {
+				b.WriteString(".*")
+				i++
+			} else {
+				b.WriteString("[^/]*")
+			}
+		case '?':
+			b.WriteString("[^/]")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	b.WriteString("$")
+
+	return regexp.Compile(b.String())
+}
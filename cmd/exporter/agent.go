@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+)
+
+const (
+	agentUp    = "up"
+	agentDrain = "drain"
+	agentDown  = "down"
+
+	// agentReadTimeout is the time given to HAProxy to send the target
+	// checked by an agent-check connection, with its agent-send string.
+	agentReadTimeout = time.Second
+
+	defaultAgentCacheTTL = 2 * time.Second
+	defaultAgentTimeout  = time.Second
+)
+
+// agentCheck reports the state of targets to load balancers, as HAProxy
+// agent-check states, so that traffic is pulled from application servers
+// whose OPcache is in a bad state.
+type agentCheck struct {
+	api    *api
+	config AgentCheckConfig
+	logger log.Logger
+
+	mu sync.Mutex
+	// states are the last states of the targets, so that every load
+	// balancer checking a target does not request its status.
+	states map[*Exporter]*agentState
+}
+
+// agentState is the state of a target at a time. Its mutex is held while
+// the status of the target is requested, so that the connections checking
+// the target meanwhile wait for it instead of requesting it too.
+type agentState struct {
+	mu            sync.Mutex
+	time          time.Time
+	state, reason string
+}
+
+func newAgentCheck(api *api, config *AgentCheckConfig, logger log.Logger) *agentCheck {
+	a := &agentCheck{api: api, logger: logger, states: map[*Exporter]*agentState{}}
+	if config != nil {
+		a.config = *config
+	}
+	if a.config.CacheFull == "" {
+		a.config.CacheFull = agentDrain
+	}
+	if a.config.Restart == "" {
+		a.config.Restart = agentDrain
+	}
+	if a.config.CacheTTL == 0 {
+		a.config.CacheTTL = defaultAgentCacheTTL
+	}
+	if a.config.Timeout == 0 {
+		a.config.Timeout = defaultAgentTimeout
+	}
+	return a
+}
+
+// state returns the state of the target, with the reason of the states other
+// than up, reusing the last one for the cache TTL.
+func (a *agentCheck) state(e *Exporter) (string, string) {
+	a.mu.Lock()
+	s, ok := a.states[e]
+	if !ok {
+		s = &agentState{}
+		a.states[e] = s
+	}
+	a.mu.Unlock()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if time.Since(s.time) >= a.config.CacheTTL {
+		s.state, s.reason = a.check(e)
+		s.time = time.Now()
+	}
+	return s.state, s.reason
+}
+
+// check requests the status of the target within the timeout of the agent
+// check, as load balancers give up on slow agents. The scripts and the custom
+// collectors are skipped, as load balancers check their servers every few
+// seconds.
+func (a *agentCheck) check(e *Exporter) (string, string) {
+	ctx, cancel := context.WithTimeout(context.Background(), a.config.Timeout)
+	defer cancel()
+
+	payload, err := e.getPayloadWith(ctx, map[string]string{scriptSkipHeader: scriptsCollector + "," + customCollector})
+	if err != nil {
+		return agentDown, "unreachable"
+	}
+	status := payload.Status
+
+	switch {
+	case !status.OPcacheEnabled:
+		return agentDown, "opcache_disabled"
+	case status.RestartPending || status.RestartInProgress:
+		return a.config.Restart, "restart"
+	case status.CacheFull:
+		return a.config.CacheFull, "cache_full"
+	case a.config.WastedPercentage > 0 && status.MemoryUsage.CurrentWastedPercentage > a.config.WastedPercentage:
+		return agentDrain, "wasted_memory"
+	case a.config.MinHitRate > 0 && status.OPcacheStatistics.OPcacheHitRate < a.config.MinHitRate:
+		return agentDrain, "low_hit_rate"
+	}
+	return agentUp, ""
+}
+
+// response formats a state as an agent-check response, the reason being a
+// description HAProxy shows in its stats.
+func agentResponse(state, reason string) string {
+	if state == agentUp || reason == "" {
+		return state + "\n"
+	}
+	return state + "#" + reason + "\n"
+}
+
+// ServeHTTP serves the state of the target of the "target" query parameter
+// in plain text. Down targets are answered with 503 Service Unavailable, for
+// load balancers only checking the status of HTTP responses.
+func (a *agentCheck) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	e, err := a.api.target(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	state, reason := a.state(e)
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if state == agentDown {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	fmt.Fprint(w, agentResponse(state, reason))
+}
+
+// listenAndServe serves the agent-check protocol of HAProxy on address. The
+// checked target is read from the agent-send string, and may be omitted when a
+// single target is configured.
+func (a *agentCheck) listenAndServe(address string) error {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				level.Error(a.logger).Log("msg", "Error accepting agent-check connection", "err", err)
+				return
+			}
+			go a.serveConn(conn)
+		}
+	}()
+	return nil
+}
+
+func (a *agentCheck) serveConn(conn net.Conn) {
+	defer conn.Close()
+
+	// HAProxy doesn't send anything without agent-send, in which case the
+	// read times out.
+	conn.SetReadDeadline(time.Now().Add(agentReadTimeout))
+	line, _ := bufio.NewReader(conn).ReadString('\n')
+	target := strings.TrimSpace(line)
+
+	e, ok := a.api.targets[target]
+	if target == "" && len(a.api.targets) == 1 {
+		for _, e = range a.api.targets {
+			ok = true
+		}
+	}
+	if !ok {
+		level.Warn(a.logger).Log("msg", "Unknown agent-check target", "target", target, "remote", conn.RemoteAddr())
+		conn.Write([]byte(agentResponse(agentDown, "unknown_target")))
+		return
+	}
+
+	state, reason := a.state(e)
+	conn.Write([]byte(agentResponse(state, reason)))
+}
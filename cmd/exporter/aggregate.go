@@ -0,0 +1,337 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// scriptFilesExpression finds the modification times of the files of the
+// scripts of the payload, which OPcache only reports with
+// opcache.validate_timestamps, and counts those modified after it last
+// started or restarted, which are stale without it.
+const scriptFilesExpression = "(function ($scripts, $statistics) { if ($scripts === null) { return null; } $restart = max($statistics['start_time'] ?? 0, $statistics['last_restart_time'] ?? 0); $files = ['oldest' => null, 'newest' => null, 'modified_since_restart' => 0]; foreach ($scripts as $path => $script) { if (($mtime = @filemtime($path)) === false) { continue; } $files['oldest'] = min($files['oldest'] ?? $mtime, $mtime); $files['newest'] = max($files['newest'] ?? $mtime, $mtime); if ($mtime > $restart) { $files['modified_since_restart']++; } } return $files; })($payload['scripts'] ?? null, $payload['status']['opcache_statistics'] ?? [])"
+
+// scriptAggregates are the metrics of the cached scripts of a target,
+// aggregated while the payload is decoded, so that the scripts are never all
+// held in memory, even for caches of 100k scripts.
+type scriptAggregates struct {
+	now time.Time
+	// seen tells whether the payload included the scripts.
+	seen     bool
+	zeroHits int64
+	// memoryConsumption is the memory consumed by all the scripts.
+	memoryConsumption int64
+	// lastUsed counts the scripts by lastUsedBuckets, plus older ones.
+	lastUsed []int64
+	// unused counts the scripts not used for at least each of the unused
+	// thresholds of the exporter, as lastUsed does for its bounds.
+	thresholds []time.Duration
+	unused     []int64
+	// files are found by the status script from the files of the scripts,
+	// if it reported them.
+	files  *ScriptFiles
+	memory *histogramAccumulator
+	hits   *histogramAccumulator
+	// manifest are the files of the manifest of the target, if any, of
+	// which manifestCached are cached.
+	manifest       map[string]struct{}
+	manifestErr    error
+	manifestCached int64
+	// top are the scripts consuming the most memory, if per-script metrics
+	// are enabled.
+	top *topScripts
+}
+
+func (e *Exporter) newScriptAggregates(now time.Time) *scriptAggregates {
+	a := &scriptAggregates{
+		now:        now,
+		lastUsed:   make([]int64, len(lastUsedBuckets)+1),
+		thresholds: e.unusedThresholds,
+		unused:     make([]int64, len(e.unusedThresholds)),
+	}
+	if e.scriptMemoryHistogram != nil {
+		a.memory = e.scriptMemoryHistogram.accumulate()
+		a.hits = e.scriptHitsHistogram.accumulate()
+	}
+	if e.manifest != nil {
+		a.manifest, a.manifestErr = e.manifest.files()
+	}
+	if e.perScriptLimit > 0 {
+		a.top = newTopScripts(e.perScriptLimit)
+	}
+	return a
+}
+
+// checkUnusedThresholds checks that the unused thresholds are positive and
+// distinct, as each is a series.
+func checkUnusedThresholds(thresholds []time.Duration) error {
+	seen := make(map[time.Duration]bool, len(thresholds))
+	for _, threshold := range thresholds {
+		if threshold <= 0 {
+			return fmt.Errorf("threshold %s not positive", threshold)
+		}
+		if seen[threshold] {
+			return fmt.Errorf("duplicate threshold %s", threshold)
+		}
+		seen[threshold] = true
+	}
+	return nil
+}
+
+// add aggregates a cached script.
+func (a *scriptAggregates) add(script Script) {
+	if script.Hits == 0 {
+		a.zeroHits++
+	}
+	a.memoryConsumption += script.MemoryConsumption
+
+	age := a.now.Sub(time.Unix(script.LastUsedTimestamp, 0))
+	i := 0
+	for i < len(lastUsedBuckets) && age >= lastUsedBuckets[i].bound {
+		i++
+	}
+	a.lastUsed[i]++
+	for i, threshold := range a.thresholds {
+		if age >= threshold {
+			a.unused[i]++
+		}
+	}
+
+	if _, ok := a.manifest[script.FullPath]; ok {
+		a.manifestCached++
+	}
+
+	if a.memory != nil {
+		a.memory.observe(intMetric(script.MemoryConsumption))
+		a.hits.observe(intMetric(script.Hits))
+	}
+
+	if a.top != nil {
+		a.top.add(script)
+	}
+}
+
+// collectScripts collects the metrics aggregated from the cached scripts.
+func (e *Exporter) collectScripts(ch chan<- prometheus.Metric, a *scriptAggregates) {
+	ch <- prometheus.MustNewConstMetric(e.scriptsZeroHitsDesc, prometheus.GaugeValue, intMetric(a.zeroHits))
+	ch <- prometheus.MustNewConstMetric(e.scriptsMemoryDesc, prometheus.GaugeValue, intMetric(a.memoryConsumption))
+
+	for i, count := range a.lastUsed {
+		age := "older"
+		if i < len(lastUsedBuckets) {
+			age = lastUsedBuckets[i].label
+		}
+		ch <- prometheus.MustNewConstMetric(e.scriptsLastUsedDesc, prometheus.GaugeValue, intMetric(count), age)
+	}
+	for i, count := range a.unused {
+		threshold := strconv.FormatFloat(a.thresholds[i].Seconds(), 'f', -1, 64)
+		ch <- prometheus.MustNewConstMetric(e.scriptsUnusedDesc, prometheus.GaugeValue, intMetric(count), threshold)
+	}
+
+	if a.files != nil {
+		if a.files.Oldest != nil && a.files.Newest != nil {
+			ch <- prometheus.MustNewConstMetric(e.oldestScriptDesc, prometheus.GaugeValue, intMetric(*a.files.Oldest))
+			ch <- prometheus.MustNewConstMetric(e.newestScriptDesc, prometheus.GaugeValue, intMetric(*a.files.Newest))
+		}
+		ch <- prometheus.MustNewConstMetric(e.scriptsModifiedDesc, prometheus.GaugeValue, intMetric(a.files.ModifiedSinceRestart))
+	}
+
+	if a.memory != nil {
+		ch <- a.memory.metric()
+		ch <- a.hits.metric()
+	}
+
+	if a.top != nil {
+		e.collectTopScripts(ch, a.top)
+	}
+}
+
+// scriptStream decodes the scripts of a payload one at a time, handing them
+// to the aggregates instead of keeping them.
+type scriptStream struct {
+	aggregates *scriptAggregates
+}
+
+// decode reads the scripts, the next value of the decoder.
+func (s *scriptStream) decode(dec *json.Decoder) error {
+	token, err := dec.Token()
+	if err != nil || token == nil {
+		return err
+	}
+	s.aggregates.seen = true
+
+	// PHP encodes an empty object as an empty array.
+	if token == json.Delim('[') {
+		for dec.More() {
+			var ignored json.RawMessage
+			if err := dec.Decode(&ignored); err != nil {
+				return err
+			}
+		}
+		_, err := dec.Token()
+		return err
+	}
+	if token != json.Delim('{') {
+		return fmt.Errorf("invalid scripts: unexpected %v", token)
+	}
+
+	var script Script
+	for dec.More() {
+		if _, err := dec.Token(); err != nil {
+			return err
+		}
+		script = Script{}
+		if err := dec.Decode(&script); err != nil {
+			return err
+		}
+		s.aggregates.add(script)
+	}
+	_, err = dec.Token()
+	return err
+}
+
+// strip reads the members of an object whose opening brace was read,
+// streaming the scripts found in it, or in its status at the top level, and
+// returns the object without them.
+func (s *scriptStream) strip(dec *json.Decoder, top bool) (json.RawMessage, error) {
+	members := map[string]json.RawMessage{}
+	for dec.More() {
+		token, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		key := token.(string)
+
+		switch {
+		case key == "scripts":
+			err = s.decode(dec)
+		case key == "status" && top:
+			if token, err = dec.Token(); err != nil {
+				return nil, err
+			}
+			switch token {
+			case nil:
+				members[key] = json.RawMessage("null")
+			case json.Delim('{'):
+				members[key], err = s.strip(dec, false)
+			default:
+				err = fmt.Errorf("invalid status: unexpected %v", token)
+			}
+		default:
+			var value json.RawMessage
+			err = dec.Decode(&value)
+			members[key] = value
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if _, err := dec.Token(); err != nil {
+		return nil, err
+	}
+	return json.Marshal(members)
+}
+
+// payloadReader reads the output of a target, keeping its start, or all of
+// it if whole, and the error of the target.
+type payloadReader struct {
+	r     io.Reader
+	whole bool
+	kept  []byte
+	err   error
+}
+
+// payloadKeptLen is the length of the start of outputs kept for the errors
+// of those which cannot be decoded, such as PHP errors.
+const payloadKeptLen = 4096
+
+func (r *payloadReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if keep := n; r.whole || len(r.kept) < payloadKeptLen {
+		if !r.whole {
+			keep = min(n, payloadKeptLen-len(r.kept))
+		}
+		r.kept = append(r.kept, p[:keep]...)
+	}
+	if err != nil && err != io.EOF {
+		r.err = err
+	}
+	return n, err
+}
+
+// decodeStreamed decodes the payload read from the target, aggregating its
+// scripts on the fly. Like getPayloadWith, it accepts bare statuses. The raw
+// document of the payload excludes the scripts, unless whole is set.
+func decodeStreamed(output io.Reader, aggregates *scriptAggregates, whole bool) (*Payload, error) {
+	stream := &scriptStream{aggregates: aggregates}
+	r := &payloadReader{r: output, whole: whole}
+	dec := json.NewDecoder(r)
+
+	content, err := func() (json.RawMessage, error) {
+		token, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		if token != json.Delim('{') {
+			return nil, fmt.Errorf("unexpected %v", token)
+		}
+		content, err := stream.strip(dec, true)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := dec.Token(); err != io.EOF {
+			return nil, errors.New("unexpected data after the payload")
+		}
+		return content, nil
+	}()
+	if err != nil {
+		// The start of outputs which are not JSON, such as PHP errors, is
+		// read for their messages.
+		io.CopyN(io.Discard, r, payloadKeptLen)
+		if r.err != nil {
+			return nil, r.err
+		}
+		return nil, &payloadError{content: r.kept}
+	}
+	raw := content
+	if whole {
+		raw = r.kept
+	}
+
+	var payload struct {
+		Status *OPcacheStatus             `json:"status"`
+		Custom map[string]json.RawMessage `json:"custom"`
+		Errors map[string]string          `json:"errors"`
+
+		ScriptFiles *ScriptFiles `json:"script_files"`
+
+		Configuration *OPcacheConfiguration `json:"configuration"`
+		PHP           *PHPInfo              `json:"php"`
+		FileCache     *FileCacheUsage       `json:"file_cache_usage"`
+		RealpathCache *RealpathCacheUsage   `json:"realpath_cache"`
+
+		ExecutionSeconds *float64 `json:"execution_seconds"`
+	}
+	if err := json.Unmarshal(content, &payload); err != nil {
+		return nil, &payloadError{content: r.kept}
+	}
+	if msg, ok := payload.Errors["status"]; ok {
+		return nil, errors.New(msg)
+	}
+	if payload.Status != nil {
+		return &Payload{Status: payload.Status, Custom: payload.Custom, Configuration: payload.Configuration, PHP: payload.PHP, FileCache: payload.FileCache, RealpathCache: payload.RealpathCache, ScriptFiles: payload.ScriptFiles, Errors: payload.Errors, ExecutionSeconds: payload.ExecutionSeconds, raw: raw}, nil
+	}
+
+	// Scripts given with --opcache.script-path may echo the bare status.
+	status := new(OPcacheStatus)
+	if err := json.Unmarshal(content, status); err != nil {
+		return nil, &payloadError{content: r.kept}
+	}
+	return &Payload{Status: status, raw: raw}, nil
+}
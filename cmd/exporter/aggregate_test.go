@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// TestAddCountsBoundsInclusively checks that a script last used exactly a
+// bound ago is counted the same way by the last used buckets and by the
+// unused thresholds.
+func TestAddCountsBoundsInclusively(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	e := &Exporter{unusedThresholds: []time.Duration{time.Minute, time.Hour}}
+
+	tests := []struct {
+		age      time.Duration
+		lastUsed string
+		unused   []int64
+	}{
+		{59 * time.Second, "1m", []int64{0, 0}},
+		{time.Minute, "1h", []int64{1, 0}},
+		{time.Hour - time.Second, "1h", []int64{1, 0}},
+		{time.Hour, "1d", []int64{1, 1}},
+		{24 * time.Hour, "older", []int64{1, 1}},
+	}
+	for _, test := range tests {
+		a := e.newScriptAggregates(now)
+		a.add(Script{LastUsedTimestamp: now.Add(-test.age).Unix()})
+
+		lastUsed := "older"
+		for i, count := range a.lastUsed {
+			if count == 1 && i < len(lastUsedBuckets) {
+				lastUsed = lastUsedBuckets[i].label
+			}
+		}
+		if lastUsed != test.lastUsed {
+			t.Errorf("age %s: last used bucket %s, want %s", test.age, lastUsed, test.lastUsed)
+		}
+		for i, count := range a.unused {
+			if count != test.unused[i] {
+				t.Errorf("age %s: %d scripts unused for %s, want %d", test.age, count, a.thresholds[i], test.unused[i])
+			}
+		}
+	}
+}
+
+// TestDecodeStreamed checks that the scripts of payloads are streamed into the
+// aggregates wherever the script put them, read a few bytes at a time.
+func TestDecodeStreamed(t *testing.T) {
+	const scripts = `"scripts":{"/app/a.php":{"memory_consumption":100},"/app/b.php":{"memory_consumption":20}}`
+
+	tests := []struct {
+		name    string
+		content string
+		whole   bool
+		memory  int64
+		raw     string
+	}{
+		{"top level", `{"status":{"opcache_enabled":true},` + scripts + `}`, false, 120, `{"status":{"opcache_enabled":true}}`},
+		{"in status", `{"status":{"opcache_enabled":true,` + scripts + `}}`, false, 120, `{"status":{"opcache_enabled":true}}`},
+		{"bare status", `{"opcache_enabled":true,` + scripts + `}`, false, 120, `{"opcache_enabled":true}`},
+		{"empty scripts", `{"status":{"opcache_enabled":true},"scripts":[]}`, false, 0, `{"status":{"opcache_enabled":true}}`},
+		{"whole document", `{"status":{"opcache_enabled":true},` + scripts + `}`, true, 120, `{"status":{"opcache_enabled":true},` + scripts + `}`},
+	}
+	for _, test := range tests {
+		a := (&Exporter{}).newScriptAggregates(time.Now())
+		payload, err := decodeStreamed(iotest.OneByteReader(strings.NewReader(test.content)), a, test.whole)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if !payload.Status.OPcacheEnabled {
+			t.Errorf("%s: status not decoded", test.name)
+		}
+		if !a.seen || a.memoryConsumption != test.memory {
+			t.Errorf("%s: scripts consuming %d bytes aggregated, want %d", test.name, a.memoryConsumption, test.memory)
+		}
+		if string(payload.raw) != test.raw {
+			t.Errorf("%s: raw document %s, want %s", test.name, payload.raw, test.raw)
+		}
+	}
+}
+
+// TestDecodeStreamedInvalid checks that the start of outputs which are not
+// payloads is kept for their error, and that the errors reading them are
+// returned as is.
+func TestDecodeStreamedInvalid(t *testing.T) {
+	output := "PHP Fatal error: Zend OPcache API is restricted by \"restrict_api\" configuration directive" + strings.Repeat(" ", 2*payloadKeptLen)
+	_, err := decodeStreamed(strings.NewReader(output), (&Exporter{}).newScriptAggregates(time.Now()), false)
+	var payload *payloadError
+	if !errors.As(err, &payload) {
+		t.Fatalf("got error %v, want a payload error", err)
+	}
+	if !bytes.Equal(payload.content, []byte(output[:payloadKeptLen])) {
+		t.Errorf("kept %d bytes of the output, want %d", len(payload.content), payloadKeptLen)
+	}
+
+	for _, content := range []string{`{"status":{}} trailing`, `{"status":{"opcache_enabled":true}`, `{"scripts":{"/app/a.php":1}}`} {
+		if _, err := decodeStreamed(strings.NewReader(content), (&Exporter{}).newScriptAggregates(time.Now()), false); !errors.As(err, &payload) {
+			t.Errorf("%s: got error %v, want a payload error", content, err)
+		}
+	}
+
+	timeout := errors.New("timeout")
+	_, err = decodeStreamed(io.MultiReader(strings.NewReader(`{"status":`), iotest.ErrReader(timeout)), (&Exporter{}).newScriptAggregates(time.Now()), false)
+	if !errors.Is(err, timeout) {
+		t.Errorf("got error %v, want the error of the reader", err)
+	}
+}
+
+// TestCollectScriptFilesWithoutValidateTimestamps checks that the times of the
+// files of the scripts are exported from the files found by the status
+// script, as OPcache reports no timestamps without
+// opcache.validate_timestamps.
+func TestCollectScriptFilesWithoutValidateTimestamps(t *testing.T) {
+	fixture, err := filepath.Abs("testdata/payload_no_validate_timestamps.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := log.NewNopLogger()
+	e, err := NewExporter("file://"+fixture, ExporterOptions{
+		Config:     &Config{},
+		Events:     NewEventLog(10, "", 0, logger),
+		Logger:     logger,
+		Collectors: map[string]bool{scriptsCollector: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	metrics := make(chan prometheus.Metric)
+	go func() {
+		e.Collect(metrics)
+		close(metrics)
+	}()
+	values := map[*prometheus.Desc]float64{}
+	for metric := range metrics {
+		var m dto.Metric
+		if err := metric.Write(&m); err != nil {
+			t.Fatal(err)
+		}
+		values[metric.Desc()] = m.GetGauge().GetValue()
+	}
+
+	for desc, want := range map[*prometheus.Desc]float64{
+		e.oldestScriptDesc:    1690000000,
+		e.newestScriptDesc:    1700002000,
+		e.scriptsModifiedDesc: 1,
+	} {
+		if value, ok := values[desc]; !ok || value != want {
+			t.Errorf("%s: got %v (collected: %t), want %v", desc, value, ok, want)
+		}
+	}
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	defaultPerPage = 100
+	maxPerPage     = 1000
+)
+
+// api serves JSON views over the OPcache status of the configured targets.
+type api struct {
+	targets map[string]*Exporter
+	// workers is the maximum number of targets requested in parallel by
+	// the endpoints requesting all of them.
+	workers int
+	// timeout bounds the status requests of an API request, which are also
+	// canceled when the client goes away.
+	timeout time.Duration
+}
+
+func newAPI(workers int, timeout time.Duration) *api {
+	return &api{targets: map[string]*Exporter{}, workers: max(workers, 1), timeout: timeout}
+}
+
+// context returns the context of the status requests of r.
+func (a *api) context(r *http.Request) (context.Context, context.CancelFunc) {
+	if a.timeout <= 0 {
+		return context.WithCancel(r.Context())
+	}
+	return context.WithTimeout(r.Context(), a.timeout)
+}
+
+func (a *api) addTarget(e *Exporter) {
+	a.targets[e.Target()] = e
+}
+
+// sortedTargets returns the exporters ordered by target.
+func (a *api) sortedTargets() []*Exporter {
+	exporters := make([]*Exporter, 0, len(a.targets))
+	for _, e := range a.targets {
+		exporters = append(exporters, e)
+	}
+	sort.Slice(exporters, func(i, j int) bool {
+		return exporters[i].Target() < exporters[j].Target()
+	})
+	return exporters
+}
+
+// target returns the exporter designated by the "target" query parameter. The
+// parameter may be omitted when a single target is configured.
+func (a *api) target(r *http.Request) (*Exporter, error) {
+	if r.URL.Query().Get("target") == "" && len(a.targets) == 1 {
+		for _, e := range a.targets {
+			return e, nil
+		}
+	}
+	return a.lookup(r, "target")
+}
+
+// lookup returns the exporter designated by the given query parameter.
+func (a *api) lookup(r *http.Request, param string) (*Exporter, error) {
+	name := r.URL.Query().Get(param)
+	if name == "" {
+		return nil, fmt.Errorf("missing %s parameter", param)
+	}
+
+	e, ok := a.targets[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown target %q", name)
+	}
+	return e, nil
+}
+
+// intParam returns the positive integer value of a query parameter, or def
+// when it is not set.
+func intParam(r *http.Request, name string, def int) (int, error) {
+	raw := r.URL.Query().Get(name)
+	if raw == "" {
+		return def, nil
+	}
+
+	value, err := strconv.Atoi(raw)
+	if err != nil || value < 1 {
+		return 0, fmt.Errorf("invalid %s parameter %q", name, raw)
+	}
+	return value, nil
+}
+
+type scriptsPage struct {
+	Target  string   `json:"target"`
+	Total   int      `json:"total"`
+	Page    int      `json:"page"`
+	PerPage int      `json:"per_page"`
+	Scripts []Script `json:"scripts"`
+}
+
+// scripts lists the scripts cached by a target, ordered by path and paginated
+// using the "page" and "per_page" query parameters. With "format=csv", all
+// scripts are returned at once as a CSV file.
+func (a *api) scripts(w http.ResponseWriter, r *http.Request) {
+	e, err := a.target(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := a.context(r)
+	defer cancel()
+
+	switch format := r.URL.Query().Get("format"); format {
+	case "", "json":
+	case "csv":
+		a.scriptsCSV(ctx, w, e)
+		return
+	default:
+		http.Error(w, fmt.Sprintf("unsupported format %q", format), http.StatusBadRequest)
+		return
+	}
+
+	page, err := intParam(r, "page", 1)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	perPage, err := intParam(r, "per_page", defaultPerPage)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	perPage = min(perPage, maxPerPage)
+
+	status, err := e.getOpcacheStatus(ctx)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	scripts := status.Scripts.Sorted()
+	start := min((page-1)*perPage, len(scripts))
+	end := min(start+perPage, len(scripts))
+
+	writeJSON(w, scriptsPage{
+		Target:  e.Target(),
+		Total:   len(scripts),
+		Page:    page,
+		PerPage: perPage,
+		Scripts: scripts[start:end],
+	})
+}
+
+func (a *api) scriptsCSV(ctx context.Context, w http.ResponseWriter, e *Exporter) {
+	status, err := e.getOpcacheStatus(ctx)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", `attachment; filename="scripts.csv"`)
+
+	out := csv.NewWriter(w)
+	out.Write([]string{"full_path", "hits", "memory_consumption", "last_used_timestamp", "timestamp"})
+	for _, script := range status.Scripts.Sorted() {
+		out.Write([]string{
+			script.FullPath,
+			strconv.FormatInt(script.Hits, 10),
+			strconv.FormatInt(script.MemoryConsumption, 10),
+			strconv.FormatInt(script.LastUsedTimestamp, 10),
+			strconv.FormatInt(script.Timestamp, 10),
+		})
+	}
+	out.Flush()
+}
+
+type scriptRevisions struct {
+	FullPath   string `json:"full_path"`
+	TimestampA int64  `json:"timestamp_a"`
+	TimestampB int64  `json:"timestamp_b"`
+}
+
+type scriptsDiff struct {
+	A       string            `json:"a"`
+	B       string            `json:"b"`
+	OnlyA   []string          `json:"only_a"`
+	OnlyB   []string          `json:"only_b"`
+	Changed []scriptRevisions `json:"changed"`
+}
+
+// scriptsDiff compares the scripts cached by the targets given by the "a" and
+// "b" query parameters, requested in parallel, and returns the scripts cached
+// by only one of them as well as the ones cached with different timestamps.
+func (a *api) scriptsDiff(w http.ResponseWriter, r *http.Request) {
+	ea, err := a.lookup(r, "a")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	eb, err := a.lookup(r, "b")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := a.context(r)
+	defer cancel()
+
+	var statusA, statusB *OPcacheStatus
+	var errA, errB error
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		statusA, errA = ea.getOpcacheStatus(ctx)
+	}()
+	statusB, errB = eb.getOpcacheStatus(ctx)
+	wg.Wait()
+
+	for _, err := range []error{errA, errB} {
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+	}
+
+	diff := scriptsDiff{
+		A:       ea.Target(),
+		B:       eb.Target(),
+		OnlyA:   []string{},
+		OnlyB:   []string{},
+		Changed: []scriptRevisions{},
+	}
+
+	for _, script := range statusA.Scripts.Sorted() {
+		other, ok := statusB.Scripts[script.FullPath]
+		switch {
+		case !ok:
+			diff.OnlyA = append(diff.OnlyA, script.FullPath)
+		case other.Timestamp != script.Timestamp:
+			diff.Changed = append(diff.Changed, scriptRevisions{
+				FullPath:   script.FullPath,
+				TimestampA: script.Timestamp,
+				TimestampB: other.Timestamp,
+			})
+		}
+	}
+
+	for _, script := range statusB.Scripts.Sorted() {
+		if _, ok := statusA.Scripts[script.FullPath]; !ok {
+			diff.OnlyB = append(diff.OnlyB, script.FullPath)
+		}
+	}
+
+	writeJSON(w, diff)
+}
+
+type searchResult struct {
+	Target string  `json:"target"`
+	Cached bool    `json:"cached"`
+	Script *Script `json:"script,omitempty"`
+	Error  string  `json:"error,omitempty"`
+}
+
+// search reports, for every target, whether the script given by the "path"
+// query parameter is cached, requesting at most a.workers targets at once.
+func (a *api) search(w http.ResponseWriter, r *http.Request) {
+	path := r.URL.Query().Get("path")
+	if path == "" {
+		http.Error(w, "missing path parameter", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := a.context(r)
+	defer cancel()
+
+	exporters := a.sortedTargets()
+	results := make([]searchResult, len(exporters))
+
+	var wg sync.WaitGroup
+	workers := make(chan struct{}, a.workers)
+	for i, e := range exporters {
+		wg.Add(1)
+		workers <- struct{}{}
+		go func(i int, e *Exporter) {
+			defer wg.Done()
+			defer func() { <-workers }()
+
+			results[i].Target = e.Target()
+
+			status, err := e.getOpcacheStatus(ctx)
+			if err != nil {
+				results[i].Error = err.Error()
+				return
+			}
+
+			if script, ok := status.Scripts[path]; ok {
+				results[i].Cached = true
+				results[i].Script = &script
+			}
+		}(i, e)
+	}
+	wg.Wait()
+
+	writeJSON(w, results)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
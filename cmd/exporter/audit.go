@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// principalKey is the context key of the principals authenticating a
+// request.
+type principalKey struct{}
+
+// addPrincipal records an identity authenticating a request audited by an
+// auditLog.
+func addPrincipal(r *http.Request, principal string) {
+	if principals, ok := r.Context().Value(principalKey{}).(*[]string); ok {
+		*principals = append(*principals, principal)
+	}
+}
+
+// requestPrincipal returns the identities authenticating a request audited by
+// an auditLog, or "anonymous".
+func requestPrincipal(r *http.Request) string {
+	var principal string
+	if principals, ok := r.Context().Value(principalKey{}).(*[]string); ok {
+		principal = strings.Join(*principals, ",")
+	}
+	if len(principal) == 0 {
+		principal = "anonymous"
+	}
+	return principal
+}
+
+// tokenPrincipal identifies a token without revealing it.
+func tokenPrincipal(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return "token:" + hex.EncodeToString(sum[:4])
+}
+
+// auditLog logs the invocations of admin endpoints, and counts them by action
+// and result.
+type auditLog struct {
+	logger  log.Logger
+	actions *prometheus.CounterVec
+}
+
+func newAuditLog(registerer prometheus.Registerer, logger log.Logger) *auditLog {
+	a := &auditLog{
+		logger: logger,
+		actions: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "admin_actions_total",
+			Help:      "Total number of admin actions requested, by action and result.",
+		}, []string{"action", "result"}),
+	}
+	registerer.MustRegister(a.actions)
+	return a
+}
+
+// wrap returns the handler of an admin action, audited.
+func (a *auditLog) wrap(action string, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var principals []string
+		r = r.WithContext(context.WithValue(r.Context(), principalKey{}, &principals))
+
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		handler.ServeHTTP(recorder, r)
+
+		result := "success"
+		switch {
+		case recorder.status == http.StatusUnauthorized || recorder.status == http.StatusForbidden:
+			result = "denied"
+		case recorder.status >= 400:
+			result = "error"
+		}
+		a.actions.WithLabelValues(action, result).Inc()
+
+		level.Info(a.logger).Log("msg", "Admin action", "action", action, "principal", requestPrincipal(r), "remote", r.RemoteAddr, "target", r.URL.Query().Get("target"), "params", r.URL.RawQuery, "result", result, "status", recorder.status)
+	})
+}
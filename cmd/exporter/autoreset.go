@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// checkAutoReset resets the OPcache of the target when its wasted percentage
+// has stayed above the threshold of the auto reset policy for long enough,
+// unless it was reset too recently, and returns the resulting events.
+func (e *Exporter) checkAutoReset(status *OPcacheStatus, err error, now time.Time) []Event {
+	policy := e.autoReset
+	if policy == nil {
+		return nil
+	}
+
+	wasted := status.MemoryUsage.CurrentWastedPercentage
+	if err != nil || wasted <= policy.WastedPercentage {
+		e.wastedSince = time.Time{}
+		e.autoResetSuppressed = false
+		return nil
+	}
+
+	if e.wastedSince.IsZero() {
+		e.wastedSince = now
+	}
+	if now.Sub(e.wastedSince) < policy.For {
+		return nil
+	}
+
+	if !e.lastAutoReset.IsZero() && now.Sub(e.lastAutoReset) < policy.MinInterval {
+		// Count suppressed resets once per episode above the threshold.
+		if !e.autoResetSuppressed {
+			e.autoResetSuppressed = true
+			e.autoResetsSuppressed++
+			level.Warn(e.logger).Log("msg", "OPcache auto reset suppressed by rate limit", "target", e.target, "wasted_percentage", wasted, "last_reset", e.lastAutoReset)
+		}
+		return nil
+	}
+
+	reason := fmt.Sprintf("wasted %.2f%% above %.2f%% for %s", wasted, policy.WastedPercentage, now.Sub(e.wastedSince).Round(time.Second))
+	e.lastAutoReset = now
+	e.wastedSince = time.Time{}
+	e.autoResets++
+
+	// Resetting does not need the lock held by the collection.
+	go func() {
+		if err := e.Reset(); err != nil {
+			level.Error(e.logger).Log("msg", "Error resetting OPcache automatically", "target", e.target, "err", err)
+			e.events.Record(newEvent(e.target, "auto_reset_failed", err.Error()))
+		}
+	}()
+
+	return []Event{newEvent(e.target, "auto_reset", reason)}
+}
+
+func init() {
+	registerCollector(collector{
+		name:    "auto_reset",
+		enabled: func(e *Exporter) bool { return e.autoReset != nil },
+		update: func(e *Exporter, ch chan<- prometheus.Metric, payload *Payload) error {
+			ch <- prometheus.MustNewConstMetric(e.autoResetsDesc, prometheus.CounterValue, e.autoResets)
+			ch <- prometheus.MustNewConstMetric(e.autoResetsSuppressedDesc, prometheus.CounterValue, e.autoResetsSuppressed)
+			return nil
+		},
+	})
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// scrapeTimeoutHeader carries the timeout of the scrapes of Prometheus.
+const scrapeTimeoutHeader = "X-Prometheus-Scrape-Timeout-Seconds"
+
+// ScrapeBudget bounds the collection of the targets by the timeout of the
+// scrape, so that a few slow targets cannot make the whole scrape exceed it
+// and be dropped by Prometheus.
+type ScrapeBudget struct {
+	// offset is kept from the timeout to write the response in time.
+	offset time.Duration
+}
+
+// NewScrapeBudget returns a ScrapeBudget keeping offset from the timeout of
+// the scrapes, or nil if budgeting is disabled.
+func NewScrapeBudget(enabled bool, offset time.Duration) *ScrapeBudget {
+	if !enabled {
+		return nil
+	}
+	return &ScrapeBudget{offset: offset}
+}
+
+// withTimeout returns a context bounded by the timeout of a scrape, minus the
+// offset, or without deadline if it is 0. It is safe to call on a nil
+// ScrapeBudget, which never sets a deadline.
+func (b *ScrapeBudget) withTimeout(parent context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if b == nil || timeout <= 0 {
+		return context.WithCancel(parent)
+	}
+	return context.WithTimeout(parent, max(timeout-b.offset, 0))
+}
+
+// scrapeContext returns the context of the collection of the targets for the
+// scrape requested by r, canceled with the request and bounded by the timeout
+// given by its header.
+func (b *ScrapeBudget) scrapeContext(r *http.Request) (context.Context, context.CancelFunc) {
+	var timeout time.Duration
+	if seconds, err := strconv.ParseFloat(r.Header.Get(scrapeTimeoutHeader), 64); err == nil && seconds > 0 {
+		timeout = time.Duration(seconds * float64(time.Second))
+	}
+	return b.withTimeout(r.Context(), timeout)
+}
+
+// shareContext returns the context of a target collected after rounds-1
+// others by the same goroutine, allocating it an equal share of the time
+// left before the deadline of ctx.
+func shareContext(ctx context.Context, rounds int) (context.Context, context.CancelFunc) {
+	deadline, ok := ctx.Deadline()
+	if !ok || rounds <= 1 {
+		return context.WithCancel(ctx)
+	}
+	now := time.Now()
+	return context.WithDeadline(ctx, now.Add(deadline.Sub(now)/time.Duration(rounds)))
+}
+
+// scrapeHandler serves the metrics of the gatherer returned by gather for
+// the context of each scrape, so that the targets are collected within the
+// timeout of their own scrape. Like the handlers of promhttp, it serves at
+// most opts.MaxRequestsInFlight scrapes at once, within opts.Timeout.
+func scrapeHandler(gather func(ctx context.Context) prometheus.Gatherer, budget *ScrapeBudget, opts promhttp.HandlerOpts) http.Handler {
+	maxRequests, timeout := opts.MaxRequestsInFlight, opts.Timeout
+	opts.MaxRequestsInFlight, opts.Timeout = 0, 0
+
+	var inFlight chan struct{}
+	if maxRequests > 0 {
+		inFlight = make(chan struct{}, maxRequests)
+	}
+
+	var handler http.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if inFlight != nil {
+			select {
+			case inFlight <- struct{}{}:
+				defer func() { <-inFlight }()
+			default:
+				http.Error(w, fmt.Sprintf("Limit of concurrent requests reached (%d), try again later.", maxRequests), http.StatusServiceUnavailable)
+				return
+			}
+		}
+
+		ctx, cancel := budget.scrapeContext(r)
+		defer cancel()
+		promhttp.HandlerFor(gather(ctx), opts).ServeHTTP(w, r)
+	})
+	if timeout > 0 {
+		handler = http.TimeoutHandler(handler, timeout, fmt.Sprintf("Exceeded configured timeout of %v.\n", timeout))
+	}
+	return handler
+}
+
+// connDeadline returns the deadline of the context, or the timeout from now
+// if it has none.
+func connDeadline(ctx context.Context, timeout time.Duration) time.Time {
+	if deadline, ok := ctx.Deadline(); ok {
+		return deadline
+	}
+	return time.Now().Add(timeout)
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// TestScrapeContext checks that each scrape is bounded by its own timeout,
+// whatever the timeouts of the other scrapes.
+func TestScrapeContext(t *testing.T) {
+	budget := NewScrapeBudget(true, 500*time.Millisecond)
+
+	bounded := httptest.NewRequest("GET", "/metrics", nil)
+	bounded.Header.Set(scrapeTimeoutHeader, "10")
+	boundedCtx, cancel := budget.scrapeContext(bounded)
+	defer cancel()
+
+	// A scrape without timeout, served meanwhile, is not bounded, and does
+	// not lift the deadline of the first one.
+	unbounded := httptest.NewRequest("GET", "/metrics", nil)
+	unboundedCtx, cancel := budget.scrapeContext(unbounded)
+	defer cancel()
+
+	deadline, ok := boundedCtx.Deadline()
+	if !ok {
+		t.Fatal("scrape with a timeout has no deadline")
+	}
+	if left := time.Until(deadline); left > 9500*time.Millisecond || left < 9*time.Second {
+		t.Errorf("deadline in %s, want the timeout minus the offset", left)
+	}
+	if _, ok := unboundedCtx.Deadline(); ok {
+		t.Error("scrape without timeout has a deadline")
+	}
+
+	// Disabled budgets never set a deadline.
+	var disabled *ScrapeBudget
+	ctx, cancel := disabled.scrapeContext(bounded)
+	defer cancel()
+	if _, ok := ctx.Deadline(); ok {
+		t.Error("scrape with a disabled budget has a deadline")
+	}
+}
+
+func TestShareContext(t *testing.T) {
+	parent, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	ctx, cancel := shareContext(parent, 4)
+	defer cancel()
+	deadline, _ := ctx.Deadline()
+	if left := time.Until(deadline); left > 2500*time.Millisecond || left < 2*time.Second {
+		t.Errorf("deadline in %s, want a quarter of the time left", left)
+	}
+
+	ctx, cancel = shareContext(context.Background(), 4)
+	defer cancel()
+	if _, ok := ctx.Deadline(); ok {
+		t.Error("share of a scrape without deadline has a deadline")
+	}
+}
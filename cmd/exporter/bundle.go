@@ -0,0 +1,323 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alecthomas/kingpin/v2"
+	"github.com/prometheus/common/version"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// bundleRecentErrors is the number of scrape errors kept by target for
+	// support bundles.
+	bundleRecentErrors = 10
+	// bundleMaxPayload is the size of the largest raw payload added to
+	// support bundles.
+	bundleMaxPayload = 16 << 20
+
+	redacted = "<redacted>"
+)
+
+// scrapeError is a scrape error kept for support bundles.
+type scrapeError struct {
+	Time  time.Time `json:"time"`
+	Error string    `json:"error"`
+}
+
+// recordError keeps the error of a failed scrape for support bundles.
+func (e *Exporter) recordError(err error) {
+	e.recentErrors = append(e.recentErrors, scrapeError{Time: time.Now(), Error: err.Error()})
+	if len(e.recentErrors) > bundleRecentErrors {
+		e.recentErrors = e.recentErrors[1:]
+	}
+}
+
+// supportBundle builds archives gathering what bug reports need: version,
+// flags and effective configuration with secrets redacted, targets, with
+// their recent errors and their raw payloads requested when the archive is
+// built, and events.
+type supportBundle struct {
+	api    *api
+	events *EventLog
+
+	mutex  sync.Mutex
+	config *Config
+}
+
+func newSupportBundle(api *api, events *EventLog, config *Config) *supportBundle {
+	return &supportBundle{api: api, events: events, config: config}
+}
+
+// setConfig sets the effective configuration, once reloaded.
+func (b *supportBundle) setConfig(config *Config) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.config = config
+}
+
+type bundleTarget struct {
+	Target        string        `json:"target"`
+	Up            bool          `json:"up"`
+	FailureReason string        `json:"failure_reason,omitempty"`
+	Endpoint      string        `json:"endpoint,omitempty"`
+	RecentErrors  []scrapeError `json:"recent_errors"`
+}
+
+// ServeHTTP serves the support bundle as a gzipped tar archive. Errors
+// truncate the archive, as they happen once it is being sent.
+func (b *supportBundle) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	name := "opcache-exporter-support-" + time.Now().UTC().Format("20060102T150405Z")
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+name+`.tar.gz"`)
+
+	ctx, cancel := b.api.context(r)
+	defer cancel()
+	b.write(ctx, w, name)
+}
+
+// bundlePayload is the raw payload of a target, or the error requesting it.
+type bundlePayload struct {
+	target  string
+	content []byte
+	err     error
+}
+
+// fetchPayloads requests the payloads of the targets, without the scripts,
+// which may be hundreds of thousands, at most b.api.workers at once. The
+// payloads are sent as they are received, so that at most one by worker is
+// held in memory, until ctx is canceled.
+func (b *supportBundle) fetchPayloads(ctx context.Context, exporters []*Exporter) <-chan bundlePayload {
+	payloads := make(chan bundlePayload)
+	go func() {
+		defer close(payloads)
+
+		var wg sync.WaitGroup
+		workers := make(chan struct{}, b.api.workers)
+		for _, e := range exporters {
+			wg.Add(1)
+			workers <- struct{}{}
+			go func(e *Exporter) {
+				defer wg.Done()
+				defer func() { <-workers }()
+
+				payload := bundlePayload{target: redactURI(e.Target())}
+				payload.content, _, payload.err = e.fetchServed(ctx, map[string]string{scriptSkipHeader: scriptsCollector})
+				if len(payload.content) > bundleMaxPayload {
+					payload.content, payload.err = nil, fmt.Errorf("payload of %d bytes larger than %d bytes", len(payload.content), bundleMaxPayload)
+				}
+				select {
+				case payloads <- payload:
+				case <-ctx.Done():
+				}
+			}(e)
+		}
+		wg.Wait()
+	}()
+	return payloads
+}
+
+// write writes the archive, whose files are in the directory name, with the
+// payloads of the targets requested before the deadline of ctx.
+func (b *supportBundle) write(ctx context.Context, w io.Writer, name string) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	gz := gzip.NewWriter(w)
+	archive := tar.NewWriter(gz)
+	now := time.Now()
+	add := func(file string, content []byte) error {
+		header := &tar.Header{Name: name + "/" + file, Mode: 0644, Size: int64(len(content)), ModTime: now}
+		if err := archive.WriteHeader(header); err != nil {
+			return err
+		}
+		_, err := archive.Write(content)
+		return err
+	}
+	addJSON := func(file string, v interface{}) error {
+		var content bytes.Buffer
+		encoder := json.NewEncoder(&content)
+		encoder.SetEscapeHTML(false)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(v); err != nil {
+			return err
+		}
+		return add(file, content.Bytes())
+	}
+
+	b.mutex.Lock()
+	config, err := yaml.Marshal(redactConfig(b.config))
+	b.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+
+	exporters := b.api.sortedTargets()
+	var targets []bundleTarget
+	for _, e := range exporters {
+		e.mutex.RLock()
+		target := bundleTarget{
+			Target:        redactURI(e.Target()),
+			Up:            e.up,
+			FailureReason: e.failureReason,
+			RecentErrors:  append([]scrapeError{}, e.recentErrors...),
+		}
+		if e.active != nil {
+			target.Endpoint = e.active.name
+		}
+		e.mutex.RUnlock()
+		targets = append(targets, target)
+	}
+
+	steps := []func() error{
+		func() error { return addJSON("version.json", bundleVersion()) },
+		func() error { return addJSON("flags.json", redactFlags(kingpin.CommandLine)) },
+		func() error { return add("config.yaml", config) },
+		func() error { return addJSON("targets.json", targets) },
+		func() error { return addJSON("events.json", b.events.Events()) },
+	}
+	for _, step := range steps {
+		if err := step(); err != nil {
+			return err
+		}
+	}
+	for payload := range b.fetchPayloads(ctx, exporters) {
+		file, content := "payloads/"+bundleFileName(payload.target), payload.content
+		if payload.err != nil {
+			file, content = file+".error.txt", []byte(payload.err.Error()+"\n")
+		} else {
+			file += ".json"
+		}
+		if err := add(file, content); err != nil {
+			return err
+		}
+	}
+
+	if err := archive.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+var bundleFileNameRE = regexp.MustCompile(`[^a-zA-Z0-9._-]+`)
+
+// bundleFileName returns a file name for a target.
+func bundleFileName(target string) string {
+	return strings.Trim(bundleFileNameRE.ReplaceAllString(target, "_"), "_")
+}
+
+func bundleVersion() map[string]string {
+	info := map[string]string{
+		"version":    version.Info(),
+		"build":      version.BuildContext(),
+		"go_version": runtime.Version(),
+		"os":         runtime.GOOS,
+		"arch":       runtime.GOARCH,
+	}
+	if build, ok := debug.ReadBuildInfo(); ok {
+		info["module_version"] = build.Main.Version
+		for _, setting := range build.Settings {
+			if setting.Key == "vcs.revision" {
+				info["revision"] = setting.Value
+			}
+		}
+	}
+	return info
+}
+
+// redactFlags returns the values of the flags, redacting tokens and URLs,
+// such as those of webhooks, but not the paths of the files containing them.
+func redactFlags(app *kingpin.Application) map[string]string {
+	flags := map[string]string{}
+	for _, flag := range app.Model().Flags {
+		value := flag.Value.String()
+		switch {
+		case flag.Name == "opcache.fcgi-uri":
+			value = redactURI(value)
+		case strings.HasSuffix(flag.Name, "-file"):
+		case len(value) > 0 && (strings.Contains(flag.Name, "token") || strings.HasSuffix(flag.Name, "-url")):
+			value = redacted
+		}
+		flags[flag.Name] = value
+	}
+	return flags
+}
+
+// redactConfig returns a copy of the configuration without its tokens.
+func redactConfig(config *Config) *Config {
+	c := *config
+	redactAll := func(values []string) []string {
+		out := make([]string, len(values))
+		for i := range out {
+			out[i] = redacted
+		}
+		return out
+	}
+	c.Web.ReadTokens = redactAll(c.Web.ReadTokens)
+	c.Web.AdminTokens = redactAll(c.Web.AdminTokens)
+	return &c
+}
+
+var uriListRE = regexp.MustCompile(`[^;\n]+`)
+
+// redactURI redacts the passwords of the URIs of targets, which may be
+// separated by semicolons or newlines.
+func redactURI(uris string) string {
+	return uriListRE.ReplaceAllStringFunc(uris, func(uri string) string {
+		if u, err := url.Parse(uri); err == nil && u.User != nil {
+			return u.Redacted()
+		}
+		return uri
+	})
+}
+
+// downloadSupportBundle downloads the support bundle of a running exporter
+// into output.
+func downloadSupportBundle(exporterURL, tokenFile, output string) error {
+	req, err := http.NewRequest(http.MethodGet, strings.TrimSuffix(exporterURL, "/")+"/api/v1/support-bundle", nil)
+	if err != nil {
+		return err
+	}
+	if len(tokenFile) > 0 {
+		token, err := os.ReadFile(tokenFile)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	}
+
+	res, err := (&http.Client{Timeout: time.Minute}).Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(io.LimitReader(res.Body, 512))
+		return fmt.Errorf("unexpected status %s: %s", res.Status, strings.TrimSpace(string(message)))
+	}
+
+	file, err := os.Create(output)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(file, res.Body); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
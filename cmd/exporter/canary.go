@@ -0,0 +1,61 @@
+package main
+
+import (
+	"errors"
+	"time"
+
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// CompileCanary compiles the canary script afresh, invalidating it first, to
+// check that the OPcache of the target still accepts new entries.
+func (e *Exporter) CompileCanary() error {
+	args := struct {
+		Script string `json:"script"`
+	}{e.canaryScript}
+
+	var compiled bool
+	if err := e.runAction("canary", args, &compiled); err != nil {
+		return err
+	}
+	if !compiled {
+		return errors.New("compiling canary script failed")
+	}
+	return nil
+}
+
+// runCanary compiles the canary script periodically, and records the
+// outcome. It never returns.
+func (e *Exporter) runCanary() {
+	for {
+		start := time.Now()
+		err := e.CompileCanary()
+		duration := time.Since(start)
+		if err != nil {
+			level.Warn(e.logger).Log("msg", "Error compiling canary script", "target", e.target, "script", e.canaryScript, "err", err)
+		}
+
+		e.mutex.Lock()
+		e.canaryChecked = true
+		e.canarySuccess = err == nil
+		e.canaryDuration = duration
+		e.mutex.Unlock()
+
+		time.Sleep(e.canaryInterval)
+	}
+}
+
+func init() {
+	registerCollector(collector{
+		name:    "canary",
+		enabled: func(e *Exporter) bool { return len(e.canaryScript) > 0 },
+		update: func(e *Exporter, ch chan<- prometheus.Metric, payload *Payload) error {
+			if e.canaryChecked {
+				ch <- prometheus.MustNewConstMetric(e.canarySuccessDesc, prometheus.GaugeValue, boolMetric(e.canarySuccess))
+				ch <- prometheus.MustNewConstMetric(e.canaryDurationDesc, prometheus.GaugeValue, e.canaryDuration.Seconds())
+			}
+			return nil
+		},
+	})
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Shard selects the targets scraped by an exporter instance, when several
+// instances share the same list of targets.
+type Shard struct {
+	index       int
+	count       int
+	assignments map[string]int
+}
+
+// NewShard returns the shard of the given index among count shards. Targets
+// are statically assigned to shards by the configuration, or else by hashing
+// their URI.
+func NewShard(index, count int, config *Config) (*Shard, error) {
+	if count < 1 || index < 0 || index >= count {
+		return nil, fmt.Errorf("invalid shard %d of %d", index, count)
+	}
+
+	for target, assigned := range config.Cluster.Assignments {
+		if assigned < 0 || assigned >= count {
+			return nil, fmt.Errorf("target %q assigned to invalid shard %d", target, assigned)
+		}
+	}
+
+	return &Shard{
+		index:       index,
+		count:       count,
+		assignments: config.Cluster.Assignments,
+	}, nil
+}
+
+// Owns tells whether the target is scraped by this shard.
+func (s *Shard) Owns(target string) bool {
+	if assigned, ok := s.assignments[target]; ok {
+		return assigned == s.index
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte(target))
+	return int(h.Sum32()%uint32(s.count)) == s.index
+}
+
+// Collector returns a collector exporting the shard identity and the number
+// of targets it owns.
+func (s *Shard) Collector(targets int) prometheus.Collector {
+	info := prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace:   "opcache_exporter",
+		Name:        "shard_info",
+		Help:        "Shard of targets scraped by this exporter instance.",
+		ConstLabels: prometheus.Labels{"shard": strconv.Itoa(s.index), "shards": strconv.Itoa(s.count)},
+	})
+	info.Set(1)
+
+	owned := prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "opcache_exporter",
+		Name:      "shard_targets",
+		Help:      "Number of targets scraped by this exporter instance.",
+	})
+	owned.Set(float64(targets))
+
+	return collectorGroup{info, owned}
+}
+
+// collectorGroup groups several collectors into one.
+type collectorGroup []prometheus.Collector
+
+func (c collectorGroup) Describe(ch chan<- *prometheus.Desc) {
+	for _, collector := range c {
+		collector.Describe(ch)
+	}
+}
+
+func (c collectorGroup) Collect(ch chan<- prometheus.Metric) {
+	for _, collector := range c {
+		collector.Collect(ch)
+	}
+}
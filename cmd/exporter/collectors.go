@@ -0,0 +1,113 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Collectors of the exporter. The status, JIT, scripts, configuration, file
+// cache and realpath cache collectors can be disabled, and the scripts and
+// custom collectors, being expensive for the targets, can run less often than
+// scrapes.
+const (
+	statusCollector        = "status"
+	jitCollector           = "jit"
+	scriptsCollector       = "scripts"
+	customCollector        = "custom"
+	executionCollector     = "execution"
+	configurationCollector = "configuration"
+	fileCacheCollector     = "file_cache"
+	realpathCacheCollector = "realpath_cache"
+)
+
+// collector collects a group of metrics of a target.
+type collector struct {
+	name string
+	// fromPayload tells whether the metrics are read from the payload of
+	// the scrape, so that the collector fails when the target cannot be
+	// scraped.
+	fromPayload bool
+	// section is the section of the payload read by the collector, which
+	// fails without running if the generated status script failed to
+	// evaluate it.
+	section string
+	// enabled tells whether the collector runs on a target.
+	enabled func(e *Exporter) bool
+	// update collects the metrics of the target, with its mutex held.
+	update func(e *Exporter, ch chan<- prometheus.Metric, payload *Payload) error
+}
+
+// collectorRegistry lists the collectors, which register themselves in the
+// init function of their file.
+var collectorRegistry []collector
+
+func registerCollector(c collector) {
+	collectorRegistry = append(collectorRegistry, c)
+}
+
+// runCollectors runs the collectors enabled on the target, and collects
+// their duration and success. scrapeErr is the error of the scrape, failing
+// the collectors reading its payload, while the failure of a section of the
+// payload only fails the collectors reading it.
+func (e *Exporter) runCollectors(ch chan<- prometheus.Metric, payload *Payload, scrapeErr error) {
+	for _, c := range collectorRegistry {
+		if !c.enabled(e) {
+			continue
+		}
+
+		start := time.Now()
+		var err error
+		if msg, ok := payload.Errors[c.section]; ok && len(c.section) > 0 {
+			err = fmt.Errorf("section %s: %s", c.section, msg)
+		} else {
+			err = c.update(e, ch, payload)
+		}
+		duration := time.Since(start)
+
+		if err != nil {
+			level.Warn(e.logger).Log("msg", "Error running collector", "target", e.target, "collector", c.name, "err", err)
+		} else if c.fromPayload {
+			err = scrapeErr
+		}
+
+		ch <- prometheus.MustNewConstMetric(e.collectorDurationDesc, prometheus.GaugeValue, duration.Seconds(), c.name)
+		ch <- prometheus.MustNewConstMetric(e.collectorSuccessDesc, prometheus.GaugeValue, boolMetric(err == nil), c.name)
+	}
+}
+
+func init() {
+	registerCollector(collector{
+		name:        customCollector,
+		fromPayload: true,
+		section:     "custom",
+		enabled:     func(e *Exporter) bool { return len(e.jsonMetrics) > 0 },
+		update: func(e *Exporter, ch chan<- prometheus.Metric, payload *Payload) error {
+			var errs []error
+			for _, m := range e.jsonMetrics {
+				if err := m.collect(ch, payload); err != nil {
+					errs = append(errs, fmt.Errorf("metric %s: %w", m.config.Name, err))
+				}
+			}
+			return errors.Join(errs...)
+		},
+	})
+
+	registerCollector(collector{
+		name:        "derived",
+		fromPayload: true,
+		enabled:     func(e *Exporter) bool { return len(e.derivedMetrics) > 0 },
+		update: func(e *Exporter, ch chan<- prometheus.Metric, payload *Payload) error {
+			var errs []error
+			for _, m := range e.derivedMetrics {
+				if err := m.collect(ch, payload); err != nil {
+					errs = append(errs, fmt.Errorf("metric %s: %w", m.config.Name, err))
+				}
+			}
+			return errors.Join(errs...)
+		},
+	})
+}
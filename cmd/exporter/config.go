@@ -0,0 +1,418 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+var metricNameRE = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+
+// Config contains the settings read from the configuration file.
+type Config struct {
+	Collectors     []CustomCollectorConfig `yaml:"collectors"`
+	JSONMappings   []MetricMappingConfig   `yaml:"json_mappings"`
+	DerivedMetrics []DerivedMetricConfig   `yaml:"derived_metrics"`
+	Cluster        ClusterConfig           `yaml:"cluster"`
+	Web            WebConfig               `yaml:"web"`
+	ResetSchedules []ResetScheduleConfig   `yaml:"reset_schedules"`
+	AutoReset      *AutoResetConfig        `yaml:"auto_reset"`
+	Warmup         *WarmupConfig           `yaml:"warmup"`
+	Entrypoints    *EntrypointsConfig      `yaml:"entrypoints"`
+	Manifest       *ManifestConfig         `yaml:"manifest"`
+	Vault          *VaultConfig            `yaml:"vault"`
+	Registration   *RegistrationConfig     `yaml:"registration"`
+	AgentCheck     *AgentCheckConfig       `yaml:"agent_check"`
+}
+
+// AgentCheckConfig sets the thresholds of the states of the targets reported
+// to load balancers.
+type AgentCheckConfig struct {
+	// CacheFull and Restart are the states reported while the cache is full
+	// and while it restarts, drain by default.
+	CacheFull string `yaml:"cache_full"`
+	Restart   string `yaml:"restart"`
+	// WastedPercentage, if not 0, drains targets whose wasted memory
+	// percentage exceeds it.
+	WastedPercentage float64 `yaml:"wasted_percentage"`
+	// MinHitRate, if not 0, drains targets whose hit rate percentage is
+	// under it.
+	MinHitRate float64 `yaml:"min_hit_rate"`
+	// CacheTTL is the duration for which the state of a target is reused,
+	// 2s by default, and Timeout the maximum duration of its status
+	// requests, 1s by default.
+	CacheTTL time.Duration `yaml:"cache_ttl"`
+	Timeout  time.Duration `yaml:"timeout"`
+}
+
+// RegistrationConfig registers the exporter in Consul or etcd on startup,
+// and deregisters it on shutdown.
+type RegistrationConfig struct {
+	// Backend is either consul or etcd.
+	Backend string `yaml:"backend"`
+	// Endpoint is the URL of the Consul agent, or of the etcd server.
+	Endpoint string `yaml:"endpoint"`
+	// TokenFile is the path of a file containing the ACL token of Consul, or
+	// the auth token of etcd, read on every request.
+	TokenFile string `yaml:"token_file"`
+	// Service is the name of the registered service.
+	Service string `yaml:"service"`
+	// Address is the host and port advertised, the host name and the port
+	// of --web.listen-address if empty.
+	Address string `yaml:"address"`
+	// Labels are added to the metadata of the Consul service, or to the
+	// target group stored in etcd.
+	Labels map[string]string `yaml:"labels"`
+	// Tags are the tags of the Consul service.
+	Tags []string `yaml:"tags"`
+	// Prefix is the prefix of the etcd key, followed by the service name and
+	// the address.
+	Prefix string `yaml:"prefix"`
+	// TTL is the interval of the Consul health check, and the lease of the
+	// etcd key.
+	TTL time.Duration `yaml:"ttl"`
+}
+
+// VaultConfig fetches credentials from HashiCorp Vault. Secrets are
+// referenced as the path of a secret and one of its keys, such as
+// secret/data/opcache-exporter#admin_token.
+type VaultConfig struct {
+	// Address is the URL of the Vault server.
+	Address string `yaml:"address"`
+	// KubernetesRole, if set, logs in with the Kubernetes auth method
+	// mounted at KubernetesMount. Otherwise, the token is read from
+	// TokenFile, or from the VAULT_TOKEN environment variable.
+	KubernetesRole  string `yaml:"kubernetes_role"`
+	KubernetesMount string `yaml:"kubernetes_mount"`
+	TokenFile       string `yaml:"token_file"`
+	// RefreshInterval is the interval between renewals of the token and
+	// refreshes of the secrets.
+	RefreshInterval time.Duration `yaml:"refresh_interval"`
+	// ReadTokens and AdminTokens are added to the tokens of the web
+	// interface.
+	ReadTokens  []string `yaml:"read_tokens"`
+	AdminTokens []string `yaml:"admin_tokens"`
+	// TLSCert and TLSKey are the PEM encoded certificate and private key of
+	// the web interface, replacing --web.tls-cert-file and
+	// --web.tls-key-file.
+	TLSCert string `yaml:"tls_cert"`
+	TLSKey  string `yaml:"tls_key"`
+}
+
+// refs returns the references of all the secrets fetched from Vault.
+func (c *VaultConfig) refs() []string {
+	refs := append(append([]string{}, c.ReadTokens...), c.AdminTokens...)
+	if len(c.TLSCert) > 0 {
+		refs = append(refs, c.TLSCert, c.TLSKey)
+	}
+	return refs
+}
+
+// EntrypointsConfig lists entrypoints of the application, periodically
+// compiled on the targets to catch broken deployments.
+type EntrypointsConfig struct {
+	// Scripts are the paths of the entrypoints on the targets.
+	Scripts []string `yaml:"scripts"`
+	// Interval is the duration between two validations.
+	Interval time.Duration `yaml:"interval"`
+	// Targets are the URIs of the validated targets, all of them if empty.
+	Targets []string `yaml:"targets"`
+}
+
+// ManifestConfig compares the cached scripts of targets with a manifest of
+// the files of the application, such as one generated at build time.
+type ManifestConfig struct {
+	// Path is the path of the manifest, listing a file per line.
+	Path string `yaml:"path"`
+	// Root is the directory of the relative paths of the manifest on the
+	// targets.
+	Root string `yaml:"root"`
+	// Targets are the URIs of the compared targets, all of them if empty.
+	Targets []string `yaml:"targets"`
+}
+
+// WarmupConfig warms up the OPcache of targets after it restarts.
+type WarmupConfig struct {
+	// Scripts are the paths of the scripts compiled on the target.
+	Scripts []string `yaml:"scripts"`
+	// URLs are requested by the exporter, to compile the scripts serving them.
+	URLs []string `yaml:"urls"`
+	// Targets are the URIs of the warmed up targets, all of them if empty.
+	Targets []string `yaml:"targets"`
+}
+
+// AutoResetConfig resets the OPcache of targets whose wasted memory stays
+// above a threshold.
+type AutoResetConfig struct {
+	// WastedPercentage is the threshold of current_wasted_percentage.
+	WastedPercentage float64 `yaml:"wasted_percentage"`
+	// For is the duration over which the threshold must be exceeded.
+	For time.Duration `yaml:"for"`
+	// MinInterval is the minimum duration between two resets of a target.
+	MinInterval time.Duration `yaml:"min_interval"`
+	// Targets are the URIs of the reset targets, all of them if empty.
+	Targets []string `yaml:"targets"`
+}
+
+// ResetScheduleConfig schedules resets of the OPcache of targets.
+type ResetScheduleConfig struct {
+	// Schedule is a cron-style schedule, such as "0 3 * * *".
+	Schedule string `yaml:"schedule"`
+	// Targets are the URIs of the reset targets, all of them if empty.
+	Targets []string `yaml:"targets"`
+
+	schedule *cronSchedule
+}
+
+// WebConfig contains the settings of the web interface.
+type WebConfig struct {
+	// ReadTokens, if any, are required by read-only endpoints, such as
+	// metrics and status APIs, which also accept admin tokens.
+	ReadTokens []string `yaml:"read_tokens"`
+	// AdminTokens are accepted by admin endpoints.
+	AdminTokens []string `yaml:"admin_tokens"`
+	// ReadTokenFiles and AdminTokenFiles are paths of files containing
+	// tokens, read on every request.
+	ReadTokenFiles  []string `yaml:"read_token_files"`
+	AdminTokenFiles []string `yaml:"admin_token_files"`
+}
+
+// ClusterConfig contains the settings of exporter instances sharing targets.
+type ClusterConfig struct {
+	// Assignments maps targets to the index of the shard scraping them.
+	Assignments map[string]int `yaml:"assignments"`
+}
+
+// CustomCollectorConfig defines a collector running a PHP snippet on the
+// targets, and the metrics extracted from the value it returns.
+type CustomCollectorConfig struct {
+	Name    string                `yaml:"name"`
+	PHP     string                `yaml:"php"`
+	Metrics []MetricMappingConfig `yaml:"metrics"`
+}
+
+// MetricMappingConfig maps fields of a JSON document to a metric. Path
+// selects, with a JSONPath subset ($.key.key[0]), an object or a list of
+// objects; each of them yields a sample whose value and labels are read from
+// the given fields.
+type MetricMappingConfig struct {
+	Name   string            `yaml:"name"`
+	Help   string            `yaml:"help"`
+	Type   string            `yaml:"type"`
+	Path   string            `yaml:"path"`
+	Value  string            `yaml:"value"`
+	Labels map[string]string `yaml:"labels"`
+}
+
+// DerivedMetricConfig defines a gauge computed from the fields of the OPcache
+// status with an arithmetic expression.
+type DerivedMetricConfig struct {
+	Name string `yaml:"name"`
+	Help string `yaml:"help"`
+	Expr string `yaml:"expr"`
+
+	expr expr
+}
+
+// LoadConfig reads and validates the configuration file. An empty path
+// results in an empty configuration.
+func LoadConfig(path string) (*Config, error) {
+	if path == "" {
+		return &Config{}, nil
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return parseConfig(path, content)
+}
+
+// parseConfig parses and validates the content of the configuration file.
+func parseConfig(path string, content []byte) (*Config, error) {
+	config := &Config{}
+	if err := yaml.Unmarshal(content, config); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+
+	if err := config.validate(); err != nil {
+		return nil, fmt.Errorf("validating %s: %w", path, err)
+	}
+
+	return config, nil
+}
+
+func (c *Config) validate() error {
+	collectors := map[string]bool{}
+	for i := range c.Collectors {
+		collector := &c.Collectors[i]
+		if !metricNameRE.MatchString(collector.Name) {
+			return fmt.Errorf("invalid collector name %q", collector.Name)
+		}
+		if collectors[collector.Name] {
+			return fmt.Errorf("duplicate collector name %q", collector.Name)
+		}
+		collectors[collector.Name] = true
+
+		if collector.PHP == "" {
+			return fmt.Errorf("collector %q: missing php snippet", collector.Name)
+		}
+
+		for j := range collector.Metrics {
+			metric := &collector.Metrics[j]
+			if metric.Help == "" {
+				metric.Help = fmt.Sprintf("Custom metric from collector %s.", collector.Name)
+			}
+			if err := metric.validate(); err != nil {
+				return fmt.Errorf("collector %q: %w", collector.Name, err)
+			}
+		}
+	}
+
+	for i := range c.JSONMappings {
+		mapping := &c.JSONMappings[i]
+		if mapping.Help == "" {
+			mapping.Help = "Metric mapped from the JSON document returned by the target."
+		}
+		if err := mapping.validate(); err != nil {
+			return fmt.Errorf("json mapping: %w", err)
+		}
+	}
+
+	for i := range c.DerivedMetrics {
+		metric := &c.DerivedMetrics[i]
+		if !metricNameRE.MatchString(metric.Name) {
+			return fmt.Errorf("derived metric: invalid metric name %q", metric.Name)
+		}
+		if metric.Help == "" {
+			metric.Help = "Derived metric: " + metric.Expr
+		}
+
+		var err error
+		if metric.expr, err = parseExpr(metric.Expr); err != nil {
+			return fmt.Errorf("derived metric %q: %w", metric.Name, err)
+		}
+	}
+
+	if c.AutoReset != nil {
+		if c.AutoReset.WastedPercentage <= 0 || c.AutoReset.WastedPercentage > 100 {
+			return fmt.Errorf("auto reset: invalid wasted percentage %v", c.AutoReset.WastedPercentage)
+		}
+		if c.AutoReset.MinInterval == 0 {
+			c.AutoReset.MinInterval = time.Hour
+		}
+	}
+
+	if c.Warmup != nil && len(c.Warmup.Scripts) == 0 && len(c.Warmup.URLs) == 0 {
+		return fmt.Errorf("warmup: missing scripts or urls")
+	}
+
+	if c.Entrypoints != nil {
+		if len(c.Entrypoints.Scripts) == 0 {
+			return fmt.Errorf("entrypoints: missing scripts")
+		}
+		if c.Entrypoints.Interval == 0 {
+			c.Entrypoints.Interval = 5 * time.Minute
+		}
+	}
+
+	if c.Manifest != nil && len(c.Manifest.Path) == 0 {
+		return fmt.Errorf("manifest: missing path")
+	}
+
+	if c.Vault != nil {
+		if len(c.Vault.Address) == 0 {
+			return fmt.Errorf("vault: missing address")
+		}
+		if (len(c.Vault.TLSCert) == 0) != (len(c.Vault.TLSKey) == 0) {
+			return fmt.Errorf("vault: tls_cert and tls_key must be given together")
+		}
+		for _, ref := range c.Vault.refs() {
+			if path, key, ok := strings.Cut(ref, "#"); !ok || len(path) == 0 || len(key) == 0 {
+				return fmt.Errorf("vault: invalid secret %q, expected path#key", ref)
+			}
+		}
+		if c.Vault.KubernetesMount == "" {
+			c.Vault.KubernetesMount = "kubernetes"
+		}
+		if c.Vault.RefreshInterval == 0 {
+			c.Vault.RefreshInterval = 5 * time.Minute
+		}
+	}
+
+	if c.Registration != nil {
+		switch c.Registration.Backend {
+		case "consul", "etcd":
+		default:
+			return fmt.Errorf("registration: invalid backend %q, expected consul or etcd", c.Registration.Backend)
+		}
+		if len(c.Registration.Endpoint) == 0 {
+			return fmt.Errorf("registration: missing endpoint")
+		}
+		for label := range c.Registration.Labels {
+			if !metricNameRE.MatchString(label) {
+				return fmt.Errorf("registration: invalid label name %q", label)
+			}
+		}
+		if c.Registration.Service == "" {
+			c.Registration.Service = "opcache-exporter"
+		}
+		if c.Registration.Prefix == "" {
+			c.Registration.Prefix = "/prometheus/targets"
+		}
+		if c.Registration.TTL == 0 {
+			c.Registration.TTL = 30 * time.Second
+		}
+		if c.Registration.TTL < 3*time.Second {
+			return fmt.Errorf("registration: ttl must be at least 3s")
+		}
+	}
+
+	if c.AgentCheck != nil {
+		for _, state := range []string{c.AgentCheck.CacheFull, c.AgentCheck.Restart} {
+			switch state {
+			case "", agentUp, agentDrain, agentDown:
+			default:
+				return fmt.Errorf("agent check: invalid state %q, expected up, drain or down", state)
+			}
+		}
+		if c.AgentCheck.CacheTTL < 0 || c.AgentCheck.Timeout < 0 {
+			return fmt.Errorf("agent check: cache_ttl and timeout must not be negative")
+		}
+	}
+
+	for i := range c.ResetSchedules {
+		schedule := &c.ResetSchedules[i]
+
+		var err error
+		if schedule.schedule, err = parseCron(schedule.Schedule); err != nil {
+			return fmt.Errorf("reset schedule: %w", err)
+		}
+	}
+
+	return nil
+}
+
+func (m *MetricMappingConfig) validate() error {
+	if !metricNameRE.MatchString(m.Name) {
+		return fmt.Errorf("invalid metric name %q", m.Name)
+	}
+	switch m.Type {
+	case "":
+		m.Type = "gauge"
+	case "gauge", "counter":
+	default:
+		return fmt.Errorf("metric %q: invalid type %q", m.Name, m.Type)
+	}
+	for label := range m.Labels {
+		if !metricNameRE.MatchString(label) {
+			return fmt.Errorf("metric %q: invalid label name %q", m.Name, label)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// OPcacheConfiguration contains the configuration of OPcache returned by
+// opcache_get_configuration()
+type OPcacheConfiguration struct {
+	Directives Directives `json:"directives"`
+	Blacklist  []string   `json:"blacklist"`
+}
+
+// Directives contains the directives of OPcache giving its limits, and some
+// string directives, which are empty when they are not set. The JIT
+// directives are only reported by PHP 8 and later.
+type Directives struct {
+	MemoryConsumption     int64   `json:"opcache.memory_consumption"`
+	InternedStringsBuffer int64   `json:"opcache.interned_strings_buffer"`
+	MaxAcceleratedFiles   int64   `json:"opcache.max_accelerated_files"`
+	MaxWastedPercentage   float64 `json:"opcache.max_wasted_percentage"`
+	ValidateTimestamps    bool    `json:"opcache.validate_timestamps"`
+	EnableCLI             bool    `json:"opcache.enable_cli"`
+	RevalidateFreq        int64   `json:"opcache.revalidate_freq"`
+	JIT                   *string `json:"opcache.jit"`
+	JITBufferSize         *int64  `json:"opcache.jit_buffer_size"`
+	Preload               string  `json:"opcache.preload"`
+	PreloadUser           string  `json:"opcache.preload_user"`
+	FileCache             string  `json:"opcache.file_cache"`
+	RestrictAPI           string  `json:"opcache.restrict_api"`
+}
+
+// collectConfiguration collects the directives of OPcache, so that its usage
+// can be compared with its limits.
+func (e *Exporter) collectConfiguration(ch chan<- prometheus.Metric, config *OPcacheConfiguration) {
+	directives := config.Directives
+	ch <- prometheus.MustNewConstMetric(e.configMemoryDesc, prometheus.GaugeValue, intMetric(directives.MemoryConsumption))
+	// opcache.interned_strings_buffer is given in megabytes.
+	ch <- prometheus.MustNewConstMetric(e.configInternedStringsDesc, prometheus.GaugeValue, intMetric(directives.InternedStringsBuffer<<20))
+	ch <- prometheus.MustNewConstMetric(e.configMaxFilesDesc, prometheus.GaugeValue, intMetric(directives.MaxAcceleratedFiles))
+	ch <- prometheus.MustNewConstMetric(e.configValidateTimestampsDesc, prometheus.GaugeValue, boolMetric(directives.ValidateTimestamps))
+	ch <- prometheus.MustNewConstMetric(e.configEnableCLIDesc, prometheus.GaugeValue, boolMetric(directives.EnableCLI))
+	ch <- prometheus.MustNewConstMetric(e.configRevalidateFreqDesc, prometheus.GaugeValue, intMetric(directives.RevalidateFreq))
+	if directives.JIT != nil {
+		ch <- prometheus.MustNewConstMetric(e.configJITDesc, prometheus.GaugeValue, 1, *directives.JIT)
+	}
+	if directives.JITBufferSize != nil {
+		ch <- prometheus.MustNewConstMetric(e.configJITBufferSizeDesc, prometheus.GaugeValue, intMetric(*directives.JITBufferSize))
+	}
+	ch <- prometheus.MustNewConstMetric(e.configBlacklistDesc, prometheus.GaugeValue, float64(len(config.Blacklist)))
+
+	var jit string
+	if directives.JIT != nil {
+		jit = *directives.JIT
+	}
+	ch <- prometheus.MustNewConstMetric(e.configInfoDesc, prometheus.GaugeValue, 1, directives.Preload, directives.PreloadUser, jit, directives.FileCache, directives.RestrictAPI)
+}
+
+// collectCapacity collects the usage of OPcache against the limits of its
+// configuration, for simple threshold alerts.
+func (e *Exporter) collectCapacity(ch chan<- prometheus.Metric, status *OPcacheStatus, config *OPcacheConfiguration) {
+	directives := config.Directives
+	ch <- prometheus.MustNewConstMetric(e.memoryCapacityDesc, prometheus.GaugeValue, ratioMetric(status.MemoryUsage.UsedMemory, directives.MemoryConsumption))
+	ch <- prometheus.MustNewConstMetric(e.filesCapacityDesc, prometheus.GaugeValue, ratioMetric(status.OPcacheStatistics.NumCachedKeys, directives.MaxAcceleratedFiles))
+
+	// opcache.max_wasted_percentage is reported as a fraction.
+	var wasted float64
+	if directives.MaxWastedPercentage > 0 {
+		wasted = status.MemoryUsage.CurrentWastedPercentage / 100 / directives.MaxWastedPercentage
+	}
+	ch <- prometheus.MustNewConstMetric(e.wastedCapacityDesc, prometheus.GaugeValue, wasted)
+}
+
+func init() {
+	registerCollector(collector{
+		name:        configurationCollector,
+		fromPayload: true,
+		section:     "configuration",
+		enabled:     func(e *Exporter) bool { return e.collectors[configurationCollector] },
+		update: func(e *Exporter, ch chan<- prometheus.Metric, payload *Payload) error {
+			// Scripts not generated by the exporter may not report it.
+			if payload.Configuration != nil {
+				e.collectConfiguration(ch, payload.Configuration)
+				e.collectCapacity(ch, payload.Status, payload.Configuration)
+			}
+			return nil
+		},
+	})
+}
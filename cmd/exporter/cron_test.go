@@ -0,0 +1,90 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCron(t *testing.T) {
+	tests := []struct {
+		spec  string
+		valid bool
+	}{
+		{"* * * * *", true},
+		{"0 3 * * 1-5", true},
+		{"*/15 0-6/2 1,15 * 7", true},
+		{"0 0 * *", false},
+		{"60 * * * *", false},
+		{"* 24 * * *", false},
+		{"* * 0 * *", false},
+		{"* * * 13 *", false},
+		{"* * * * 8", false},
+		{"5-1 * * * *", false},
+		{"*/0 * * * *", false},
+		{"a * * * *", false},
+		{"1-a * * * *", false},
+	}
+	for _, test := range tests {
+		_, err := parseCron(test.spec)
+		if (err == nil) != test.valid {
+			t.Errorf("%q: got error %v, want valid %t", test.spec, err, test.valid)
+		}
+	}
+}
+
+func TestCronScheduleMatches(t *testing.T) {
+	// 2024-01-07 is a Sunday.
+	at := func(day, hour, minute int) time.Time {
+		return time.Date(2024, time.January, day, hour, minute, 0, 0, time.UTC)
+	}
+
+	tests := []struct {
+		spec    string
+		time    time.Time
+		matches bool
+	}{
+		// Ranges and lists.
+		{"0 3 * * *", at(8, 3, 0), true},
+		{"0 3 * * *", at(8, 3, 1), false},
+		{"0 1-3 * * *", at(8, 2, 0), true},
+		{"0 1-3 * * *", at(8, 4, 0), false},
+		{"0,30 * * * *", at(8, 5, 30), true},
+		{"0,30 * * * *", at(8, 5, 15), false},
+		// Steps.
+		{"*/15 * * * *", at(8, 5, 45), true},
+		{"*/15 * * * *", at(8, 5, 50), false},
+		{"10-50/20 * * * *", at(8, 5, 30), true},
+		{"10-50/20 * * * *", at(8, 5, 40), false},
+		{"5/20 * * * *", at(8, 5, 45), true},
+		// Sunday is either 0 or 7.
+		{"0 0 * * 0", at(7, 0, 0), true},
+		{"0 0 * * 7", at(7, 0, 0), true},
+		{"0 0 * * 7", at(8, 0, 0), false},
+		{"0 0 * * 5-7", at(7, 0, 0), true},
+		// When both day fields are restricted, either of them matches.
+		{"0 0 1 * 1", at(1, 0, 0), true},
+		{"0 0 1 * 1", at(8, 0, 0), true},
+		{"0 0 1 * 1", at(9, 0, 0), false},
+		// When either day field starts with *, even with a step, both of
+		// them must match.
+		{"0 0 */2 * 1", at(15, 0, 0), true},
+		{"0 0 */2 * 1", at(8, 0, 0), false},
+		{"0 0 */2 * 1", at(3, 0, 0), false},
+		{"0 0 1-10 * */2", at(2, 0, 0), true},
+		{"0 0 1-10 * */2", at(1, 0, 0), false},
+		{"0 0 1-10 * */2", at(16, 0, 0), false},
+		{"0 0 */2 * *", at(3, 0, 0), true},
+		{"0 0 */2 * *", at(4, 0, 0), false},
+		// Months.
+		{"0 0 * 2 *", at(8, 0, 0), false},
+	}
+	for _, test := range tests {
+		schedule, err := parseCron(test.spec)
+		if err != nil {
+			t.Fatalf("%q: %v", test.spec, err)
+		}
+		if matches := schedule.Matches(test.time); matches != test.matches {
+			t.Errorf("%q at %s: matches %t, want %t", test.spec, test.time.Format("Mon 2006-01-02 15:04"), matches, test.matches)
+		}
+	}
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// customSection returns the payload section running the snippets of the
+// custom collectors, each one in its own function.
+func customSection(collectors []CustomCollectorConfig) payloadSection {
+	var b strings.Builder
+
+	b.WriteString("[\n")
+	for _, collector := range collectors {
+		fmt.Fprintf(&b, "    '%s' => (function () {\n%s\n    })(),\n", collector.Name, collector.PHP)
+	}
+	b.WriteString("  ]")
+
+	return payloadSection{"custom", skipped(customCollector) + " ? null : " + b.String()}
+}
+
+// jsonMetric exports a metric from a JSON document: the value returned by a
+// custom collector, or the whole document returned by the target.
+type jsonMetric struct {
+	collector  string
+	config     MetricMappingConfig
+	labelNames []string
+	valueType  prometheus.ValueType
+	desc       *prometheus.Desc
+}
+
+func newJSONMetric(collector string, config MetricMappingConfig, labels prometheus.Labels) *jsonMetric {
+	m := &jsonMetric{
+		collector: collector,
+		config:    config,
+		valueType: prometheus.GaugeValue,
+	}
+	if config.Type == "counter" {
+		m.valueType = prometheus.CounterValue
+	}
+	for label := range config.Labels {
+		m.labelNames = append(m.labelNames, label)
+	}
+	sort.Strings(m.labelNames)
+
+	m.desc = prometheus.NewDesc(config.Name, config.Help, m.labelNames, labels)
+	return m
+}
+
+func newJSONMetrics(config *Config, labels prometheus.Labels) []*jsonMetric {
+	var metrics []*jsonMetric
+	for _, collector := range config.Collectors {
+		for _, mapping := range collector.Metrics {
+			metrics = append(metrics, newJSONMetric(collector.Name, mapping, labels))
+		}
+	}
+	for _, mapping := range config.JSONMappings {
+		metrics = append(metrics, newJSONMetric("", mapping, labels))
+	}
+	return metrics
+}
+
+// mapsDocument tells whether JSON mappings export metrics from the whole
+// document returned by the target, which must then be kept with its scripts.
+func (e *Exporter) mapsDocument() bool {
+	for _, m := range e.jsonMetrics {
+		if m.collector == "" {
+			return true
+		}
+	}
+	return false
+}
+
+// collect exports the samples found in the payload.
+func (m *jsonMetric) collect(ch chan<- prometheus.Metric, payload *Payload) error {
+	raw := payload.raw
+	if m.collector != "" {
+		var ok bool
+		if raw, ok = payload.Custom[m.collector]; !ok {
+			return nil
+		}
+	}
+	if len(raw) == 0 {
+		return nil
+	}
+
+	var data interface{}
+	if err := json.Unmarshal(raw, &data); err != nil {
+		return err
+	}
+
+	entries, ok := lookupPath(data, m.config.Path)
+	if !ok {
+		return fmt.Errorf("path %q not found", m.config.Path)
+	}
+	if _, ok := entries.([]interface{}); !ok {
+		entries = []interface{}{entries}
+	}
+
+	for _, entry := range entries.([]interface{}) {
+		field, _ := lookupPath(entry, m.config.Value)
+		value, ok := numberValue(field)
+		if !ok {
+			return fmt.Errorf("invalid value for metric %s: %v", m.config.Name, field)
+		}
+
+		labelValues := make([]string, len(m.labelNames))
+		for i, label := range m.labelNames {
+			field, _ := lookupPath(entry, m.config.Labels[label])
+			labelValues[i] = stringValue(field)
+		}
+
+		metric, err := prometheus.NewConstMetric(m.desc, m.valueType, value, labelValues...)
+		if err != nil {
+			return err
+		}
+		ch <- metric
+	}
+
+	return nil
+}
+
+// derivedMetric exports a gauge computed from the OPcache status.
+type derivedMetric struct {
+	config DerivedMetricConfig
+	desc   *prometheus.Desc
+}
+
+func newDerivedMetrics(config *Config, labels prometheus.Labels) []*derivedMetric {
+	var metrics []*derivedMetric
+	for _, c := range config.DerivedMetrics {
+		metrics = append(metrics, &derivedMetric{
+			config: c,
+			desc:   prometheus.NewDesc(c.Name, c.Help, nil, labels),
+		})
+	}
+	return metrics
+}
+
+// collect evaluates the expression against the status found in the payload.
+func (m *derivedMetric) collect(ch chan<- prometheus.Metric, payload *Payload) error {
+	if len(payload.raw) == 0 {
+		return nil
+	}
+
+	var data interface{}
+	if err := json.Unmarshal(payload.raw, &data); err != nil {
+		return err
+	}
+	if status, ok := lookupPath(data, "status"); ok {
+		data = status
+	}
+
+	value, err := m.config.expr.eval(data)
+	if err != nil {
+		return err
+	}
+
+	ch <- prometheus.MustNewConstMetric(m.desc, prometheus.GaugeValue, value)
+	return nil
+}
+
+// lookupPath returns the value found under path in a decoded JSON document.
+// Path is made of dot-separated keys and indexes, optionally written as a
+// JSONPath: "$.a.b[0]" is equivalent to "a.b.0".
+func lookupPath(data interface{}, path string) (interface{}, bool) {
+	path = strings.TrimPrefix(strings.TrimPrefix(path, "$"), ".")
+	path = strings.NewReplacer("[", ".", "]", "").Replace(path)
+	if path == "" {
+		return data, true
+	}
+
+	for _, key := range strings.Split(path, ".") {
+		switch node := data.(type) {
+		case map[string]interface{}:
+			value, ok := node[key]
+			if !ok {
+				return nil, false
+			}
+			data = value
+		case []interface{}:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(node) {
+				return nil, false
+			}
+			data = node[i]
+		default:
+			return nil, false
+		}
+	}
+
+	return data, true
+}
+
+func numberValue(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return v, true
+	case bool:
+		return boolMetric(v), true
+	case string:
+		f, err := strconv.ParseFloat(v, 64)
+		return f, err == nil
+	}
+	return 0, false
+}
+
+func stringValue(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	return fmt.Sprint(value)
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Reasons of the failures of scrapes, exported by the scrape_failure_reason
+// metric.
+const (
+	failureRestrictAPI     = "restrict_api"
+	failureLimitExtensions = "limit_extensions"
+	failureOther           = "other"
+)
+
+var scrapeFailureReasons = []string{failureRestrictAPI, failureLimitExtensions, failureOther}
+
+// Classes of the errors of scrapes, exported by the scrape_errors_total
+// metric. Scrapes of targets with OPcache disabled count as failed.
+const (
+	errorDial            = "dial_error"
+	errorTimeout         = "timeout"
+	errorHTTP            = "http_error"
+	errorJSON            = "json_error"
+	errorOPcacheDisabled = "opcache_disabled"
+	errorOther           = "other"
+)
+
+var scrapeErrorClasses = []string{errorDial, errorTimeout, errorHTTP, errorJSON, errorOPcacheDisabled, errorOther}
+
+// statusError is returned when the status script is answered with another
+// status than 200 OK.
+type statusError struct {
+	status  string
+	message string
+}
+
+func (err *statusError) Error() string {
+	return fmt.Sprintf("unexpected status %s: %s", err.status, err.message)
+}
+
+// payloadError is returned when the output of the status script cannot be
+// decoded, which is then the message of the error, such as PHP errors.
+type payloadError struct {
+	content []byte
+}
+
+func (err *payloadError) Error() string {
+	return string(err.content)
+}
+
+// restrictAPIError is returned when the OPcache functions called by the
+// status script are restricted by opcache.restrict_api, which only allows
+// scripts whose path starts with its value.
+type restrictAPIError struct {
+	scriptPath string
+	message    string
+}
+
+func (err *restrictAPIError) Error() string {
+	return fmt.Sprintf("script %s refused by opcache.restrict_api (%s), set opcache.restrict_api to a prefix of its path such as %s, or create the script under the allowed directory with --opcache.script-dir",
+		err.scriptPath, err.message, filepath.Dir(err.scriptPath)+string(filepath.Separator))
+}
+
+// limitExtensionsError is returned when PHP-FPM refuses the status script
+// because its extension is not listed in security.limit_extensions.
+type limitExtensionsError struct {
+	scriptPath string
+}
+
+func (err *limitExtensionsError) Error() string {
+	return fmt.Sprintf("script %s refused by security.limit_extensions of the pool, allow its extension or change it with --opcache.script-extension", err.scriptPath)
+}
+
+// diagnosed returns the error of a scrape, replaced with a restrictAPIError
+// if its message is the warning of the OPcache functions restricted by
+// opcache.restrict_api, reported by the generated status script or echoed
+// before the status by custom ones.
+func (e *Exporter) diagnosed(err error) error {
+	message := err.Error()
+	if !strings.Contains(message, `"restrict_api"`) {
+		return err
+	}
+	if i := strings.Index(message, "Zend OPcache API"); i >= 0 {
+		message = message[i:]
+		if j := strings.IndexAny(message, "\r\n<"); j >= 0 {
+			message = message[:j]
+		}
+	}
+	return &restrictAPIError{scriptPath: e.scriptPath, message: strings.TrimSpace(message)}
+}
+
+// scrapeFailureReason returns the reason of the failure of a scrape, or an
+// empty string if it succeeded.
+func scrapeFailureReason(err error) string {
+	var restrictAPI *restrictAPIError
+	var limitExtensions *limitExtensionsError
+	switch {
+	case err == nil:
+		return ""
+	case errors.As(err, &restrictAPI):
+		return failureRestrictAPI
+	case errors.As(err, &limitExtensions):
+		return failureLimitExtensions
+	default:
+		return failureOther
+	}
+}
+
+// collectFailureReason collects the reason of the failure of the scrape, and
+// logs the remediation of the diagnosed failures when they start.
+func (e *Exporter) collectFailureReason(ch chan<- prometheus.Metric, err error) {
+	reason := scrapeFailureReason(err)
+	if reason != e.failureReason && (reason == failureRestrictAPI || reason == failureLimitExtensions) {
+		level.Error(e.logger).Log("msg", "Status script refused by the PHP configuration", "target", e.target, "reason", reason, "err", err)
+	}
+	e.failureReason = reason
+
+	for _, r := range scrapeFailureReasons {
+		ch <- prometheus.MustNewConstMetric(e.scrapeFailureReasonDesc, prometheus.GaugeValue, boolMetric(r == reason), r)
+	}
+}
+
+// scrapeErrorClass returns the class of the error of a failed scrape.
+func scrapeErrorClass(err error) string {
+	var netErr net.Error
+	var status *statusError
+	var limitExtensions *limitExtensionsError
+	var payload *payloadError
+	switch {
+	case errors.Is(err, context.DeadlineExceeded) || errors.Is(err, os.ErrDeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()):
+		return errorTimeout
+	case unreachable(err):
+		return errorDial
+	case errors.As(err, &status) || errors.As(err, &limitExtensions):
+		return errorHTTP
+	case errors.As(err, &payload):
+		return errorJSON
+	default:
+		return errorOther
+	}
+}
+
+// collectScrapeErrors counts the failure of the scrape, if it failed or found
+// OPcache disabled, and collects the failed scrapes by class of error.
+func (e *Exporter) collectScrapeErrors(ch chan<- prometheus.Metric, status *OPcacheStatus, err error) {
+	if err != nil {
+		e.scrapeErrors[scrapeErrorClass(err)]++
+	} else if !status.OPcacheEnabled {
+		e.scrapeErrors[errorOPcacheDisabled]++
+	}
+
+	for _, class := range scrapeErrorClasses {
+		ch <- prometheus.MustNewConstMetric(e.scrapeErrorsDesc, prometheus.CounterValue, e.scrapeErrors[class], class)
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"time"
+
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// ValidateScripts compiles scripts into the OPcache, and returns whether each
+// one compiled without error and is cached.
+func (e *Exporter) ValidateScripts(scripts []string) (map[string]bool, error) {
+	args := struct {
+		Scripts []string `json:"scripts"`
+	}{scripts}
+
+	var valid map[string]bool
+	if err := e.runAction("validate", args, &valid); err != nil {
+		return nil, err
+	}
+	return valid, nil
+}
+
+// runEntrypointValidation validates the entrypoints of the application
+// periodically, and records the outcome. It never returns.
+func (e *Exporter) runEntrypointValidation() {
+	for {
+		valid, err := e.ValidateScripts(e.entrypoints.Scripts)
+		if err != nil {
+			level.Warn(e.logger).Log("msg", "Error validating entrypoints", "target", e.target, "err", err)
+		}
+		for _, script := range e.entrypoints.Scripts {
+			if err == nil && !valid[script] {
+				level.Warn(e.logger).Log("msg", "Entrypoint failed to compile", "target", e.target, "script", script)
+			}
+		}
+
+		e.mutex.Lock()
+		// Results are kept when the target cannot be reached.
+		if err == nil {
+			e.validEntrypoints = valid
+		}
+		e.mutex.Unlock()
+
+		time.Sleep(e.entrypoints.Interval)
+	}
+}
+
+func init() {
+	registerCollector(collector{
+		name:    "entrypoints",
+		enabled: func(e *Exporter) bool { return e.entrypoints != nil },
+		update: func(e *Exporter, ch chan<- prometheus.Metric, payload *Payload) error {
+			for script, valid := range e.validEntrypoints {
+				ch <- prometheus.MustNewConstMetric(e.entrypointValidDesc, prometheus.GaugeValue, boolMetric(valid), script)
+			}
+			return nil
+		},
+	})
+}
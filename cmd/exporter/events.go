@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+)
+
+// Event describes a notable change observed on a target.
+type Event struct {
+	Time   time.Time `json:"time"`
+	Target string    `json:"target"`
+	Type   string    `json:"type"`
+	Reason string    `json:"reason,omitempty"`
+	// Principal is who requested the change, for the resets requested
+	// through the admin API or scheduled.
+	Principal string `json:"principal,omitempty"`
+}
+
+func newEvent(target, eventType, reason string) Event {
+	return Event{
+		Time:   time.Now(),
+		Target: target,
+		Type:   eventType,
+		Reason: reason,
+	}
+}
+
+// EventSink receives the events recorded in an EventLog.
+type EventSink interface {
+	Notify(event Event)
+}
+
+// EventLog keeps the last recorded events, optionally persisted to a file, and
+// forwards them to its sinks.
+type EventLog struct {
+	mutex sync.Mutex
+
+	events           []Event
+	size             int
+	path             string
+	hitRateThreshold float64
+	sinks            []EventSink
+	logger           log.Logger
+}
+
+// NewEventLog returns an initialized EventLog, restoring the events persisted
+// in the given file if any.
+func NewEventLog(size int, path string, hitRateThreshold float64, logger log.Logger) *EventLog {
+	l := &EventLog{
+		size:             size,
+		path:             path,
+		hitRateThreshold: hitRateThreshold,
+		logger:           logger,
+	}
+
+	if path != "" {
+		content, err := os.ReadFile(path)
+		if err == nil {
+			err = json.Unmarshal(content, &l.events)
+		}
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			level.Error(logger).Log("msg", "Error loading event log", "path", path, "err", err)
+		}
+		l.truncate()
+	}
+
+	return l
+}
+
+// AddSink registers a sink to which recorded events are forwarded.
+func (l *EventLog) AddSink(sink EventSink) {
+	l.sinks = append(l.sinks, sink)
+}
+
+// HitRateThreshold returns the hit rate percentage under which targets record
+// an event.
+func (l *EventLog) HitRateThreshold() float64 {
+	return l.hitRateThreshold
+}
+
+// Record appends an event to the log and forwards it to the sinks.
+func (l *EventLog) Record(event Event) {
+	level.Info(l.logger).Log("msg", "OPcache event", "target", event.Target, "type", event.Type, "reason", event.Reason)
+
+	l.mutex.Lock()
+	l.events = append(l.events, event)
+	l.truncate()
+	if l.path != "" {
+		if err := l.persist(); err != nil {
+			level.Error(l.logger).Log("msg", "Error persisting event log", "path", l.path, "err", err)
+		}
+	}
+	l.mutex.Unlock()
+
+	for _, sink := range l.sinks {
+		sink.Notify(event)
+	}
+}
+
+// Events returns the recorded events, oldest first.
+func (l *EventLog) Events() []Event {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	return append([]Event{}, l.events...)
+}
+
+func (l *EventLog) truncate() {
+	if len(l.events) > l.size {
+		l.events = append([]Event{}, l.events[len(l.events)-l.size:]...)
+	}
+}
+
+func (l *EventLog) persist() error {
+	content, err := json.Marshal(l.events)
+	if err != nil {
+		return err
+	}
+
+	tmp := l.path + ".tmp"
+	if err := os.WriteFile(tmp, content, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, l.path)
+}
+
+// ServeHTTP lists the recorded events as JSON, optionally restricted to the
+// target given by the "target" query parameter.
+func (l *EventLog) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	events := []Event{}
+	target := r.URL.Query().Get("target")
+	for _, event := range l.Events() {
+		if target == "" || event.Target == target {
+			events = append(events, event)
+		}
+	}
+
+	writeJSON(w, events)
+}
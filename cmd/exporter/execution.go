@@ -0,0 +1,29 @@
+package main
+
+import (
+	"errors"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func init() {
+	registerCollector(collector{
+		name:        executionCollector,
+		fromPayload: true,
+		enabled:     func(e *Exporter) bool { return e.collectors[executionCollector] },
+		update: func(e *Exporter, ch chan<- prometheus.Metric, payload *Payload) error {
+			// Failed scrapes have no timing to report.
+			if payload.fetchDuration == 0 {
+				return nil
+			}
+			if payload.ExecutionSeconds == nil {
+				return errors.New("execution time not reported by the status script")
+			}
+
+			execution := *payload.ExecutionSeconds
+			ch <- prometheus.MustNewConstMetric(e.executionSecondsDesc, prometheus.GaugeValue, execution)
+			ch <- prometheus.MustNewConstMetric(e.requestOverheadDesc, prometheus.GaugeValue, max(payload.fetchDuration.Seconds()-execution, 0))
+			return nil
+		},
+	})
+}
@@ -1,28 +1,84 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
-	"net/url"
+	"fmt"
+	"net"
+	"path"
+	"reflect"
+	"regexp"
+	"runtime/debug"
 	"strings"
 	"sync"
+	"time"
 
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
 	"github.com/prometheus/client_golang/prometheus"
-
-	"io"
-
-	fcgiclient "github.com/tomasen/fcgi_client"
 )
 
 const (
 	namespace = "opcache"
 )
 
-func newMetric(metricName, metricDesc string, fcgiURI string) *prometheus.Desc {
-	labels := prometheus.Labels{"fcgi_uri": fcgiURI}
+func newMetric(metricName, metricDesc string, labels prometheus.Labels) *prometheus.Desc {
 	return prometheus.NewDesc(prometheus.BuildFQName(namespace, "", metricName), metricDesc, nil, labels)
 }
 
+func newLabeledMetric(metricName, metricDesc string, labels prometheus.Labels, variableLabels ...string) *prometheus.Desc {
+	return prometheus.NewDesc(prometheus.BuildFQName(namespace, "", metricName), metricDesc, variableLabels, labels)
+}
+
+// targetLabels returns the constant labels of the metrics of a target: its
+// URI, and the static labels given as comma-separated key=value pairs in the
+// fragment of the URI.
+func targetLabels(rawUri string) (prometheus.Labels, error) {
+	target, fragment, _ := strings.Cut(rawUri, "#")
+	labels := prometheus.Labels{"fcgi_uri": target}
+
+	if fragment == "" {
+		return labels, nil
+	}
+
+	for _, pair := range strings.Split(fragment, ",") {
+		name, value, ok := strings.Cut(pair, "=")
+		if !ok || !metricNameRE.MatchString(name) || strings.Contains(name, ":") {
+			return nil, fmt.Errorf("invalid label %q in URI fragment", pair)
+		}
+		if _, exists := labels[name]; exists {
+			return nil, fmt.Errorf("duplicate label %q in URI fragment", name)
+		}
+		labels[name] = value
+	}
+
+	return labels, nil
+}
+
+// lastUsedBuckets are the bounds used to group cached scripts by recency. A
+// script last used exactly a bound ago falls in the next bucket, as it does
+// for the unused thresholds.
+var lastUsedBuckets = []struct {
+	label string
+	bound time.Duration
+}{
+	{"1m", time.Minute},
+	{"1h", time.Hour},
+	{"1d", 24 * time.Hour},
+}
+
+// resolveHostname returns the hostname of an IP address, or the address itself
+// if it cannot be resolved.
+func resolveHostname(ip net.IP, logger log.Logger) string {
+	names, err := net.LookupAddr(ip.String())
+	if err != nil || len(names) == 0 {
+		level.Warn(logger).Log("msg", "Error resolving target hostname", "ip", ip, "err", err)
+		return ip.String()
+	}
+	return strings.TrimSuffix(names[0], ".")
+}
+
 func boolMetric(value bool) float64 {
 	return map[bool]float64{true: 1, false: 0}[value]
 }
@@ -31,29 +87,148 @@ func intMetric(value int64) float64 {
 	return float64(value)
 }
 
+// ratioMetric returns the ratio of value to total, or 0 if total is 0, as
+// for failed scrapes.
+func ratioMetric(value, total int64) float64 {
+	if total == 0 {
+		return 0
+	}
+	return float64(value) / float64(total)
+}
+
 // Exporter collects OPcache status from the given FastCGI URI and exports them using
 // the prometheus metrics package.
 type Exporter struct {
 	mutex sync.RWMutex
 
-	uri        *url.URL
-	scriptPath string
+	target string
+	labels prometheus.Labels
+	// primary and backup are the endpoints of the target, the backup one,
+	// if any, serving the scrapes when the primary one cannot be reached.
+	primary     *endpoint
+	backup      *endpoint
+	scriptPath  string
+	scriptToken string
+	// httpScript is the script requested by the http(s) endpoints, if it is
+	// not scriptPath.
+	httpScript string
+	params     map[string]string
+	events     *EventLog
+	tracer     *ScrapeTracer
+	logger     log.Logger
+
+	requestBody        string
+	requestContentType string
+
+	jsonMetrics    []*jsonMetric
+	derivedMetrics []*derivedMetric
+
+	// Outcome of the last scheduled reset, exported if resetScheduled.
+	resetScheduled            bool
+	lastScheduledReset        time.Time
+	lastScheduledResetSuccess bool
+
+	// State of the auto reset policy, if it applies to the target.
+	autoReset            *AutoResetConfig
+	wastedSince          time.Time
+	lastAutoReset        time.Time
+	autoResetSuppressed  bool
+	autoResets           float64
+	autoResetsSuppressed float64
+
+	// Outcome of the last warmup, if the warmup applies to the target.
+	warmup             *WarmupConfig
+	warmingUp          bool
+	lastWarmup         time.Time
+	lastWarmupDuration time.Duration
+	lastWarmupSuccess  bool
+
+	// manifest lists the files of the application expected to be cached
+	// on the target, if any.
+	manifest *manifest
+
+	// Outcome of the last compilation of the canary script, if set.
+	canaryScript   string
+	canaryInterval time.Duration
+	canaryChecked  bool
+	canarySuccess  bool
+	canaryDuration time.Duration
+
+	// Outcome of the last validation of the entrypoints, if configured.
+	entrypoints      *EntrypointsConfig
+	validEntrypoints map[string]bool
+
+	// perScriptLimit is the number of scripts consuming the most memory
+	// exported with per-script metrics, 0 if disabled.
+	perScriptLimit int
+
+	// unusedThresholds are the durations since their last use after which
+	// cached scripts are counted as unused.
+	unusedThresholds []time.Duration
+
+	// statisticsType is the type of the statistics which only grow until
+	// OPcache restarts, such as hits, misses and restarts.
+	statisticsType prometheus.ValueType
+
+	// collectors tells whether each collector which can be disabled is
+	// enabled.
+	collectors map[string]bool
+
+	// Collectors running less often than scrapes, with their last values.
+	collectorIntervals map[string]time.Duration
+	lastCollected      map[string]time.Time
+	cachedAggregates   *scriptAggregates
+	cachedCustom       map[string]json.RawMessage
+
+	// panics counts the scrapes aborted by a panic.
+	panics float64
+	// failureReason is the reason of the failure of the last scrape.
+	failureReason string
+	// deadlineExceeded counts the scrapes aborted by their deadline.
+	deadlineExceeded float64
+	// scrapeErrors counts the failed scrapes by class of error.
+	scrapeErrors map[string]float64
+	// recentErrors are the errors of the last failed scrapes, for support
+	// bundles.
+	recentErrors []scrapeError
+	// served is the endpoint which served the last scrape, nil if it
+	// failed, and active the last one which served a scrape.
+	served *endpoint
+	active *endpoint
+
+	// State derived from successive scrapes.
+	polled                       bool
+	up                           bool
+	scraped                      bool
+	lastCacheFull                bool
+	lastHitRate                  float64
+	lastStatistics               OPcacheStatistics
+	observedEvictions            float64
+	observedKeyEvictions         float64
+	maxUsedMemory                int64
+	maxWastedPercentage          float64
+	minInternedStringsFreeMemory int64
 
 	enabledDesc                            *prometheus.Desc
 	cacheFullDesc                          *prometheus.Desc
+	fileCacheOnlyDesc                      *prometheus.Desc
 	restartPendingDesc                     *prometheus.Desc
 	restartInProgressDesc                  *prometheus.Desc
 	memoryUsageUsedMemoryDesc              *prometheus.Desc
 	memoryUsageFreeMemoryDesc              *prometheus.Desc
 	memoryUsageWastedMemoryDesc            *prometheus.Desc
 	memoryUsageCurrentWastedPercentageDesc *prometheus.Desc
+	memoryUsageRatioDesc                   *prometheus.Desc
 	internedStringsUsageBufferSizeDesc     *prometheus.Desc
 	internedStringsUsageUsedMemoryDesc     *prometheus.Desc
 	internedStringsUsageUsedFreeMemory     *prometheus.Desc
 	internedStringsUsageUsedNumerOfStrings *prometheus.Desc
+	internedStringsUsageRatioDesc          *prometheus.Desc
 	statisticsNumCachedScripts             *prometheus.Desc
 	statisticsNumCachedKeys                *prometheus.Desc
 	statisticsMaxCachedKeys                *prometheus.Desc
+	statisticsFreeCachedKeys               *prometheus.Desc
+	cachedKeysRatioDesc                    *prometheus.Desc
 	statisticsHits                         *prometheus.Desc
 	statisticsStartTime                    *prometheus.Desc
 	statisticsLastRestartTime              *prometheus.Desc
@@ -64,51 +239,416 @@ type Exporter struct {
 	statisticsBlacklistMisses              *prometheus.Desc
 	statisticsBlacklistMissRatio           *prometheus.Desc
 	statisticsHitRate                      *prometheus.Desc
+	jitEnabledDesc                         *prometheus.Desc
+	jitOnDesc                              *prometheus.Desc
+	jitKindDesc                            *prometheus.Desc
+	jitOptLevelDesc                        *prometheus.Desc
+	jitBufferSizeDesc                      *prometheus.Desc
+	jitBufferFreeDesc                      *prometheus.Desc
+	jitBufferUsageRatioDesc                *prometheus.Desc
+	preloadMemoryDesc                      *prometheus.Desc
+	preloadScriptsDesc                     *prometheus.Desc
+	preloadFunctionsDesc                   *prometheus.Desc
+	preloadClassesDesc                     *prometheus.Desc
+	configMemoryDesc                       *prometheus.Desc
+	configInternedStringsDesc              *prometheus.Desc
+	configMaxFilesDesc                     *prometheus.Desc
+	configValidateTimestampsDesc           *prometheus.Desc
+	configEnableCLIDesc                    *prometheus.Desc
+	configRevalidateFreqDesc               *prometheus.Desc
+	configJITDesc                          *prometheus.Desc
+	configJITBufferSizeDesc                *prometheus.Desc
+	configBlacklistDesc                    *prometheus.Desc
+	configInfoDesc                         *prometheus.Desc
+	memoryCapacityDesc                     *prometheus.Desc
+	filesCapacityDesc                      *prometheus.Desc
+	wastedCapacityDesc                     *prometheus.Desc
+	fileCacheSizeDesc                      *prometheus.Desc
+	fileCacheEntriesDesc                   *prometheus.Desc
+	fileCacheOldestAgeDesc                 *prometheus.Desc
+	realpathCacheUsedDesc                  *prometheus.Desc
+	realpathCacheEntriesDesc               *prometheus.Desc
+	realpathCacheSizeDesc                  *prometheus.Desc
+	scriptsZeroHitsDesc                    *prometheus.Desc
+	scriptsLastUsedDesc                    *prometheus.Desc
+	scriptsMemoryDesc                      *prometheus.Desc
+	scriptsUnusedDesc                      *prometheus.Desc
+	oldestScriptDesc                       *prometheus.Desc
+	newestScriptDesc                       *prometheus.Desc
+	scriptsModifiedDesc                    *prometheus.Desc
+	scriptHitsDesc                         *prometheus.Desc
+	scriptMemoryDesc                       *prometheus.Desc
+	scriptLastUsedDesc                     *prometheus.Desc
+	scriptMemoryHistogram                  *scriptHistogram
+	scriptHitsHistogram                    *scriptHistogram
+	fetchDuration                          prometheus.Histogram
+	observedEvictionsDesc                  *prometheus.Desc
+	observedKeyEvictionsDesc               *prometheus.Desc
+	maxUsedMemoryDesc                      *prometheus.Desc
+	maxWastedPercentageDesc                *prometheus.Desc
+	minInternedStringsFreeMemoryDesc       *prometheus.Desc
+	scheduledResetTimeDesc                 *prometheus.Desc
+	scheduledResetSuccessDesc              *prometheus.Desc
+	autoResetsDesc                         *prometheus.Desc
+	autoResetsSuppressedDesc               *prometheus.Desc
+	warmupDurationDesc                     *prometheus.Desc
+	manifestFilesDesc                      *prometheus.Desc
+	manifestCachedDesc                     *prometheus.Desc
+	manifestRatioDesc                      *prometheus.Desc
+	warmupSuccessDesc                      *prometheus.Desc
+	executionSecondsDesc                   *prometheus.Desc
+	requestOverheadDesc                    *prometheus.Desc
+	canarySuccessDesc                      *prometheus.Desc
+	canaryDurationDesc                     *prometheus.Desc
+	entrypointValidDesc                    *prometheus.Desc
+	collectorDurationDesc                  *prometheus.Desc
+	collectorSuccessDesc                   *prometheus.Desc
+	scrapePanicsDesc                       *prometheus.Desc
+	scrapeDurationDesc                     *prometheus.Desc
+	scrapeFailureReasonDesc                *prometheus.Desc
+	scrapeErrorsDesc                       *prometheus.Desc
+	phpInfoDesc                            *prometheus.Desc
+	scrapeEndpointDesc                     *prometheus.Desc
+	deadlineExceededDesc                   *prometheus.Desc
 }
 
-// NewExporter returns an initialized Exporter.
-func NewExporter(rawUri string, scriptPath string) (*Exporter, error) {
+// ExporterOptions contains the settings shared by the exporters of all
+// targets.
+type ExporterOptions struct {
+	ScriptPath string
+	// HTTPScriptPath, if set, replaces ScriptPath for the http(s) endpoints,
+	// as the generated script reads the token from headers over HTTP.
+	HTTPScriptPath string
+	ScriptToken    string
+	Config         *Config
+	Events         *EventLog
+	Logger         log.Logger
+
+	// FCGIParams are extra parameters passed to the targets with all
+	// requests.
+	FCGIParams map[string]string
+
+	// RequestBody, if set, is posted to the status script of FastCGI and
+	// HTTP targets with the RequestContentType content type.
+	RequestBody        string
+	RequestContentType string
+
+	// ResolveHostnames adds a target_hostname label resolved from the IP
+	// address of TCP targets.
+	ResolveHostnames bool
+
+	// PoolRegexp extracts, with its first group, a pool label from the file
+	// name of unix socket targets.
+	PoolRegexp *regexp.Regexp
+
+	// ScriptHistograms exports histograms of the memory consumption and hits
+	// of cached scripts, as native histograms if NativeHistograms is set.
+	ScriptHistograms bool
+	NativeHistograms bool
+	// HitsBuckets are the upper bounds of the buckets of the classic
+	// histogram of the hits of cached scripts, hitsBuckets if empty.
+	HitsBuckets []float64
+
+	// PerScriptLimit, if not 0, exports per-script metrics, labeled by
+	// script, for this number of the scripts consuming the most memory.
+	PerScriptLimit int
+
+	// UnusedThresholds are the durations since their last use after which
+	// cached scripts are counted by opcache_scripts_unused.
+	UnusedThresholds []time.Duration
+
+	// StatisticsCounters exports the statistics which only grow until OPcache
+	// restarts, such as hits, misses and restarts, as counters with a _total
+	// suffix instead of gauges.
+	StatisticsCounters bool
+
+	// CanaryScript, if set, is the path of a script compiled on the targets
+	// every CanaryInterval, to check that their OPcache accepts new entries.
+	CanaryScript   string
+	CanaryInterval time.Duration
+
+	// Collectors tells whether the "status", "scripts", "configuration",
+	// "file_cache", "realpath_cache" and "execution" collectors are enabled.
+	Collectors map[string]bool
+
+	// CollectorIntervals are the minimum durations between two runs of
+	// expensive collectors, "scripts" and "custom", which otherwise run on
+	// every scrape.
+	CollectorIntervals map[string]time.Duration
+
+	// Tracer, if set, links the duration of status requests to the traces of
+	// scrapes.
+	Tracer *ScrapeTracer
+
+	// State, if set, restores the state derived from the scrapes of the
+	// target saved before the exporter restarted.
+	State *StateStore
+}
+
+// normalizeURI returns the URI of a target, with its scheme.
+func normalizeURI(rawUri string) string {
 	// fallback for old default value
 	if !strings.Contains(rawUri, "://") {
 		rawUri = "tcp://" + rawUri
 	}
-	parsedUri, err := url.Parse(rawUri)
+	return rawUri
+}
+
+// NewExporter returns an initialized Exporter.
+func NewExporter(rawUri string, opts ExporterOptions) (*Exporter, error) {
+	rawUri, backupUri := splitBackup(normalizeURI(rawUri))
+	primary, err := newEndpoint("primary", rawUri)
+	if err != nil {
+		return nil, err
+	}
+	var backup *endpoint
+	if len(backupUri) > 0 {
+		if backup, err = newEndpoint("backup", backupUri); err != nil {
+			return nil, err
+		}
+	}
+	parsedUri := primary.uri
+
+	labels, err := targetLabels(rawUri)
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.ResolveHostnames {
+		if ip := net.ParseIP(parsedUri.Hostname()); ip != nil {
+			labels["target_hostname"] = resolveHostname(ip, opts.Logger)
+		}
+	}
+
+	if _, ok := labels["pool"]; !ok && opts.PoolRegexp != nil && strings.HasSuffix(parsedUri.Scheme, "unix") {
+		if match := opts.PoolRegexp.FindStringSubmatch(path.Base(parsedUri.Path)); len(match) > 1 {
+			labels["pool"] = match[1]
+		}
+	}
+
+	statisticsType, counter := prometheus.GaugeValue, func(name string) string { return name }
+	if opts.StatisticsCounters {
+		statisticsType, counter = prometheus.CounterValue, func(name string) string { return name + "_total" }
+	}
 
 	exporter := &Exporter{
-		uri:        parsedUri,
-		scriptPath: scriptPath,
-
-		enabledDesc:           newMetric("enabled", "Is OPcache enabled.", rawUri),
-		cacheFullDesc:         newMetric("cache_full", "Is OPcache full.", rawUri),
-		restartPendingDesc:    newMetric("restart_pending", "Is restart pending.", rawUri),
-		restartInProgressDesc: newMetric("restart_in_progress", "Is restart in progress.", rawUri),
-
-		memoryUsageUsedMemoryDesc:              newMetric("memory_usage_used_memory", "OPcache used memory.", rawUri),
-		memoryUsageFreeMemoryDesc:              newMetric("memory_usage_free_memory", "OPcache free memory.", rawUri),
-		memoryUsageWastedMemoryDesc:            newMetric("memory_usage_wasted_memory", "OPcache wasted memory.", rawUri),
-		memoryUsageCurrentWastedPercentageDesc: newMetric("memory_usage_current_wasted_percentage", "OPcache current wasted percentage.", rawUri),
-
-		internedStringsUsageBufferSizeDesc:     newMetric("interned_strings_usage_buffer_size", "OPcache interned string buffer size.", rawUri),
-		internedStringsUsageUsedMemoryDesc:     newMetric("interned_strings_usage_used_memory", "OPcache interned string used memory.", rawUri),
-		internedStringsUsageUsedFreeMemory:     newMetric("interned_strings_usage_free_memory", "OPcache interned string free memory.", rawUri),
-		internedStringsUsageUsedNumerOfStrings: newMetric("interned_strings_usage_number_of_strings", "OPcache interned string number of strings.", rawUri),
-
-		statisticsNumCachedScripts:   newMetric("statistics_num_cached_scripts", "OPcache statistics, number of cached scripts.", rawUri),
-		statisticsNumCachedKeys:      newMetric("statistics_num_cached_keys", "OPcache statistics, number of cached keys.", rawUri),
-		statisticsMaxCachedKeys:      newMetric("statistics_max_cached_keys", "OPcache statistics, max cached keys.", rawUri),
-		statisticsHits:               newMetric("statistics_hits", "OPcache statistics, hits.", rawUri),
-		statisticsStartTime:          newMetric("statistics_start_time", "OPcache statistics, start time.", rawUri),
-		statisticsLastRestartTime:    newMetric("statistics_last_restart_time", "OPcache statistics, last restart time", rawUri),
-		statisticsOOMRestarts:        newMetric("statistics_oom_restarts", "OPcache statistics, oom restarts", rawUri),
-		statisticsHashRestarts:       newMetric("statistics_hash_restarts", "OPcache statistics, hash restarts", rawUri),
-		statisticsManualRestarts:     newMetric("statistics_manual_restarts", "OPcache statistics, manual restarts", rawUri),
-		statisticsMisses:             newMetric("statistics_misses", "OPcache statistics, misses", rawUri),
-		statisticsBlacklistMisses:    newMetric("statistics_blacklist_misses", "OPcache statistics, blacklist misses", rawUri),
-		statisticsBlacklistMissRatio: newMetric("statistics_blacklist_miss_ratio", "OPcache statistics, blacklist miss ratio", rawUri),
-		statisticsHitRate:            newMetric("statistics_hit_rate", "OPcache statistics, opcache hit rate", rawUri),
-	}
-
-	return exporter, err
+		target:      labels["fcgi_uri"],
+		labels:      labels,
+		primary:     primary,
+		backup:      backup,
+		scriptPath:  opts.ScriptPath,
+		scriptToken: opts.ScriptToken,
+		httpScript:  opts.HTTPScriptPath,
+		params:      opts.FCGIParams,
+		events:      opts.Events,
+		tracer:      opts.Tracer,
+		logger:      opts.Logger,
+
+		requestBody:        opts.RequestBody,
+		requestContentType: opts.RequestContentType,
+
+		canaryScript:   opts.CanaryScript,
+		canaryInterval: opts.CanaryInterval,
+
+		perScriptLimit:     opts.PerScriptLimit,
+		unusedThresholds:   opts.UnusedThresholds,
+		statisticsType:     statisticsType,
+		collectors:         opts.Collectors,
+		collectorIntervals: map[string]time.Duration{},
+		lastCollected:      map[string]time.Time{},
+		scrapeErrors:       map[string]float64{},
+
+		enabledDesc:           newMetric("enabled", "Is OPcache enabled.", labels),
+		cacheFullDesc:         newMetric("cache_full", "Is OPcache full.", labels),
+		fileCacheOnlyDesc:     newMetric("file_cache_only", "Is OPcache caching scripts in opcache.file_cache only, without shared memory statistics.", labels),
+		restartPendingDesc:    newMetric("restart_pending", "Is restart pending.", labels),
+		restartInProgressDesc: newMetric("restart_in_progress", "Is restart in progress.", labels),
+		phpInfoDesc:           newLabeledMetric("php_info", "Versions of PHP, of its Zend Engine and of the OPcache extension, as labels.", labels, "version", "zend", "opcache"),
+
+		memoryUsageUsedMemoryDesc:              newMetric("memory_usage_used_memory", "OPcache used memory.", labels),
+		memoryUsageFreeMemoryDesc:              newMetric("memory_usage_free_memory", "OPcache free memory.", labels),
+		memoryUsageWastedMemoryDesc:            newMetric("memory_usage_wasted_memory", "OPcache wasted memory.", labels),
+		memoryUsageCurrentWastedPercentageDesc: newMetric("memory_usage_current_wasted_percentage", "OPcache current wasted percentage.", labels),
+		memoryUsageRatioDesc:                   newMetric("memory_usage_ratio", "OPcache used memory ratio, used / (used + free + wasted).", labels),
+
+		internedStringsUsageBufferSizeDesc:     newMetric("interned_strings_usage_buffer_size", "OPcache interned string buffer size.", labels),
+		internedStringsUsageUsedMemoryDesc:     newMetric("interned_strings_usage_used_memory", "OPcache interned string used memory.", labels),
+		internedStringsUsageUsedFreeMemory:     newMetric("interned_strings_usage_free_memory", "OPcache interned string free memory.", labels),
+		internedStringsUsageUsedNumerOfStrings: newMetric("interned_strings_usage_number_of_strings", "OPcache interned string number of strings.", labels),
+		internedStringsUsageRatioDesc:          newMetric("interned_strings_usage_ratio", "OPcache interned string used memory ratio, used / buffer size.", labels),
+
+		statisticsNumCachedScripts:   newMetric("statistics_num_cached_scripts", "OPcache statistics, number of cached scripts.", labels),
+		statisticsNumCachedKeys:      newMetric("statistics_num_cached_keys", "OPcache statistics, number of cached keys.", labels),
+		statisticsMaxCachedKeys:      newMetric("statistics_max_cached_keys", "OPcache statistics, max cached keys.", labels),
+		statisticsFreeCachedKeys:     newMetric("statistics_free_cached_keys", "OPcache statistics, free cached keys, max cached keys - number of cached keys.", labels),
+		cachedKeysRatioDesc:          newMetric("cached_keys_ratio", "OPcache cached keys ratio, cached keys / max cached keys.", labels),
+		statisticsHits:               newMetric(counter("statistics_hits"), "OPcache statistics, hits.", labels),
+		statisticsStartTime:          newMetric("statistics_start_time", "OPcache statistics, start time.", labels),
+		statisticsLastRestartTime:    newMetric("statistics_last_restart_time", "OPcache statistics, last restart time", labels),
+		statisticsOOMRestarts:        newMetric(counter("statistics_oom_restarts"), "OPcache statistics, oom restarts", labels),
+		statisticsHashRestarts:       newMetric(counter("statistics_hash_restarts"), "OPcache statistics, hash restarts", labels),
+		statisticsManualRestarts:     newMetric(counter("statistics_manual_restarts"), "OPcache statistics, manual restarts", labels),
+		statisticsMisses:             newMetric(counter("statistics_misses"), "OPcache statistics, misses", labels),
+		statisticsBlacklistMisses:    newMetric(counter("statistics_blacklist_misses"), "OPcache statistics, blacklist misses", labels),
+		statisticsBlacklistMissRatio: newMetric("statistics_blacklist_miss_ratio", "OPcache statistics, blacklist miss ratio", labels),
+		statisticsHitRate:            newMetric("statistics_hit_rate", "OPcache statistics, opcache hit rate", labels),
+
+		jitEnabledDesc:          newMetric("jit_enabled", "Is the JIT compiler enabled.", labels),
+		jitOnDesc:               newMetric("jit_on", "Is the JIT compiler on.", labels),
+		jitKindDesc:             newMetric("jit_kind", "JIT compiler trigger, as the T digit of opcache.jit, such as 3 for hot counters or 5 for tracing.", labels),
+		jitOptLevelDesc:         newMetric("jit_opt_level", "JIT compiler optimization level.", labels),
+		jitBufferSizeDesc:       newMetric("jit_buffer_size", "JIT compiler buffer size.", labels),
+		jitBufferFreeDesc:       newMetric("jit_buffer_free", "JIT compiler buffer free memory.", labels),
+		jitBufferUsageRatioDesc: newMetric("jit_buffer_usage_ratio", "JIT compiler buffer used memory ratio, (size - free) / size.", labels),
+
+		preloadMemoryDesc:    newMetric("preload_memory_consumption", "Memory consumed by the scripts preloaded by opcache.preload.", labels),
+		preloadScriptsDesc:   newMetric("preload_scripts", "Number of scripts preloaded by opcache.preload.", labels),
+		preloadFunctionsDesc: newMetric("preload_functions", "Number of top-level functions preloaded by opcache.preload.", labels),
+		preloadClassesDesc:   newMetric("preload_classes", "Number of classes preloaded by opcache.preload.", labels),
+
+		configMemoryDesc:             newMetric("configuration_memory_consumption", "Size of the shared memory of OPcache, set by opcache.memory_consumption, in bytes.", labels),
+		configInternedStringsDesc:    newMetric("configuration_interned_strings_buffer", "Size of the interned strings buffer, set by opcache.interned_strings_buffer, in bytes.", labels),
+		configMaxFilesDesc:           newMetric("configuration_max_accelerated_files", "Maximum number of cached scripts, set by opcache.max_accelerated_files.", labels),
+		configValidateTimestampsDesc: newMetric("configuration_validate_timestamps", "Whether cached scripts are checked for updates, set by opcache.validate_timestamps.", labels),
+		configEnableCLIDesc:          newMetric("configuration_enable_cli", "Whether OPcache is enabled for the CLI version of PHP, set by opcache.enable_cli.", labels),
+		configRevalidateFreqDesc:     newMetric("configuration_revalidate_freq", "Seconds between two checks of a cached script for updates, set by opcache.revalidate_freq.", labels),
+		configJITDesc:                newLabeledMetric("configuration_jit", "JIT compiler mode set by opcache.jit, as the jit label.", labels, "jit"),
+		configJITBufferSizeDesc:      newMetric("configuration_jit_buffer_size", "Size of the JIT compiler buffer, set by opcache.jit_buffer_size, in bytes.", labels),
+		configBlacklistDesc:          newMetric("configuration_blacklist_entries", "Number of entries of the blacklist files of opcache.blacklist_filename.", labels),
+		configInfoDesc:               newLabeledMetric("configuration_info", "String directives of OPcache, as labels: opcache.preload, opcache.preload_user, opcache.jit, opcache.file_cache and opcache.restrict_api.", labels, "preload", "preload_user", "jit", "file_cache", "restrict_api"),
+
+		memoryCapacityDesc: newMetric("memory_consumption_ratio", "OPcache used memory over opcache.memory_consumption.", labels),
+		filesCapacityDesc:  newMetric("max_accelerated_files_ratio", "OPcache cached keys over opcache.max_accelerated_files.", labels),
+		wastedCapacityDesc: newMetric("max_wasted_percentage_ratio", "OPcache current wasted percentage over opcache.max_wasted_percentage, above which OPcache restarts when it is full.", labels),
+
+		fileCacheSizeDesc:      newMetric("file_cache_size_bytes", "Size of the files of the second-level cache directory of opcache.file_cache.", labels),
+		fileCacheEntriesDesc:   newMetric("file_cache_entries", "Number of files of the second-level cache directory of opcache.file_cache.", labels),
+		fileCacheOldestAgeDesc: newMetric("file_cache_oldest_entry_age_seconds", "Time since the oldest file of the second-level cache directory of opcache.file_cache was written.", labels),
+
+		realpathCacheUsedDesc:    newPHPMetric("realpath_cache_used_bytes", "Memory used by the realpath cache of the PHP process which ran the status script.", labels),
+		realpathCacheEntriesDesc: newPHPMetric("realpath_cache_entries", "Number of entries of the realpath cache of the PHP process which ran the status script.", labels),
+		realpathCacheSizeDesc:    newPHPMetric("realpath_cache_size_bytes", "Maximum memory used by the realpath cache, set by realpath_cache_size.", labels),
+
+		scriptsZeroHitsDesc: newMetric("scripts_zero_hits", "Number of cached scripts which were never hit.", labels),
+		scriptsLastUsedDesc: newLabeledMetric("scripts_last_used", "Number of cached scripts by time since last use (less than 1m, 1h, 1d, or older).", labels, "age"),
+		scriptsUnusedDesc:   newLabeledMetric("scripts_unused", "Number of cached scripts not used for at least a threshold, in seconds.", labels, "threshold"),
+		scriptsMemoryDesc:   newMetric("scripts_memory_bytes", "Memory consumed by all the cached scripts, apart from the other uses of the shared memory.", labels),
+		oldestScriptDesc:    newMetric("oldest_script_timestamp_seconds", "Oldest modification time of the files of the cached scripts.", labels),
+		newestScriptDesc:    newMetric("newest_script_timestamp_seconds", "Newest modification time of the files of the cached scripts.", labels),
+		scriptsModifiedDesc: newMetric("scripts_modified_since_restart", "Number of cached scripts whose file was modified after OPcache last started or restarted, which are served stale without opcache.validate_timestamps.", labels),
+
+		scriptHitsDesc:     newLabeledMetric("cached_script_hits", "Number of hits of a cached script, among those consuming the most memory.", labels, "script"),
+		scriptMemoryDesc:   newLabeledMetric("cached_script_memory_consumption_bytes", "Memory consumed by a cached script, among those consuming the most memory.", labels, "script"),
+		scriptLastUsedDesc: newLabeledMetric("cached_script_last_used_timestamp_seconds", "Time a cached script was last used, among those consuming the most memory.", labels, "script"),
+
+		observedEvictionsDesc:            newMetric("observed_evictions_total", "Number of cached scripts which disappeared between two scrapes without a restart of OPcache, as observed by the exporter.", labels),
+		observedKeyEvictionsDesc:         newMetric("observed_key_evictions_total", "Number of cached keys which disappeared between two scrapes without a restart of OPcache, as observed by the exporter.", labels),
+		maxUsedMemoryDesc:                newMetric("memory_usage_used_memory_max", "OPcache highest used memory since exporter start.", labels),
+		maxWastedPercentageDesc:          newMetric("memory_usage_current_wasted_percentage_max", "OPcache highest wasted percentage since exporter start.", labels),
+		minInternedStringsFreeMemoryDesc: newMetric("interned_strings_usage_free_memory_min", "OPcache lowest interned string free memory since exporter start.", labels),
+
+		scheduledResetTimeDesc:    newMetric("scheduled_reset_last_timestamp_seconds", "Time of the last scheduled reset of OPcache.", labels),
+		scheduledResetSuccessDesc: newMetric("scheduled_reset_last_success", "Whether the last scheduled reset of OPcache succeeded.", labels),
+
+		autoResetsDesc:           newMetric("auto_resets_total", "Number of automatic resets of OPcache triggered by its wasted memory.", labels),
+		autoResetsSuppressedDesc: newMetric("auto_resets_suppressed_total", "Number of automatic resets of OPcache suppressed by the minimum interval between resets.", labels),
+
+		warmupDurationDesc: newMetric("warmup_last_duration_seconds", "Duration of the last warmup of OPcache after a restart.", labels),
+		warmupSuccessDesc:  newMetric("warmup_last_success", "Whether the last warmup of OPcache after a restart succeeded.", labels),
+
+		manifestFilesDesc:  newMetric("manifest_files", "Number of files listed in the manifest of the application.", labels),
+		manifestCachedDesc: newMetric("manifest_files_cached", "Number of files listed in the manifest of the application which are cached.", labels),
+		manifestRatioDesc:  newMetric("manifest_cached_ratio", "Ratio of the files listed in the manifest of the application which are cached, or cache warmness.", labels),
+
+		executionSecondsDesc: newMetric("status_script_execution_seconds", "Time taken by PHP to run the status script in the last scrape, as measured by the script.", labels),
+		requestOverheadDesc:  newMetric("status_request_overhead_seconds", "Time of the last status request not spent running the status script, such as the network latency and the wait for a free PHP worker.", labels),
+
+		canarySuccessDesc:  newMetric("canary_compile_success", "Whether the last compilation of the canary script into OPcache succeeded.", labels),
+		canaryDurationDesc: newMetric("canary_compile_duration_seconds", "Duration of the last compilation of the canary script into OPcache.", labels),
+
+		collectorDurationDesc: newLabeledMetric("exporter_collector_duration_seconds", "Duration of the last run of a collector of the exporter on the target.", labels, "collector"),
+		collectorSuccessDesc:  newLabeledMetric("exporter_collector_success", "Whether the last run of a collector of the exporter on the target succeeded.", labels, "collector"),
+		scrapePanicsDesc:      newMetric("scrape_panics_total", "Number of scrapes of the target aborted by a panic.", labels),
+		scrapeDurationDesc:    newMetric("scrape_duration_seconds", "Duration of the last scrape of the target, including the status request and the decoding of its payload.", labels),
+
+		scrapeEndpointDesc:      newLabeledMetric("scrape_endpoint", "Whether an endpoint of a target with a backup endpoint served its last scrape.", labels, "endpoint", "endpoint_uri"),
+		deadlineExceededDesc:    newMetric("scrape_deadline_exceeded_total", "Number of scrapes of the target aborted by the deadline allocated from the timeout of the scrape.", labels),
+		scrapeFailureReasonDesc: newLabeledMetric("scrape_failure_reason", "Whether the last scrape of the target failed, by reason (restrict_api, limit_extensions or other).", labels, "reason"),
+		scrapeErrorsDesc:        newLabeledMetric("scrape_errors_total", "Number of failed scrapes of the target, by class of error (dial_error, timeout, http_error, json_error, opcache_disabled or other).", labels, "reason"),
+
+		entrypointValidDesc: newLabeledMetric("entrypoint_compile_success", "Whether the last compilation of an entrypoint of the application into OPcache succeeded.", labels, "script"),
+	}
+
+	if opts.ScriptHistograms {
+		exporter.scriptMemoryHistogram = newScriptHistogram("script_memory_bytes", "Histogram of the memory consumption of cached scripts.", labels, memoryBuckets, opts.NativeHistograms)
+		buckets := hitsBuckets
+		if len(opts.HitsBuckets) > 0 {
+			buckets = opts.HitsBuckets
+		}
+		exporter.scriptHitsHistogram = newScriptHistogram("script_hits", "Histogram of the hits of cached scripts.", labels, buckets, opts.NativeHistograms)
+	}
+
+	exporter.applyConfig(opts.Config)
+	if entrypoints := opts.Config.Entrypoints; entrypoints != nil && coversTarget(entrypoints.Targets, exporter.target) {
+		exporter.entrypoints = entrypoints
+	}
+
+	for collector, interval := range opts.CollectorIntervals {
+		if interval > 0 {
+			exporter.collectorIntervals[collector] = interval
+		}
+	}
+
+	if opts.Tracer != nil {
+		exporter.fetchDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace:   namespace,
+			Name:        "fetch_duration_seconds",
+			Help:        "Histogram of the duration of status requests to the target.",
+			ConstLabels: labels,
+		})
+	}
+
+	opts.State.restore(exporter)
+
+	return exporter, nil
+}
+
+// applyConfig applies the settings of the configuration which can change
+// while the exporter runs, when the configuration file is reloaded.
+func (e *Exporter) applyConfig(config *Config) {
+	jsonMetrics := newJSONMetrics(config, e.labels)
+	derivedMetrics := newDerivedMetrics(config, e.labels)
+
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	e.jsonMetrics = jsonMetrics
+	e.derivedMetrics = derivedMetrics
+
+	var autoReset *AutoResetConfig
+	if policy := config.AutoReset; policy != nil && coversTarget(policy.Targets, e.target) {
+		autoReset = policy
+	}
+	if !reflect.DeepEqual(autoReset, e.autoReset) {
+		e.wastedSince = time.Time{}
+		e.autoResetSuppressed = false
+	}
+	e.autoReset = autoReset
+
+	e.warmup = nil
+	if warmup := config.Warmup; warmup != nil && coversTarget(warmup.Targets, e.target) {
+		e.warmup = warmup
+	}
+
+	e.manifest = nil
+	if manifest := config.Manifest; manifest != nil && coversTarget(manifest.Targets, e.target) {
+		e.manifest = sharedManifest(manifest)
+	}
+}
+
+// Target returns the FastCGI URI the exporter collects OPcache status from.
+func (e *Exporter) Target() string {
+	return e.target
 }
 
 // Describe describes all the metrics ever exported by the OPcache exporter.
@@ -116,19 +656,24 @@ func NewExporter(rawUri string, scriptPath string) (*Exporter, error) {
 func (e *Exporter) Describe(ch chan<- *prometheus.Desc) {
 	ch <- e.enabledDesc
 	ch <- e.cacheFullDesc
+	ch <- e.fileCacheOnlyDesc
 	ch <- e.restartPendingDesc
 	ch <- e.restartInProgressDesc
 	ch <- e.memoryUsageUsedMemoryDesc
 	ch <- e.memoryUsageFreeMemoryDesc
 	ch <- e.memoryUsageWastedMemoryDesc
 	ch <- e.memoryUsageCurrentWastedPercentageDesc
+	ch <- e.memoryUsageRatioDesc
 	ch <- e.internedStringsUsageBufferSizeDesc
 	ch <- e.internedStringsUsageUsedMemoryDesc
 	ch <- e.internedStringsUsageUsedFreeMemory
 	ch <- e.internedStringsUsageUsedNumerOfStrings
+	ch <- e.internedStringsUsageRatioDesc
 	ch <- e.statisticsNumCachedScripts
 	ch <- e.statisticsNumCachedKeys
 	ch <- e.statisticsMaxCachedKeys
+	ch <- e.statisticsFreeCachedKeys
+	ch <- e.cachedKeysRatioDesc
 	ch <- e.statisticsHits
 	ch <- e.statisticsStartTime
 	ch <- e.statisticsLastRestartTime
@@ -139,75 +684,345 @@ func (e *Exporter) Describe(ch chan<- *prometheus.Desc) {
 	ch <- e.statisticsBlacklistMisses
 	ch <- e.statisticsBlacklistMissRatio
 	ch <- e.statisticsHitRate
+	ch <- e.jitEnabledDesc
+	ch <- e.jitOnDesc
+	ch <- e.jitKindDesc
+	ch <- e.jitOptLevelDesc
+	ch <- e.jitBufferSizeDesc
+	ch <- e.jitBufferFreeDesc
+	ch <- e.jitBufferUsageRatioDesc
+	ch <- e.preloadMemoryDesc
+	ch <- e.preloadScriptsDesc
+	ch <- e.preloadFunctionsDesc
+	ch <- e.preloadClassesDesc
+	ch <- e.configMemoryDesc
+	ch <- e.configInternedStringsDesc
+	ch <- e.configMaxFilesDesc
+	ch <- e.configValidateTimestampsDesc
+	ch <- e.configEnableCLIDesc
+	ch <- e.configRevalidateFreqDesc
+	ch <- e.configJITDesc
+	ch <- e.configJITBufferSizeDesc
+	ch <- e.configBlacklistDesc
+	ch <- e.configInfoDesc
+	ch <- e.memoryCapacityDesc
+	ch <- e.filesCapacityDesc
+	ch <- e.wastedCapacityDesc
+	ch <- e.fileCacheSizeDesc
+	ch <- e.fileCacheEntriesDesc
+	ch <- e.fileCacheOldestAgeDesc
+	ch <- e.realpathCacheUsedDesc
+	ch <- e.realpathCacheEntriesDesc
+	ch <- e.realpathCacheSizeDesc
+	ch <- e.scriptsZeroHitsDesc
+	ch <- e.scriptsLastUsedDesc
+	ch <- e.scriptsMemoryDesc
+	ch <- e.scriptsUnusedDesc
+	ch <- e.oldestScriptDesc
+	ch <- e.newestScriptDesc
+	ch <- e.scriptsModifiedDesc
+	ch <- e.scriptHitsDesc
+	ch <- e.scriptMemoryDesc
+	ch <- e.scriptLastUsedDesc
+	ch <- e.observedEvictionsDesc
+	ch <- e.observedKeyEvictionsDesc
+	ch <- e.maxUsedMemoryDesc
+	ch <- e.maxWastedPercentageDesc
+	ch <- e.minInternedStringsFreeMemoryDesc
+	ch <- e.scheduledResetTimeDesc
+	ch <- e.scheduledResetSuccessDesc
+	ch <- e.autoResetsDesc
+	ch <- e.autoResetsSuppressedDesc
+	ch <- e.warmupDurationDesc
+	ch <- e.warmupSuccessDesc
+	ch <- e.manifestFilesDesc
+	ch <- e.manifestCachedDesc
+	ch <- e.manifestRatioDesc
+	ch <- e.executionSecondsDesc
+	ch <- e.requestOverheadDesc
+	ch <- e.canarySuccessDesc
+	ch <- e.canaryDurationDesc
+	ch <- e.entrypointValidDesc
+	ch <- e.collectorDurationDesc
+	ch <- e.collectorSuccessDesc
+	ch <- e.scrapePanicsDesc
+	ch <- e.scrapeDurationDesc
+	ch <- e.scrapeFailureReasonDesc
+	ch <- e.scrapeErrorsDesc
+	ch <- e.phpInfoDesc
+	ch <- e.scrapeEndpointDesc
+	ch <- e.deadlineExceededDesc
+
+	if e.scriptMemoryHistogram != nil {
+		ch <- e.scriptMemoryHistogram.desc
+		ch <- e.scriptHitsHistogram.desc
+	}
+	if e.fetchDuration != nil {
+		e.fetchDuration.Describe(ch)
+	}
+
+	for _, m := range e.jsonMetrics {
+		ch <- m.desc
+	}
+	for _, m := range e.derivedMetrics {
+		ch <- m.desc
+	}
 }
 
 // Collect collects metrics of OPcache stats.
 // Implements prometheus.Collector.
 func (e *Exporter) Collect(ch chan<- prometheus.Metric) {
+	e.collectContext(context.Background(), ch)
+}
+
+// collectContext collects the metrics, failing the scrape of the target if it
+// does not answer before the deadline of ctx, if it has one.
+func (e *Exporter) collectContext(ctx context.Context, ch chan<- prometheus.Metric) {
 	e.mutex.Lock() // To protect metrics from concurrent collects.
 	defer e.mutex.Unlock()
 
-	status, err := e.getOpcacheStatus()
+	// A malformed payload must not take the other targets down.
+	defer func() {
+		if err := recover(); err != nil {
+			e.panics++
+			level.Error(e.logger).Log("msg", "Panic collecting metrics", "target", e.target, "err", err, "stack", string(debug.Stack()))
+		}
+		ch <- prometheus.MustNewConstMetric(e.scrapePanicsDesc, prometheus.CounterValue, e.panics)
+	}()
+
+	start := time.Now()
+	payload, err := e.collectedPayload(ctx, e.newScriptAggregates(start))
+	if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		e.deadlineExceeded++
+		err = fmt.Errorf("scrape deadline exceeded: %w", err)
+	}
+	duration := time.Since(start)
+	if err != nil {
+		e.recordError(err)
+	}
+	if e.fetchDuration != nil {
+		observeWithTrace(e.fetchDuration, duration.Seconds(), e.tracer.TraceID())
+	}
 	if err != nil {
-		status = new(OPcacheStatus)
+		payload = &Payload{Status: new(OPcacheStatus), aggregates: e.newScriptAggregates(start)}
 	}
+	status := payload.Status
 
+	for _, event := range e.updateState(status, err) {
+		e.events.Record(event)
+		if event.Type == "restart" && e.warmup != nil && !e.warmingUp {
+			e.warmingUp = true
+			go e.warmUp(e.warmup)
+		}
+	}
+	for _, event := range e.checkAutoReset(status, err, time.Now()) {
+		e.events.Record(event)
+	}
+
+	e.runCollectors(ch, payload, err)
+	e.collectFailureReason(ch, err)
+	e.collectScrapeErrors(ch, status, err)
+	e.collectEndpoint(ch)
+	ch <- prometheus.MustNewConstMetric(e.deadlineExceededDesc, prometheus.CounterValue, e.deadlineExceeded)
+	ch <- prometheus.MustNewConstMetric(e.scrapeDurationDesc, prometheus.GaugeValue, duration.Seconds())
+
+	if e.fetchDuration != nil {
+		ch <- e.fetchDuration
+	}
+}
+
+// collectStatus collects the metrics of the memory usage and statistics of
+// OPcache, and of their evolution across scrapes.
+func (e *Exporter) collectStatus(ch chan<- prometheus.Metric, status *OPcacheStatus) {
 	ch <- prometheus.MustNewConstMetric(e.enabledDesc, prometheus.GaugeValue, boolMetric(status.OPcacheEnabled))
 	ch <- prometheus.MustNewConstMetric(e.cacheFullDesc, prometheus.GaugeValue, boolMetric(status.CacheFull))
+	ch <- prometheus.MustNewConstMetric(e.fileCacheOnlyDesc, prometheus.GaugeValue, boolMetric(status.FileCacheOnly))
 	ch <- prometheus.MustNewConstMetric(e.restartPendingDesc, prometheus.GaugeValue, boolMetric(status.RestartPending))
 	ch <- prometheus.MustNewConstMetric(e.restartInProgressDesc, prometheus.GaugeValue, boolMetric(status.RestartInProgress))
 	ch <- prometheus.MustNewConstMetric(e.memoryUsageUsedMemoryDesc, prometheus.GaugeValue, intMetric(status.MemoryUsage.UsedMemory))
 	ch <- prometheus.MustNewConstMetric(e.memoryUsageFreeMemoryDesc, prometheus.GaugeValue, intMetric(status.MemoryUsage.FreeMemory))
 	ch <- prometheus.MustNewConstMetric(e.memoryUsageWastedMemoryDesc, prometheus.GaugeValue, intMetric(status.MemoryUsage.WastedMemory))
 	ch <- prometheus.MustNewConstMetric(e.memoryUsageCurrentWastedPercentageDesc, prometheus.GaugeValue, status.MemoryUsage.CurrentWastedPercentage)
+	memory := status.MemoryUsage
+	ch <- prometheus.MustNewConstMetric(e.memoryUsageRatioDesc, prometheus.GaugeValue, ratioMetric(memory.UsedMemory, memory.UsedMemory+memory.FreeMemory+memory.WastedMemory))
 	ch <- prometheus.MustNewConstMetric(e.internedStringsUsageBufferSizeDesc, prometheus.GaugeValue, intMetric(status.InternedStringsUsage.BufferSize))
 	ch <- prometheus.MustNewConstMetric(e.internedStringsUsageUsedMemoryDesc, prometheus.GaugeValue, intMetric(status.InternedStringsUsage.UsedMemory))
 	ch <- prometheus.MustNewConstMetric(e.internedStringsUsageUsedFreeMemory, prometheus.GaugeValue, intMetric(status.InternedStringsUsage.FreeMemory))
+	ch <- prometheus.MustNewConstMetric(e.internedStringsUsageUsedNumerOfStrings, prometheus.GaugeValue, intMetric(status.InternedStringsUsage.NumerOfStrings))
+	ch <- prometheus.MustNewConstMetric(e.internedStringsUsageRatioDesc, prometheus.GaugeValue, ratioMetric(status.InternedStringsUsage.UsedMemory, status.InternedStringsUsage.BufferSize))
 	ch <- prometheus.MustNewConstMetric(e.statisticsNumCachedScripts, prometheus.GaugeValue, intMetric(status.OPcacheStatistics.NumCachedScripts))
 	ch <- prometheus.MustNewConstMetric(e.statisticsNumCachedKeys, prometheus.GaugeValue, intMetric(status.OPcacheStatistics.NumCachedKeys))
 	ch <- prometheus.MustNewConstMetric(e.statisticsMaxCachedKeys, prometheus.GaugeValue, intMetric(status.OPcacheStatistics.MaxCachedKeys))
-	ch <- prometheus.MustNewConstMetric(e.statisticsHits, prometheus.GaugeValue, intMetric(status.OPcacheStatistics.Hits))
+	ch <- prometheus.MustNewConstMetric(e.statisticsFreeCachedKeys, prometheus.GaugeValue, intMetric(status.OPcacheStatistics.MaxCachedKeys-status.OPcacheStatistics.NumCachedKeys))
+	ch <- prometheus.MustNewConstMetric(e.cachedKeysRatioDesc, prometheus.GaugeValue, ratioMetric(status.OPcacheStatistics.NumCachedKeys, status.OPcacheStatistics.MaxCachedKeys))
+	ch <- prometheus.MustNewConstMetric(e.statisticsHits, e.statisticsType, intMetric(status.OPcacheStatistics.Hits))
 	ch <- prometheus.MustNewConstMetric(e.statisticsStartTime, prometheus.GaugeValue, intMetric(status.OPcacheStatistics.StartTime))
 	ch <- prometheus.MustNewConstMetric(e.statisticsLastRestartTime, prometheus.GaugeValue, intMetric(status.OPcacheStatistics.LastRestartTime))
-	ch <- prometheus.MustNewConstMetric(e.statisticsOOMRestarts, prometheus.GaugeValue, intMetric(status.OPcacheStatistics.OOMRestarts))
-	ch <- prometheus.MustNewConstMetric(e.statisticsHashRestarts, prometheus.GaugeValue, intMetric(status.OPcacheStatistics.HashRestarts))
-	ch <- prometheus.MustNewConstMetric(e.statisticsManualRestarts, prometheus.GaugeValue, intMetric(status.OPcacheStatistics.ManualRestarts))
-	ch <- prometheus.MustNewConstMetric(e.statisticsMisses, prometheus.GaugeValue, intMetric(status.OPcacheStatistics.Misses))
-	ch <- prometheus.MustNewConstMetric(e.statisticsBlacklistMisses, prometheus.GaugeValue, intMetric(status.OPcacheStatistics.BlacklistMisses))
+	ch <- prometheus.MustNewConstMetric(e.statisticsOOMRestarts, e.statisticsType, intMetric(status.OPcacheStatistics.OOMRestarts))
+	ch <- prometheus.MustNewConstMetric(e.statisticsHashRestarts, e.statisticsType, intMetric(status.OPcacheStatistics.HashRestarts))
+	ch <- prometheus.MustNewConstMetric(e.statisticsManualRestarts, e.statisticsType, intMetric(status.OPcacheStatistics.ManualRestarts))
+	ch <- prometheus.MustNewConstMetric(e.statisticsMisses, e.statisticsType, intMetric(status.OPcacheStatistics.Misses))
+	ch <- prometheus.MustNewConstMetric(e.statisticsBlacklistMisses, e.statisticsType, intMetric(status.OPcacheStatistics.BlacklistMisses))
 	ch <- prometheus.MustNewConstMetric(e.statisticsBlacklistMissRatio, prometheus.GaugeValue, status.OPcacheStatistics.BlacklistMissRatio)
 	ch <- prometheus.MustNewConstMetric(e.statisticsHitRate, prometheus.GaugeValue, status.OPcacheStatistics.OPcacheHitRate)
-}
 
-func (e *Exporter) getOpcacheStatus() (*OPcacheStatus, error) {
-	host := e.uri.Host
-	if e.uri.Scheme == "unix" {
-		host = e.uri.Path
+	if preload := status.PreloadStatistics; preload != nil {
+		ch <- prometheus.MustNewConstMetric(e.preloadMemoryDesc, prometheus.GaugeValue, intMetric(preload.MemoryConsumption))
+		ch <- prometheus.MustNewConstMetric(e.preloadScriptsDesc, prometheus.GaugeValue, float64(len(preload.Scripts)))
+		ch <- prometheus.MustNewConstMetric(e.preloadFunctionsDesc, prometheus.GaugeValue, float64(len(preload.Functions)))
+		ch <- prometheus.MustNewConstMetric(e.preloadClassesDesc, prometheus.GaugeValue, float64(len(preload.Classes)))
 	}
 
-	client, err := fcgiclient.Dial(e.uri.Scheme, host)
+	ch <- prometheus.MustNewConstMetric(e.observedEvictionsDesc, prometheus.CounterValue, e.observedEvictions)
+	ch <- prometheus.MustNewConstMetric(e.observedKeyEvictionsDesc, prometheus.CounterValue, e.observedKeyEvictions)
+	ch <- prometheus.MustNewConstMetric(e.maxUsedMemoryDesc, prometheus.GaugeValue, intMetric(e.maxUsedMemory))
+	ch <- prometheus.MustNewConstMetric(e.maxWastedPercentageDesc, prometheus.GaugeValue, e.maxWastedPercentage)
+	ch <- prometheus.MustNewConstMetric(e.minInternedStringsFreeMemoryDesc, prometheus.GaugeValue, intMetric(e.minInternedStringsFreeMemory))
+}
+
+func init() {
+	registerCollector(collector{
+		name:        statusCollector,
+		fromPayload: true,
+		enabled:     func(e *Exporter) bool { return e.collectors[statusCollector] },
+		update: func(e *Exporter, ch chan<- prometheus.Metric, payload *Payload) error {
+			e.collectStatus(ch, payload.Status)
+			// Scripts not generated by the exporter may not report it.
+			if php := payload.PHP; php != nil {
+				ch <- prometheus.MustNewConstMetric(e.phpInfoDesc, prometheus.GaugeValue, 1, php.Version, php.Zend, php.OPcache)
+			}
+			return nil
+		},
+	})
+
+	registerCollector(collector{
+		name:        scriptsCollector,
+		fromPayload: true,
+		section:     "scripts",
+		enabled:     func(e *Exporter) bool { return e.collectors[scriptsCollector] },
+		update: func(e *Exporter, ch chan<- prometheus.Metric, payload *Payload) error {
+			e.collectScripts(ch, payload.aggregates)
+			return nil
+		},
+	})
+}
+
+// updateState updates the state derived from successive scrapes with the
+// outcome of the last one, and returns the events detected since the previous
+// scrape.
+func (e *Exporter) updateState(status *OPcacheStatus, err error) []Event {
+	var events []Event
+
 	if err != nil {
-		return nil, err
+		if !e.polled || e.up {
+			events = append(events, newEvent(e.target, "down", err.Error()))
+		}
+		e.polled = true
+		e.up = false
+		return events
 	}
 
-	env := map[string]string{
-		"SCRIPT_FILENAME": e.scriptPath,
+	if e.polled && !e.up {
+		events = append(events, newEvent(e.target, "up", ""))
 	}
+	e.polled = true
+	e.up = true
 
-	resp, err := client.Get(env)
+	if e.scraped && status.CacheFull && !e.lastCacheFull {
+		events = append(events, newEvent(e.target, "cache_full", ""))
+	}
+	e.lastCacheFull = status.CacheFull
+
+	hitRate := status.OPcacheStatistics.OPcacheHitRate
+	threshold := e.events.HitRateThreshold()
+	if threshold > 0 && hitRate < threshold && (!e.scraped || e.lastHitRate >= threshold) {
+		events = append(events, newEvent(e.target, "low_hit_rate", fmt.Sprintf("hit rate %.2f%% below %.2f%%", hitRate, threshold)))
+	}
+	e.lastHitRate = hitRate
+
+	statistics := status.OPcacheStatistics
+	last := e.lastStatistics
+
+	var reason string
+	switch {
+	case statistics.OOMRestarts > last.OOMRestarts:
+		reason = "oom"
+	case statistics.HashRestarts > last.HashRestarts:
+		reason = "hash"
+	case statistics.ManualRestarts > last.ManualRestarts:
+		reason = "manual"
+	case statistics.LastRestartTime != last.LastRestartTime:
+		reason = "unknown"
+	}
+	if e.scraped && reason != "" {
+		events = append(events, newEvent(e.target, "restart", reason))
+	}
+
+	// Restarts of OPcache, or of the target, empty the cache at once, which
+	// are not evictions.
+	if reason == "" && statistics.StartTime == last.StartTime {
+		if statistics.NumCachedScripts < last.NumCachedScripts {
+			e.observedEvictions += float64(last.NumCachedScripts - statistics.NumCachedScripts)
+		}
+		if statistics.NumCachedKeys < last.NumCachedKeys {
+			e.observedKeyEvictions += float64(last.NumCachedKeys - statistics.NumCachedKeys)
+		}
+	}
+	e.lastStatistics = statistics
+
+	if !e.scraped || status.MemoryUsage.UsedMemory > e.maxUsedMemory {
+		e.maxUsedMemory = status.MemoryUsage.UsedMemory
+	}
+	if !e.scraped || status.MemoryUsage.CurrentWastedPercentage > e.maxWastedPercentage {
+		e.maxWastedPercentage = status.MemoryUsage.CurrentWastedPercentage
+	}
+	if !e.scraped || status.InternedStringsUsage.FreeMemory < e.minInternedStringsFreeMemory {
+		e.minInternedStringsFreeMemory = status.InternedStringsUsage.FreeMemory
+	}
+
+	e.scraped = true
+
+	return events
+}
+
+// getOpcacheStatus returns the status of the target, requested before the
+// deadline of ctx.
+func (e *Exporter) getOpcacheStatus(ctx context.Context) (*OPcacheStatus, error) {
+	payload, err := e.getPayloadWith(ctx, nil)
 	if err != nil {
 		return nil, err
 	}
 
-	content, err := io.ReadAll(io.Reader(resp.Body))
+	return payload.Status, nil
+}
+
+// getPayloadWith returns the payload of the target, requested with the
+// headers before the deadline of ctx.
+func (e *Exporter) getPayloadWith(ctx context.Context, headers map[string]string) (*Payload, error) {
+	content, _, err := e.fetchServed(ctx, headers)
 	if err != nil {
 		return nil, err
 	}
 
+	payload := &Payload{raw: content}
+	if err := json.Unmarshal(content, payload); err == nil {
+		if msg, ok := payload.Errors["status"]; ok {
+			return nil, e.diagnosed(errors.New(msg))
+		}
+		if payload.Status != nil {
+			if payload.Scripts != nil {
+				payload.Status.Scripts = payload.Scripts
+			}
+			return payload, nil
+		}
+	}
+
+	// Scripts given with --opcache.script-path may echo the bare status.
 	status := new(OPcacheStatus)
 	err = json.Unmarshal(content, status)
 	if err != nil {
-		return nil, errors.New(string(content))
+		return nil, e.diagnosed(&payloadError{content: content})
 	}
 
-	return status, nil
+	return &Payload{Status: status, raw: content}, nil
 }
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// TestCollectEmitsDescribedMetrics checks that every metric described by the
+// exporter is collected from a payload reporting everything, so that a
+// metric is never described without being collected.
+func TestCollectEmitsDescribedMetrics(t *testing.T) {
+	fixture, err := filepath.Abs("testdata/payload.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The features running in the background, or depending on the
+	// configuration, are all enabled.
+	logger := log.NewNopLogger()
+	e, err := NewExporter("file://"+fixture+"|file://"+fixture, ExporterOptions{
+		Config: &Config{
+			AutoReset:   &AutoResetConfig{WastedPercentage: 50},
+			Warmup:      &WarmupConfig{Scripts: []string{"/app/a.php"}},
+			Entrypoints: &EntrypointsConfig{Scripts: []string{"/app/a.php"}},
+			Manifest:    &ManifestConfig{Path: "testdata/manifest.txt"},
+		},
+		Events:           NewEventLog(10, "", 0, logger),
+		Logger:           logger,
+		ScriptHistograms: true,
+		PerScriptLimit:   1,
+		UnusedThresholds: []time.Duration{time.Hour},
+		CanaryScript:     "/app/canary.php",
+		Collectors: map[string]bool{
+			statusCollector:        true,
+			jitCollector:           true,
+			scriptsCollector:       true,
+			executionCollector:     true,
+			configurationCollector: true,
+			fileCacheCollector:     true,
+			realpathCacheCollector: true,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The outcomes of the actions run in the background are only exported
+	// once they ran.
+	e.resetScheduled = true
+	e.lastScheduledReset = time.Now()
+	e.lastWarmup = time.Now()
+	e.canaryChecked = true
+	e.validEntrypoints = map[string]bool{"/app/a.php": true}
+
+	descs := make(chan *prometheus.Desc)
+	go func() {
+		e.Describe(descs)
+		close(descs)
+	}()
+	described := map[string]bool{}
+	for desc := range descs {
+		described[desc.String()] = true
+	}
+
+	metrics := make(chan prometheus.Metric)
+	go func() {
+		e.Collect(metrics)
+		close(metrics)
+	}()
+	collected := map[string]bool{}
+	for metric := range metrics {
+		collected[metric.Desc().String()] = true
+	}
+
+	for desc := range described {
+		if !collected[desc] {
+			t.Errorf("described but not collected: %s", desc)
+		}
+	}
+}
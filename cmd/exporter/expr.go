@@ -0,0 +1,197 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// expr is an arithmetic expression over the fields of a JSON document, such
+// as "memory_usage.used_memory / (memory_usage.used_memory + memory_usage.free_memory)".
+type expr interface {
+	eval(data interface{}) (float64, error)
+}
+
+type numberExpr float64
+
+func (n numberExpr) eval(interface{}) (float64, error) {
+	return float64(n), nil
+}
+
+type fieldExpr string
+
+func (f fieldExpr) eval(data interface{}) (float64, error) {
+	field, ok := lookupPath(data, string(f))
+	if !ok {
+		return 0, fmt.Errorf("field %q not found", string(f))
+	}
+	value, ok := numberValue(field)
+	if !ok {
+		return 0, fmt.Errorf("field %q is not a number", string(f))
+	}
+	return value, nil
+}
+
+type negExpr struct {
+	operand expr
+}
+
+func (n negExpr) eval(data interface{}) (float64, error) {
+	value, err := n.operand.eval(data)
+	return -value, err
+}
+
+type binaryExpr struct {
+	op          byte
+	left, right expr
+}
+
+func (b binaryExpr) eval(data interface{}) (float64, error) {
+	left, err := b.left.eval(data)
+	if err != nil {
+		return 0, err
+	}
+	right, err := b.right.eval(data)
+	if err != nil {
+		return 0, err
+	}
+
+	switch b.op {
+	case '+':
+		return left + right, nil
+	case '-':
+		return left - right, nil
+	case '*':
+		return left * right, nil
+	default:
+		// Dividing by zero would export infinities or NaN, which break the
+		// comparisons of alert rules, so the sample is skipped instead.
+		if right == 0 {
+			return 0, fmt.Errorf("division by zero")
+		}
+		return left / right, nil
+	}
+}
+
+// parseExpr parses an expression made of numbers, dot-separated field paths,
+// the +, -, * and / operators, and parentheses.
+func parseExpr(input string) (expr, error) {
+	p := &exprParser{input: input}
+	e, err := p.parseSum()
+	if err != nil {
+		return nil, err
+	}
+
+	p.skipSpaces()
+	if p.pos < len(p.input) {
+		return nil, fmt.Errorf("unexpected %q at position %d", p.input[p.pos], p.pos)
+	}
+	return e, nil
+}
+
+type exprParser struct {
+	input string
+	pos   int
+}
+
+func (p *exprParser) skipSpaces() {
+	for p.pos < len(p.input) && p.input[p.pos] == ' ' {
+		p.pos++
+	}
+}
+
+// next returns the next non-space character, or 0 at the end of the input.
+func (p *exprParser) next() byte {
+	p.skipSpaces()
+	if p.pos < len(p.input) {
+		return p.input[p.pos]
+	}
+	return 0
+}
+
+func (p *exprParser) parseSum() (expr, error) {
+	left, err := p.parseProduct()
+	if err != nil {
+		return nil, err
+	}
+
+	for op := p.next(); op == '+' || op == '-'; op = p.next() {
+		p.pos++
+		right, err := p.parseProduct()
+		if err != nil {
+			return nil, err
+		}
+		left = binaryExpr{op, left, right}
+	}
+	return left, nil
+}
+
+func (p *exprParser) parseProduct() (expr, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+
+	for op := p.next(); op == '*' || op == '/'; op = p.next() {
+		p.pos++
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = binaryExpr{op, left, right}
+	}
+	return left, nil
+}
+
+func (p *exprParser) parseUnary() (expr, error) {
+	if p.next() == '-' {
+		p.pos++
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return negExpr{operand}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *exprParser) parsePrimary() (expr, error) {
+	c := p.next()
+	start := p.pos
+
+	switch {
+	case c == '(':
+		p.pos++
+		e, err := p.parseSum()
+		if err != nil {
+			return nil, err
+		}
+		if p.next() != ')' {
+			return nil, fmt.Errorf("missing closing parenthesis at position %d", p.pos)
+		}
+		p.pos++
+		return e, nil
+
+	case c == '.' || unicode.IsDigit(rune(c)):
+		for p.pos < len(p.input) && strings.IndexByte("0123456789.eE", p.input[p.pos]) >= 0 {
+			p.pos++
+		}
+		value, err := strconv.ParseFloat(p.input[start:p.pos], 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q", p.input[start:p.pos])
+		}
+		return numberExpr(value), nil
+
+	case c == '_' || unicode.IsLetter(rune(c)):
+		for p.pos < len(p.input) && (p.input[p.pos] == '_' || p.input[p.pos] == '.' || unicode.IsLetter(rune(p.input[p.pos])) || unicode.IsDigit(rune(p.input[p.pos]))) {
+			p.pos++
+		}
+		return fieldExpr(p.input[start:p.pos]), nil
+
+	case c == 0:
+		return nil, fmt.Errorf("unexpected end of expression")
+	}
+
+	return nil, fmt.Errorf("unexpected %q at position %d", c, p.pos)
+}
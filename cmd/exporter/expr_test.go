@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestParseExpr(t *testing.T) {
+	var data interface{}
+	if err := json.Unmarshal([]byte(`{"a": 6, "b": {"c": 2, "d": 0}, "s": "x"}`), &data); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		expr  string
+		value float64
+	}{
+		{"1 + 2 * 3", 7},
+		{"(1 + 2) * 3", 9},
+		{"8 - 4 - 2", 2},
+		{"8 / 4 / 2", 1},
+		{"2 * 3 + 4 * 5", 26},
+		{"-2 * 3", -6},
+		{"--2", 2},
+		{"2 - -3", 5},
+		{"-(1 + 2)", -3},
+		{"((a))", 6},
+		{"a / b.c", 3},
+		{"a * -b.c + 1.5e1", 3},
+		{".5 * a", 3},
+		{"b.d / a", 0},
+	}
+	for _, test := range tests {
+		e, err := parseExpr(test.expr)
+		if err != nil {
+			t.Errorf("%q: %v", test.expr, err)
+			continue
+		}
+		value, err := e.eval(data)
+		if err != nil {
+			t.Errorf("%q: %v", test.expr, err)
+			continue
+		}
+		if value != test.value {
+			t.Errorf("%q = %g, want %g", test.expr, value, test.value)
+		}
+	}
+}
+
+func TestParseExprInvalid(t *testing.T) {
+	tests := []string{
+		"",
+		"1 +",
+		"(1 + 2",
+		"1 + 2)",
+		"1 2",
+		"* 2",
+		"1.2.3",
+		"a % 2",
+		"()",
+	}
+	for _, test := range tests {
+		if _, err := parseExpr(test); err == nil {
+			t.Errorf("%q: parsed", test)
+		}
+	}
+}
+
+func TestExprEvalErrors(t *testing.T) {
+	var data interface{}
+	if err := json.Unmarshal([]byte(`{"a": 6, "b": {"c": 0}, "s": "x"}`), &data); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		expr string
+		err  string
+	}{
+		{"missing + 1", `field "missing" not found`},
+		{"b.missing", `field "b.missing" not found`},
+		{"s * 2", `field "s" is not a number`},
+		{"a / b.c", "division by zero"},
+		{"a / (b.c * 2)", "division by zero"},
+		{"-(1 / 0)", "division by zero"},
+	}
+	for _, test := range tests {
+		e, err := parseExpr(test.expr)
+		if err != nil {
+			t.Errorf("%q: %v", test.expr, err)
+			continue
+		}
+		if _, err := e.eval(data); err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%q: got error %v, want %q", test.expr, err, test.err)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// endpoint is a URI serving the status script of a target.
+type endpoint struct {
+	// name is "primary" or "backup".
+	name string
+	uri  *url.URL
+	fcgi *fcgiClient
+}
+
+func newEndpoint(name, rawUri string) (*endpoint, error) {
+	uri, err := url.Parse(normalizeURI(rawUri))
+	if err != nil {
+		return nil, err
+	}
+	uri.Fragment = ""
+
+	host := uri.Host
+	if uri.Scheme == "unix" {
+		host = uri.Path
+	}
+	return &endpoint{name: name, uri: uri, fcgi: newFCGIClient(uri.Scheme, host)}, nil
+}
+
+// splitBackup returns the target without its backup URI, given after a pipe
+// such as unix:///run/php/www.sock|tcp://127.0.0.1:9000#pool=www, and the
+// backup URI, which is empty if there is none. The labels of the fragment
+// apply to the target, whichever endpoint serves it.
+func splitBackup(rawUri string) (string, string) {
+	uris, fragment, hasFragment := strings.Cut(rawUri, "#")
+	primary, backup, _ := strings.Cut(uris, "|")
+	if hasFragment {
+		primary += "#" + fragment
+	}
+	return primary, backup
+}
+
+// openServed runs the status script on the primary endpoint of the target,
+// or on its backup endpoint if the primary one cannot be reached, and returns
+// the reader of its output and the endpoint which served it.
+func (e *Exporter) openServed(ctx context.Context, headers map[string]string) (io.ReadCloser, *endpoint, error) {
+	output, err := e.openFrom(ctx, e.primary, headers)
+	if err == nil || e.backup == nil || !unreachable(err) {
+		return output, e.primary, err
+	}
+
+	backupOutput, backupErr := e.openFrom(ctx, e.backup, headers)
+	if backupErr != nil {
+		return nil, nil, errors.Join(err, backupErr)
+	}
+	return backupOutput, e.backup, nil
+}
+
+// fetchServed is like openServed, but returns the whole output.
+func (e *Exporter) fetchServed(ctx context.Context, headers map[string]string) ([]byte, *endpoint, error) {
+	output, served, err := e.openServed(ctx, headers)
+	if err != nil {
+		return nil, served, err
+	}
+	defer output.Close()
+
+	content, err := io.ReadAll(output)
+	if err != nil {
+		return nil, served, err
+	}
+	return content, served, nil
+}
+
+// unreachable tells whether an error is a failure to connect to an endpoint,
+// such as a unix socket missing from the mounts of a container, rather than
+// an error of the script.
+func unreachable(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// collectEndpoint collects which endpoint served the last scrape of a target
+// with a backup endpoint, and logs when the target switches endpoints.
+func (e *Exporter) collectEndpoint(ch chan<- prometheus.Metric) {
+	if e.backup == nil {
+		return
+	}
+
+	if e.served != nil && e.served != e.active && (e.active != nil || e.served == e.backup) {
+		level.Warn(e.logger).Log("msg", "Target served by its "+e.served.name+" endpoint", "target", e.target, "uri", e.served.uri)
+	}
+	if e.served != nil {
+		e.active = e.served
+	}
+
+	for _, ep := range []*endpoint{e.primary, e.backup} {
+		ch <- prometheus.MustNewConstMetric(e.scrapeEndpointDesc, prometheus.GaugeValue, boolMetric(ep == e.served), ep.name, ep.uri.String())
+	}
+}
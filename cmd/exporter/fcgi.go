@@ -0,0 +1,424 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FastCGI protocol, as defined by its specification.
+const (
+	fcgiVersion      = 1
+	fcgiBeginRequest = 1
+	fcgiEndRequest   = 3
+	fcgiParams       = 4
+	fcgiStdin        = 5
+	fcgiStdout       = 6
+	fcgiStderr       = 7
+
+	fcgiResponder = 1
+	fcgiKeepConn  = 1
+
+	fcgiHeaderLen     = 8
+	fcgiMaxContentLen = 65535
+	// Requests are not multiplexed, so they all have the same ID.
+	fcgiRequestID = 1
+
+	fcgiTimeout = 10 * time.Second
+	// fcgiMaxIdleConns is the number of connections kept open per target
+	// between scrapes.
+	fcgiMaxIdleConns = 2
+)
+
+var fcgiPadding [8]byte
+
+// fcgiBuffers are reused by the requests of all the targets.
+var fcgiBuffers = sync.Pool{
+	New: func() interface{} { return new(bytes.Buffer) },
+}
+
+// fcgiClient runs requests on a FastCGI server, reusing its connections.
+type fcgiClient struct {
+	network string
+	address string
+
+	mutex sync.Mutex
+	idle  []net.Conn
+}
+
+func newFCGIClient(network, address string) *fcgiClient {
+	return &fcgiClient{network: network, address: address}
+}
+
+// fcgiResponse is the CGI response of a FastCGI server. Its body must be
+// closed.
+type fcgiResponse struct {
+	Status  int
+	Headers map[string]string
+	Body    *fcgiBody
+}
+
+// Do runs a request with the environment and the body, with the deadline of
+// the context, or fcgiTimeout if it has none, which also bounds reading the
+// body of the response. It is aborted if the context is canceled.
+func (c *fcgiClient) Do(ctx context.Context, env [][2]string, body []byte) (*fcgiResponse, error) {
+	cancel := context.CancelFunc(func() {})
+	if _, ok := ctx.Deadline(); !ok {
+		ctx, cancel = context.WithTimeout(ctx, fcgiTimeout)
+	}
+
+	request := fcgiBuffers.Get().(*bytes.Buffer)
+	defer fcgiBuffers.Put(request)
+	request.Reset()
+	if err := writeFCGIRequest(request, env, body); err != nil {
+		cancel()
+		return nil, err
+	}
+
+	resp, err := c.send(ctx, request.Bytes())
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	resp.Body.cancel = cancel
+	return resp, nil
+}
+
+// send sends the request on an idle connection, or a new one, and reads the
+// headers of the response.
+func (c *fcgiClient) send(ctx context.Context, request []byte) (*fcgiResponse, error) {
+	// Idle connections may have been closed by the server, in which case
+	// the request is retried on a new one.
+	if conn := c.idleConn(); conn != nil {
+		resp, started, err := c.roundTrip(ctx, conn, request)
+		if err == nil || started || ctx.Err() != nil {
+			return resp, err
+		}
+	}
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, c.network, c.address)
+	if err != nil {
+		return nil, err
+	}
+	resp, _, err := c.roundTrip(ctx, conn, request)
+	return resp, err
+}
+
+// idleConn returns an idle connection, or nil if there is none.
+func (c *fcgiClient) idleConn() net.Conn {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if len(c.idle) == 0 {
+		return nil
+	}
+	conn := c.idle[len(c.idle)-1]
+	c.idle = c.idle[:len(c.idle)-1]
+	return conn
+}
+
+// release keeps a connection for later requests, or closes it if enough are
+// kept already.
+func (c *fcgiClient) release(conn net.Conn) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if len(c.idle) >= fcgiMaxIdleConns {
+		conn.Close()
+		return
+	}
+	c.idle = append(c.idle, conn)
+}
+
+// roundTrip sends the request on the connection and reads the headers of the
+// response. It also returns whether the server started answering, after
+// which the request cannot be retried. The connection is closed on errors,
+// and released by the body otherwise.
+func (c *fcgiClient) roundTrip(ctx context.Context, conn net.Conn, request []byte) (*fcgiResponse, bool, error) {
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+	stop := context.AfterFunc(ctx, func() {
+		// Unblocks the pending read or write.
+		conn.SetDeadline(time.Unix(1, 0))
+	})
+
+	stream := &fcgiStream{r: bufio.NewReader(conn)}
+	resp, err := func() (*fcgiResponse, error) {
+		if _, err := conn.Write(request); err != nil {
+			return nil, err
+		}
+		return readCGIHeaders(stream)
+	}()
+	if err != nil {
+		stop()
+		conn.Close()
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			err = ctxErr
+		}
+		return nil, stream.started, err
+	}
+
+	resp.Body.ctx = ctx
+	resp.Body.stream = stream
+	resp.Body.client = c
+	resp.Body.conn = conn
+	resp.Body.stop = stop
+	return resp, true, nil
+}
+
+// writeFCGIRequest writes the records of a responder request, keeping the
+// connection open.
+func writeFCGIRequest(w *bytes.Buffer, env [][2]string, body []byte) error {
+	writeFCGIRecord(w, fcgiBeginRequest, []byte{0, fcgiResponder, fcgiKeepConn, 0, 0, 0, 0, 0})
+
+	params := fcgiBuffers.Get().(*bytes.Buffer)
+	defer fcgiBuffers.Put(params)
+	params.Reset()
+	for _, kv := range env {
+		if len(kv[0]) > 0x7fffffff || len(kv[1]) > 0x7fffffff {
+			return errors.New("fcgi: parameter too large")
+		}
+		writeFCGILength(params, len(kv[0]))
+		writeFCGILength(params, len(kv[1]))
+		params.WriteString(kv[0])
+		params.WriteString(kv[1])
+	}
+	writeFCGIStream(w, fcgiParams, params.Bytes())
+	writeFCGIStream(w, fcgiStdin, body)
+
+	return nil
+}
+
+// writeFCGIStream writes the content of a stream in as many records as
+// needed, followed by the empty record ending it.
+func writeFCGIStream(w *bytes.Buffer, recordType byte, content []byte) {
+	for len(content) > 0 {
+		n := min(len(content), fcgiMaxContentLen)
+		writeFCGIRecord(w, recordType, content[:n])
+		content = content[n:]
+	}
+	writeFCGIRecord(w, recordType, nil)
+}
+
+func writeFCGIRecord(w *bytes.Buffer, recordType byte, content []byte) {
+	padding := -len(content) & 7
+	header := [fcgiHeaderLen]byte{fcgiVersion, recordType, 0, fcgiRequestID, 0, 0, byte(padding), 0}
+	binary.BigEndian.PutUint16(header[4:], uint16(len(content)))
+
+	w.Write(header[:])
+	w.Write(content)
+	w.Write(fcgiPadding[:padding])
+}
+
+// writeFCGILength writes the length of a name or a value of parameter, on
+// one byte if it fits, or else on four.
+func writeFCGILength(w *bytes.Buffer, length int) {
+	if length < 0x80 {
+		w.WriteByte(byte(length))
+		return
+	}
+	var buf [4]byte
+	binary.BigEndian.PutUint32(buf[:], uint32(length)|1<<31)
+	w.Write(buf[:])
+}
+
+// fcgiStream reads the content of the stdout records of a response, keeping
+// its stderr records, until the end of the request.
+type fcgiStream struct {
+	r *bufio.Reader
+	// stdout is the length of the content of the current stdout record left
+	// to read, followed by padding bytes.
+	stdout  int
+	padding int
+	stderr  strings.Builder
+	// started tells whether any record was read, and ended whether the end
+	// of the request was.
+	started bool
+	ended   bool
+}
+
+func (s *fcgiStream) Read(p []byte) (int, error) {
+	for s.stdout == 0 {
+		if s.ended {
+			return 0, io.EOF
+		}
+		if err := s.next(); err != nil {
+			return 0, err
+		}
+	}
+	if len(p) > s.stdout {
+		p = p[:s.stdout]
+	}
+	n, err := s.r.Read(p)
+	s.stdout -= n
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// next reads the records until content of stdout, or the end of the request.
+func (s *fcgiStream) next() error {
+	if _, err := s.r.Discard(s.padding); err != nil {
+		return err
+	}
+	s.padding = 0
+
+	var header [fcgiHeaderLen]byte
+	if _, err := io.ReadFull(s.r, header[:]); err != nil {
+		if s.started && err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	s.started = true
+
+	if header[0] != fcgiVersion {
+		return fmt.Errorf("fcgi: unsupported version %d", header[0])
+	}
+	length := int(binary.BigEndian.Uint16(header[4:]))
+	s.padding = int(header[6])
+
+	switch header[1] {
+	case fcgiStdout:
+		s.stdout = length
+	case fcgiStderr:
+		if _, err := io.CopyN(&s.stderr, s.r, int64(length)); err != nil {
+			return err
+		}
+	case fcgiEndRequest:
+		// The application status, such as the exit code of the script, is
+		// ignored like by web servers, unlike the protocol status telling
+		// whether the request was rejected.
+		var body [8]byte
+		if length < len(body) {
+			return errors.New("fcgi: malformed end of request")
+		}
+		if _, err := io.ReadFull(s.r, body[:]); err != nil {
+			return err
+		}
+		if _, err := s.r.Discard(length - len(body) + s.padding); err != nil {
+			return err
+		}
+		s.padding = 0
+		if body[4] != 0 {
+			return fmt.Errorf("fcgi: request rejected with protocol status %d", body[4])
+		}
+		if s.r.Buffered() > 0 {
+			return errors.New("fcgi: unexpected data after the end of the request")
+		}
+		s.ended = true
+	default:
+		if _, err := s.r.Discard(length); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fcgiBody is the body of a response, read from the stdout records until the
+// end of the request, after which its connection can be reused.
+type fcgiBody struct {
+	r io.Reader
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	stream *fcgiStream
+	client *fcgiClient
+	conn   net.Conn
+	stop   func() bool
+}
+
+func (b *fcgiBody) Read(p []byte) (int, error) {
+	n, err := b.r.Read(p)
+	if err != nil && err != io.EOF {
+		if ctxErr := b.ctx.Err(); ctxErr != nil {
+			err = ctxErr
+		}
+	}
+	return n, err
+}
+
+// Stderr returns the error output of the script, such as "Primary script
+// unknown" when PHP-FPM cannot find it, as read so far: it is complete once
+// the body was read.
+func (b *fcgiBody) Stderr() string {
+	return b.stream.stderr.String()
+}
+
+// Close releases the connection if the end of the request was read, and
+// closes it otherwise.
+func (b *fcgiBody) Close() error {
+	// The deadline may have been forced right after the response.
+	if b.stop() && b.stream.ended {
+		b.conn.SetDeadline(time.Time{})
+		b.client.release(b.conn)
+	} else {
+		b.conn.Close()
+	}
+	b.cancel()
+	return nil
+}
+
+// readCGIHeaders reads the headers of the CGI response from the start of the
+// output, which may have none.
+func readCGIHeaders(output io.Reader) (*fcgiResponse, error) {
+	resp := &fcgiResponse{Status: 200, Headers: map[string]string{}, Body: &fcgiBody{}}
+
+	r := bufio.NewReader(output)
+	var consumed []byte
+	for {
+		line, err := r.ReadSlice('\n')
+		consumed = append(consumed, line...)
+		if err == nil && len(bytes.TrimRight(line, "\r\n")) == 0 {
+			break
+		}
+		name, value, ok := bytes.Cut(bytes.TrimRight(line, "\r\n"), []byte(":"))
+		name = bytes.TrimSpace(name)
+		if err == io.EOF || err == bufio.ErrBufferFull || (err == nil && (!ok || !cgiHeaderName(name))) {
+			// Output without headers.
+			resp.Headers = map[string]string{}
+			resp.Body.r = io.MultiReader(bytes.NewReader(consumed), r)
+			return resp, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		resp.Headers[strings.ToLower(string(name))] = string(bytes.TrimSpace(value))
+	}
+
+	if status, ok := resp.Headers["status"]; ok {
+		code, _, _ := strings.Cut(status, " ")
+		var err error
+		if resp.Status, err = strconv.Atoi(code); err != nil {
+			return nil, fmt.Errorf("fcgi: malformed status %q", status)
+		}
+	}
+
+	resp.Body.r = r
+	return resp, nil
+}
+
+// cgiHeaderName tells whether the name of a header is valid, which tells
+// outputs without headers apart.
+func cgiHeaderName(name []byte) bool {
+	if len(name) == 0 {
+		return false
+	}
+	for _, c := range name {
+		if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '-' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
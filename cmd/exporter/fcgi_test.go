@@ -0,0 +1,350 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fcgiRecord encodes a record of the response, with padding bytes.
+func fcgiRecord(recordType byte, content string, padding int) []byte {
+	header := [fcgiHeaderLen]byte{fcgiVersion, recordType, 0, fcgiRequestID, 0, 0, byte(padding), 0}
+	binary.BigEndian.PutUint16(header[4:], uint16(len(content)))
+	return append(append(header[:], content...), make([]byte, padding)...)
+}
+
+// fcgiEnd encodes the end of the request, with the application and protocol
+// statuses.
+func fcgiEnd(appStatus uint32, protocolStatus byte) []byte {
+	var body [8]byte
+	binary.BigEndian.PutUint32(body[:], appStatus)
+	body[4] = protocolStatus
+	return fcgiRecord(fcgiEndRequest, string(body[:]), 0)
+}
+
+// readFCGIRequest reads a request sent by the client, returning its
+// parameters once its stdin stream ended.
+func readFCGIRequest(r *bufio.Reader) (map[string]string, error) {
+	var params bytes.Buffer
+	for {
+		var header [fcgiHeaderLen]byte
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			return nil, err
+		}
+		content := make([]byte, binary.BigEndian.Uint16(header[4:]))
+		if _, err := io.ReadFull(r, content); err != nil {
+			return nil, err
+		}
+		if _, err := r.Discard(int(header[6])); err != nil {
+			return nil, err
+		}
+
+		switch header[1] {
+		case fcgiParams:
+			params.Write(content)
+		case fcgiStdin:
+			if len(content) > 0 {
+				continue
+			}
+			decoded := map[string]string{}
+			for params.Len() > 0 {
+				nameLen, valueLen := readFCGITestLength(&params), readFCGITestLength(&params)
+				name := string(params.Next(nameLen))
+				decoded[name] = string(params.Next(valueLen))
+			}
+			return decoded, nil
+		}
+	}
+}
+
+func readFCGITestLength(params *bytes.Buffer) int {
+	b, _ := params.ReadByte()
+	if b < 0x80 {
+		return int(b)
+	}
+	rest := params.Next(3)
+	return int(binary.BigEndian.Uint32([]byte{b & 0x7f, rest[0], rest[1], rest[2]}))
+}
+
+// pipeFCGIClient returns a client whose only idle connection is served by
+// serve, and the client end of the connection.
+func pipeFCGIClient(serve func(conn net.Conn)) (*fcgiClient, net.Conn) {
+	client, server := net.Pipe()
+	go func() {
+		defer server.Close()
+		serve(server)
+	}()
+
+	// Requests fail instead of dialing when the connection is not reused.
+	c := newFCGIClient("unix", "/nonexistent/fcgi.sock")
+	c.idle = []net.Conn{client}
+	return c, client
+}
+
+// TestFCGIClientResponses checks that responses are read from their records
+// however they are split, padded and interleaved.
+func TestFCGIClientResponses(t *testing.T) {
+	tests := []struct {
+		name    string
+		records [][]byte
+		status  int
+		headers map[string]string
+		body    string
+		stderr  string
+		err     string
+	}{
+		{
+			name: "single record",
+			records: [][]byte{
+				fcgiRecord(fcgiStdout, "Content-Type: application/json\r\n\r\n{\"a\":1}", 0),
+				fcgiRecord(fcgiStdout, "", 0),
+				fcgiEnd(0, 0),
+			},
+			status:  200,
+			headers: map[string]string{"content-type": "application/json"},
+			body:    `{"a":1}`,
+		},
+		{
+			name: "split records",
+			records: [][]byte{
+				fcgiRecord(fcgiStdout, "Status: 404 Not", 0),
+				fcgiRecord(fcgiStdout, " Found\r\nContent-Type: text/plain\r", 0),
+				fcgiRecord(fcgiStdout, "\n\r\nFile not", 0),
+				fcgiRecord(fcgiStdout, " found.", 0),
+				fcgiEnd(0, 0),
+			},
+			status:  404,
+			headers: map[string]string{"status": "404 Not Found", "content-type": "text/plain"},
+			body:    "File not found.",
+		},
+		{
+			name: "padding",
+			records: [][]byte{
+				fcgiRecord(fcgiStdout, "Content-Type: text/plain\n\n", 6),
+				fcgiRecord(fcgiStdout, "abc", 5),
+				fcgiRecord(fcgiStdout, "", 8),
+				fcgiRecord(fcgiEndRequest, string(fcgiEnd(0, 0)[fcgiHeaderLen:]), 3),
+			},
+			status:  200,
+			headers: map[string]string{"content-type": "text/plain"},
+			body:    "abc",
+		},
+		{
+			name: "interleaved stderr",
+			records: [][]byte{
+				fcgiRecord(fcgiStdout, "Content-Type: text/plain\r\n\r\nab", 0),
+				fcgiRecord(fcgiStderr, "PHP Warning: ", 1),
+				fcgiRecord(fcgiStdout, "c", 0),
+				fcgiRecord(fcgiStderr, "deprecated", 0),
+				fcgiEnd(0, 0),
+			},
+			status:  200,
+			headers: map[string]string{"content-type": "text/plain"},
+			body:    "abc",
+			stderr:  "PHP Warning: deprecated",
+		},
+		{
+			name: "stderr only",
+			records: [][]byte{
+				fcgiRecord(fcgiStderr, "Primary script unknown", 2),
+				fcgiRecord(fcgiStdout, "", 0),
+				fcgiEnd(0, 0),
+			},
+			status:  200,
+			headers: map[string]string{},
+			stderr:  "Primary script unknown",
+		},
+		{
+			name: "no headers",
+			records: [][]byte{
+				fcgiRecord(fcgiStdout, "{\"status\":\n\n{}}", 0),
+				fcgiEnd(0, 0),
+			},
+			status:  200,
+			headers: map[string]string{},
+			body:    "{\"status\":\n\n{}}",
+		},
+		{
+			name: "application status",
+			records: [][]byte{
+				fcgiRecord(fcgiStdout, "Content-Type: text/plain\r\n\r\nexit", 0),
+				fcgiEnd(255, 0),
+			},
+			status:  200,
+			headers: map[string]string{"content-type": "text/plain"},
+			body:    "exit",
+		},
+		{
+			name: "rejected request",
+			records: [][]byte{
+				fcgiEnd(0, 2),
+			},
+			err: "fcgi: request rejected with protocol status 2",
+		},
+		{
+			name: "truncated response",
+			records: [][]byte{
+				fcgiRecord(fcgiStdout, "Content-Type: text/plain\r\n\r\nabc", 0)[:fcgiHeaderLen+30],
+			},
+			status:  200,
+			headers: map[string]string{"content-type": "text/plain"},
+			err:     io.ErrUnexpectedEOF.Error(),
+		},
+	}
+
+	longValue := strings.Repeat("v", 300)
+	for _, test := range tests {
+		c, _ := pipeFCGIClient(func(conn net.Conn) {
+			params, err := readFCGIRequest(bufio.NewReader(conn))
+			if err != nil {
+				t.Errorf("%s: reading the request: %v", test.name, err)
+				return
+			}
+			if params["SCRIPT_FILENAME"] != "/app/status.php" || params["LONG"] != longValue {
+				t.Errorf("%s: got parameters %v", test.name, params)
+			}
+			for _, record := range test.records {
+				conn.Write(record)
+			}
+		})
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		resp, err := c.Do(ctx, [][2]string{{"SCRIPT_FILENAME", "/app/status.php"}, {"LONG", longValue}}, nil)
+		var body []byte
+		if err == nil {
+			body, err = io.ReadAll(resp.Body)
+			resp.Body.Close()
+		}
+		cancel()
+
+		if len(test.err) > 0 {
+			if err == nil || err.Error() != test.err {
+				t.Errorf("%s: got error %v, want %s", test.name, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if resp.Status != test.status {
+			t.Errorf("%s: got status %d, want %d", test.name, resp.Status, test.status)
+		}
+		if len(resp.Headers) != len(test.headers) {
+			t.Errorf("%s: got headers %v, want %v", test.name, resp.Headers, test.headers)
+		}
+		for name, value := range test.headers {
+			if resp.Headers[name] != value {
+				t.Errorf("%s: got header %s %q, want %q", test.name, name, resp.Headers[name], value)
+			}
+		}
+		if string(body) != test.body {
+			t.Errorf("%s: got body %q, want %q", test.name, body, test.body)
+		}
+		if resp.Body.Stderr() != test.stderr {
+			t.Errorf("%s: got stderr %q, want %q", test.name, resp.Body.Stderr(), test.stderr)
+		}
+	}
+}
+
+// TestFCGIClientReuse checks that connections are reused once their response
+// was read, but closed when it was not, such as after a timeout, so that the
+// rest of the response is never read by the next request.
+func TestFCGIClientReuse(t *testing.T) {
+	response := [][]byte{
+		fcgiRecord(fcgiStdout, "Content-Type: text/plain\r\n\r\nok", 0),
+		fcgiEnd(0, 0),
+	}
+
+	served := make(chan int)
+	c, conn := pipeFCGIClient(func(conn net.Conn) {
+		r := bufio.NewReader(conn)
+		requests := 0
+		defer func() { served <- requests }()
+		for {
+			if _, err := readFCGIRequest(r); err != nil {
+				return
+			}
+			requests++
+			if requests == 3 {
+				// Times out.
+				continue
+			}
+			for _, record := range response {
+				if _, err := conn.Write(record); err != nil {
+					return
+				}
+			}
+		}
+	})
+
+	for i := 0; i < 2; i++ {
+		resp, err := c.Do(context.Background(), nil, nil)
+		if err != nil {
+			t.Fatalf("request %d: %v", i, err)
+		}
+		if body, err := io.ReadAll(resp.Body); err != nil || string(body) != "ok" {
+			t.Fatalf("request %d: got body %q, %v", i, body, err)
+		}
+		resp.Body.Close()
+		if len(c.idle) != 1 || c.idle[0] != conn {
+			t.Fatalf("request %d: connection not released", i)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := c.Do(ctx, nil, nil); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got error %v, want %v", err, context.DeadlineExceeded)
+	}
+	if len(c.idle) != 0 {
+		t.Fatal("connection released after a timeout")
+	}
+	select {
+	case requests := <-served:
+		if requests != 3 {
+			t.Errorf("got %d requests on the connection, want 3", requests)
+		}
+	case <-time.After(time.Second):
+		t.Error("connection not closed after a timeout")
+	}
+}
+
+// TestFCGIClientUnreadBody checks that connections are closed when their
+// body is closed before the end of the request.
+func TestFCGIClientUnreadBody(t *testing.T) {
+	closed := make(chan struct{})
+	c, _ := pipeFCGIClient(func(conn net.Conn) {
+		defer close(closed)
+		if _, err := readFCGIRequest(bufio.NewReader(conn)); err != nil {
+			return
+		}
+		conn.Write(fcgiRecord(fcgiStdout, "Content-Type: text/plain\r\n\r\n", 0))
+		for {
+			if _, err := conn.Write(fcgiRecord(fcgiStdout, strings.Repeat("x", 1000), 0)); err != nil {
+				return
+			}
+		}
+	})
+
+	resp, err := c.Do(context.Background(), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if len(c.idle) != 0 {
+		t.Fatal("connection released before the end of the request")
+	}
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Error("connection not closed")
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// fileCacheExpression is the PHP expression walking the second-level cache
+// directory of opcache.file_cache, evaluated to null when it is not set. The
+// age of the oldest entry is computed by PHP, so that it does not depend on
+// the clock of the exporter.
+const fileCacheExpression = "(function ($dir) { if (!$dir) { return null; } $usage = ['size' => 0, 'entries' => 0, 'oldest_entry_age' => null]; $now = time(); foreach (new \\RecursiveIteratorIterator(new \\RecursiveDirectoryIterator($dir, \\FilesystemIterator::SKIP_DOTS)) as $file) { if ($file->isFile()) { $usage['size'] += $file->getSize(); $usage['entries']++; $usage['oldest_entry_age'] = max($usage['oldest_entry_age'] ?? 0, $now - $file->getMTime()); } } return $usage; })(ini_get('opcache.file_cache'))"
+
+// FileCacheUsage contains the usage of the second-level cache directory of
+// opcache.file_cache
+type FileCacheUsage struct {
+	Size    int64 `json:"size"`
+	Entries int64 `json:"entries"`
+	// OldestEntryAge is the age in seconds of the oldest file, if any.
+	OldestEntryAge *int64 `json:"oldest_entry_age"`
+}
+
+func init() {
+	registerCollector(collector{
+		name:        fileCacheCollector,
+		fromPayload: true,
+		section:     "file_cache_usage",
+		enabled:     func(e *Exporter) bool { return e.collectors[fileCacheCollector] },
+		update: func(e *Exporter, ch chan<- prometheus.Metric, payload *Payload) error {
+			// The file cache is reported only when opcache.file_cache is set.
+			usage := payload.FileCache
+			if usage == nil {
+				return nil
+			}
+			ch <- prometheus.MustNewConstMetric(e.fileCacheSizeDesc, prometheus.GaugeValue, intMetric(usage.Size))
+			ch <- prometheus.MustNewConstMetric(e.fileCacheEntriesDesc, prometheus.GaugeValue, intMetric(usage.Entries))
+			if usage.OldestEntryAge != nil {
+				ch <- prometheus.MustNewConstMetric(e.fileCacheOldestAgeDesc, prometheus.GaugeValue, intMetric(*usage.OldestEntryAge))
+			}
+			return nil
+		},
+	})
+}
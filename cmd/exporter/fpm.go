@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// FPMPool is a PHP-FPM pool, as defined by its configuration file.
+type FPMPool struct {
+	Name   string
+	Listen string
+	// Chroot is the directory the workers of the pool are chrooted to.
+	Chroot string
+	// Dirs are the directories the pool is known to execute scripts from,
+	// most relevant first: its open_basedir, its working directory, and its
+	// document root last, as scripts there may be reachable through the
+	// web server.
+	Dirs []string
+}
+
+// FPMPools are the pools of the PHP-FPM servers scraped by the exporter.
+type FPMPools []*FPMPool
+
+// LoadFPMPools parses the PHP-FPM pool configuration files matching the glob
+// pattern.
+func LoadFPMPools(pattern string) (FPMPools, error) {
+	var pools FPMPools
+	if len(pattern) == 0 {
+		return pools, nil
+	}
+
+	files, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, file := range files {
+		filePools, err := loadFPMPoolFile(file)
+		if err != nil {
+			return nil, err
+		}
+		pools = append(pools, filePools...)
+	}
+
+	return pools, nil
+}
+
+func loadFPMPoolFile(file string) (FPMPools, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var pools FPMPools
+	var pool *FPMPool
+	var docRoot, openBasedir, chdir string
+
+	flush := func() {
+		if pool == nil {
+			return
+		}
+		for _, dir := range append(strings.Split(openBasedir, ":"), chdir, docRoot) {
+			if path.IsAbs(dir) {
+				pool.Dirs = append(pool.Dirs, path.Clean(dir))
+			}
+		}
+		pools = append(pools, pool)
+		pool, docRoot, openBasedir, chdir = nil, "", "", ""
+	}
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || line[0] == ';' || line[0] == '#' {
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			flush()
+			if name := line[1 : len(line)-1]; name != "global" {
+				pool = &FPMPool{Name: name}
+			}
+			continue
+		}
+
+		key, value, ok := strings.Cut(line, "=")
+		if !ok || pool == nil {
+			continue
+		}
+		value = strings.Trim(strings.TrimSpace(value), `"'`)
+		value = strings.ReplaceAll(value, "$pool", pool.Name)
+
+		switch strings.TrimSpace(key) {
+		case "listen":
+			pool.Listen = value
+		case "chroot":
+			pool.Chroot = value
+		case "chdir":
+			chdir = value
+		case "php_value[doc_root]", "php_admin_value[doc_root]":
+			docRoot = value
+		case "php_value[open_basedir]", "php_admin_value[open_basedir]":
+			openBasedir = value
+		}
+	}
+	flush()
+
+	return pools, scanner.Err()
+}
+
+// Lookup returns the pool listening on the address of the target URI, or nil
+// if none is.
+func (p FPMPools) Lookup(uri *url.URL) *FPMPool {
+	for _, pool := range p {
+		if pool.listensOn(uri) {
+			return pool
+		}
+	}
+	return nil
+}
+
+func (p *FPMPool) listensOn(uri *url.URL) bool {
+	if uri.Scheme == "unix" {
+		return path.Clean(p.Listen) == path.Clean(uri.Path)
+	}
+	if uri.Scheme != "tcp" {
+		return false
+	}
+
+	// A pool listening on a bare port accepts connections on all addresses.
+	host, port, err := net.SplitHostPort(p.Listen)
+	if err != nil {
+		host, port = "", p.Listen
+	}
+	if port != uri.Port() {
+		return false
+	}
+	return host == "" || host == "0.0.0.0" || host == "::" || host == uri.Hostname()
+}
+
+// ScriptDir returns a directory where the pool is allowed to execute scripts,
+// as seen by the exporter and by the pool, or empty strings if none exists.
+func (p *FPMPool) ScriptDir() (string, string) {
+	for _, dir := range p.Dirs {
+		localDir := filepath.Join(p.Chroot, dir)
+		if info, err := os.Stat(localDir); err == nil && info.IsDir() {
+			return localDir, dir
+		}
+	}
+	return "", ""
+}
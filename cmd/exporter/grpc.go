@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"opcache_exporter/internal/statuspb"
+)
+
+const (
+	defaultWatchInterval = 15 * time.Second
+	minWatchInterval     = time.Second
+)
+
+// statusServer implements the gRPC status service over the targets of the
+// API.
+type statusServer struct {
+	statuspb.UnimplementedStatusServiceServer
+
+	api *api
+}
+
+// exporters returns the exporters of the requested targets, all of them if
+// none is requested.
+func (s *statusServer) exporters(targets []string) ([]*Exporter, error) {
+	if len(targets) == 0 {
+		return s.api.sortedTargets(), nil
+	}
+
+	exporters := make([]*Exporter, 0, len(targets))
+	for _, target := range targets {
+		e, ok := s.api.targets[target]
+		if !ok {
+			return nil, status.Errorf(codes.NotFound, "unknown target %q", target)
+		}
+		exporters = append(exporters, e)
+	}
+	return exporters, nil
+}
+
+func (s *statusServer) GetStatus(ctx context.Context, req *statuspb.GetStatusRequest) (*statuspb.GetStatusResponse, error) {
+	exporters, err := s.exporters(req.Targets)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &statuspb.GetStatusResponse{}
+	for _, e := range exporters {
+		resp.Statuses = append(resp.Statuses, targetStatus(ctx, e))
+	}
+	return resp, nil
+}
+
+func (s *statusServer) WatchStatus(req *statuspb.WatchStatusRequest, stream statuspb.StatusService_WatchStatusServer) error {
+	exporters, err := s.exporters(req.Targets)
+	if err != nil {
+		return err
+	}
+
+	interval := defaultWatchInterval
+	if req.Interval != nil {
+		interval = max(req.Interval.AsDuration(), minWatchInterval)
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		for _, e := range exporters {
+			if err := stream.Send(targetStatus(stream.Context(), e)); err != nil {
+				return err
+			}
+		}
+
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// targetStatus retrieves the current status of a target.
+func targetStatus(ctx context.Context, e *Exporter) *statuspb.TargetStatus {
+	ts := &statuspb.TargetStatus{
+		Target: e.Target(),
+		Time:   timestamppb.Now(),
+	}
+
+	s, err := e.getOpcacheStatus(ctx)
+	if err != nil {
+		ts.Error = err.Error()
+		return ts
+	}
+
+	ts.Status = &statuspb.OPcacheStatus{
+		OpcacheEnabled:    s.OPcacheEnabled,
+		CacheFull:         s.CacheFull,
+		RestartPending:    s.RestartPending,
+		RestartInProgress: s.RestartInProgress,
+		MemoryUsage: &statuspb.MemoryUsage{
+			UsedMemory:              s.MemoryUsage.UsedMemory,
+			FreeMemory:              s.MemoryUsage.FreeMemory,
+			WastedMemory:            s.MemoryUsage.WastedMemory,
+			CurrentWastedPercentage: s.MemoryUsage.CurrentWastedPercentage,
+		},
+		InternedStringsUsage: &statuspb.InternedStringsUsage{
+			BufferSize:      s.InternedStringsUsage.BufferSize,
+			UsedMemory:      s.InternedStringsUsage.UsedMemory,
+			FreeMemory:      s.InternedStringsUsage.FreeMemory,
+			NumberOfStrings: s.InternedStringsUsage.NumerOfStrings,
+		},
+		OpcacheStatistics: &statuspb.OPcacheStatistics{
+			NumCachedScripts:   s.OPcacheStatistics.NumCachedScripts,
+			NumCachedKeys:      s.OPcacheStatistics.NumCachedKeys,
+			MaxCachedKeys:      s.OPcacheStatistics.MaxCachedKeys,
+			Hits:               s.OPcacheStatistics.Hits,
+			StartTime:          s.OPcacheStatistics.StartTime,
+			LastRestartTime:    s.OPcacheStatistics.LastRestartTime,
+			OomRestarts:        s.OPcacheStatistics.OOMRestarts,
+			HashRestarts:       s.OPcacheStatistics.HashRestarts,
+			ManualRestarts:     s.OPcacheStatistics.ManualRestarts,
+			Misses:             s.OPcacheStatistics.Misses,
+			BlacklistMisses:    s.OPcacheStatistics.BlacklistMisses,
+			BlacklistMissRatio: s.OPcacheStatistics.BlacklistMissRatio,
+			OpcacheHitRate:     s.OPcacheStatistics.OPcacheHitRate,
+		},
+	}
+	return ts
+}
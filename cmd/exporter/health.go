@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// healthHandler serves the liveness of the exporter, and with deep=true,
+// checks the whole path to OPcache with live status requests to the targets,
+// for orchestration systems.
+type healthHandler struct {
+	api     *api
+	timeout time.Duration
+	// deep serves deep checks, which always require a read or admin token,
+	// as they send requests to the targets.
+	deep http.Handler
+}
+
+func newHealthHandler(api *api, timeout time.Duration, fanOut func(http.Handler) http.Handler) *healthHandler {
+	h := &healthHandler{api: api, timeout: timeout}
+	h.deep = fanOut(http.HandlerFunc(h.serveDeep))
+	return h
+}
+
+func (h *healthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Get("deep") == "true" {
+		h.deep.ServeHTTP(w, r)
+		return
+	}
+	fmt.Fprintln(w, "OPcache Exporter is Healthy.")
+}
+
+// serveDeep requests the status of the target of the "target" query
+// parameter, or of all the targets if it is omitted, at most h.api.workers at
+// once, answering 503 Service Unavailable if any of them fails or has OPcache
+// disabled.
+func (h *healthHandler) serveDeep(w http.ResponseWriter, r *http.Request) {
+	exporters := h.api.sortedTargets()
+	if len(r.URL.Query().Get("target")) > 0 {
+		e, err := h.api.lookup(r, "target")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		exporters = []*Exporter{e}
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), h.timeout)
+	defer cancel()
+
+	errs := make([]error, len(exporters))
+	var wg sync.WaitGroup
+	workers := make(chan struct{}, h.api.workers)
+	for i, e := range exporters {
+		wg.Add(1)
+		workers <- struct{}{}
+		go func(i int, e *Exporter) {
+			defer wg.Done()
+			defer func() { <-workers }()
+			errs[i] = checkTarget(ctx, e)
+		}(i, e)
+	}
+	wg.Wait()
+
+	var failures []string
+	for i, err := range errs {
+		if err != nil {
+			failures = append(failures, exporters[i].Target()+": "+err.Error())
+		}
+	}
+	if len(failures) > 0 {
+		http.Error(w, strings.Join(failures, "\n"), http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "OPcache Exporter is Healthy.")
+}
+
+// checkTarget requests the status of the target, skipping the scripts and the
+// custom collectors, and checks that OPcache is enabled.
+func checkTarget(ctx context.Context, e *Exporter) error {
+	payload, err := e.getPayloadWith(ctx, map[string]string{scriptSkipHeader: scriptsCollector + "," + customCollector})
+	if err != nil {
+		return err
+	}
+	if !payload.Status.OPcacheEnabled {
+		return fmt.Errorf("OPcache disabled")
+	}
+	return nil
+}
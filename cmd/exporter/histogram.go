@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	// memoryBuckets range from 1KiB to 16MiB.
+	memoryBuckets = prometheus.ExponentialBuckets(1024, 4, 8)
+	// hitsBuckets range from 1 to 1M hits.
+	hitsBuckets = prometheus.ExponentialBuckets(1, 10, 7)
+)
+
+// checkBuckets checks that the upper bounds of the buckets of a histogram
+// are increasing.
+func checkBuckets(buckets []float64) error {
+	for i := 1; i < len(buckets); i++ {
+		if buckets[i] <= buckets[i-1] {
+			return fmt.Errorf("bucket %g not greater than %g", buckets[i], buckets[i-1])
+		}
+	}
+	return nil
+}
+
+// scriptHistogram exports the distribution of a value over the cached scripts
+// of a target, as a classic or a native histogram.
+type scriptHistogram struct {
+	opts   prometheus.HistogramOpts
+	native bool
+	desc   *prometheus.Desc
+}
+
+func newScriptHistogram(metricName, metricDesc string, labels prometheus.Labels, buckets []float64, native bool) *scriptHistogram {
+	opts := prometheus.HistogramOpts{
+		Namespace:   namespace,
+		Name:        metricName,
+		Help:        metricDesc,
+		ConstLabels: labels,
+		Buckets:     buckets,
+	}
+	// Native histograms pick their own buckets, and leaving the classic
+	// ones unset avoids exporting both.
+	if native {
+		opts.Buckets = nil
+		opts.NativeHistogramBucketFactor = 1.1
+	}
+
+	return &scriptHistogram{
+		opts:   opts,
+		native: native,
+		desc:   newMetric(metricName, metricDesc, labels),
+	}
+}
+
+// histogramAccumulator fills a scriptHistogram with the values of the cached
+// scripts, one at a time.
+type histogramAccumulator struct {
+	histogram *scriptHistogram
+	// native is filled instead of the counts of classic histograms, as const
+	// histograms cannot be native.
+	native  prometheus.Histogram
+	buckets map[float64]uint64
+	count   uint64
+	sum     float64
+}
+
+// accumulate returns an empty accumulator of the histogram.
+func (h *scriptHistogram) accumulate() *histogramAccumulator {
+	if h.native {
+		return &histogramAccumulator{histogram: h, native: prometheus.NewHistogram(h.opts)}
+	}
+	return &histogramAccumulator{histogram: h, buckets: make(map[float64]uint64, len(h.opts.Buckets))}
+}
+
+func (a *histogramAccumulator) observe(v float64) {
+	if a.native != nil {
+		a.native.Observe(v)
+		return
+	}
+
+	for _, bound := range a.histogram.opts.Buckets {
+		if v <= bound {
+			a.buckets[bound]++
+		}
+	}
+	a.count++
+	a.sum += v
+}
+
+// metric returns the histogram of the observed values.
+func (a *histogramAccumulator) metric() prometheus.Metric {
+	if a.native != nil {
+		return a.native
+	}
+	return prometheus.MustNewConstHistogram(a.histogram.desc, a.count, a.sum, a.buckets)
+}
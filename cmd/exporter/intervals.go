@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// skipped returns the PHP expression telling whether the generated status
+// script is requested to skip a collector.
+func skipped(collector string) string {
+	return fmt.Sprintf("in_array('%s', explode(',', $_SERVER['%s'] ?? ''))", collector, scriptSkipVar)
+}
+
+// collectedPayload returns the payload of a scrape, with its scripts streamed
+// into the aggregates, skipping the disabled collectors, and the collectors
+// which ran less than their interval ago, serving their last values instead.
+func (e *Exporter) collectedPayload(ctx context.Context, aggregates *scriptAggregates) (*Payload, error) {
+	now := time.Now()
+
+	var skip []string
+	if !e.collectors[scriptsCollector] {
+		skip = append(skip, scriptsCollector)
+	}
+	for _, collector := range []string{configurationCollector, fileCacheCollector, realpathCacheCollector} {
+		if !e.collectors[collector] {
+			skip = append(skip, collector)
+		}
+	}
+	for collector, interval := range e.collectorIntervals {
+		if now.Sub(e.lastCollected[collector]) < interval {
+			skip = append(skip, collector)
+		}
+	}
+
+	var headers map[string]string
+	if len(skip) > 0 {
+		sort.Strings(skip)
+		headers = map[string]string{scriptSkipHeader: strings.Join(skip, ",")}
+	}
+
+	start := time.Now()
+	output, served, err := e.openServed(ctx, headers)
+	e.served = served
+	if err != nil {
+		return nil, err
+	}
+	defer output.Close()
+	payload, err := decodeStreamed(output, aggregates, e.mapsDocument())
+	if err != nil {
+		return nil, e.diagnosed(err)
+	}
+	aggregates.files = payload.ScriptFiles
+	payload.aggregates = aggregates
+	payload.fetchDuration = time.Since(start)
+
+	// Scripts not generated by the exporter may return skipped collectors
+	// anyway, which are then fresh.
+	if _, ok := e.collectorIntervals[scriptsCollector]; ok && e.collectors[scriptsCollector] {
+		if !aggregates.seen {
+			if e.cachedAggregates != nil {
+				payload.aggregates = e.cachedAggregates
+			}
+		} else {
+			e.cachedAggregates = aggregates
+			e.lastCollected[scriptsCollector] = now
+		}
+	}
+	if _, ok := e.collectorIntervals[customCollector]; ok {
+		if payload.Custom == nil {
+			payload.Custom = e.cachedCustom
+		} else {
+			e.cachedCustom = payload.Custom
+			e.lastCollected[customCollector] = now
+		}
+	}
+
+	return payload, nil
+}
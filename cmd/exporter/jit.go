@@ -0,0 +1,33 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// collectJIT collects the state and buffer usage of the JIT compiler, which
+// is only reported by PHP 8 and later.
+func (e *Exporter) collectJIT(ch chan<- prometheus.Metric, jit *JITStatus) {
+	ch <- prometheus.MustNewConstMetric(e.jitEnabledDesc, prometheus.GaugeValue, boolMetric(jit.Enabled))
+	ch <- prometheus.MustNewConstMetric(e.jitOnDesc, prometheus.GaugeValue, boolMetric(jit.On))
+	ch <- prometheus.MustNewConstMetric(e.jitKindDesc, prometheus.GaugeValue, intMetric(jit.Kind))
+	ch <- prometheus.MustNewConstMetric(e.jitOptLevelDesc, prometheus.GaugeValue, intMetric(jit.OptLevel))
+	ch <- prometheus.MustNewConstMetric(e.jitBufferSizeDesc, prometheus.GaugeValue, intMetric(jit.BufferSize))
+	ch <- prometheus.MustNewConstMetric(e.jitBufferFreeDesc, prometheus.GaugeValue, intMetric(jit.BufferFree))
+	ch <- prometheus.MustNewConstMetric(e.jitBufferUsageRatioDesc, prometheus.GaugeValue, ratioMetric(jit.BufferSize-jit.BufferFree, jit.BufferSize))
+}
+
+func init() {
+	// The JIT status is part of the status, which is always requested, so
+	// disabling the collector only drops its series.
+	registerCollector(collector{
+		name:        jitCollector,
+		fromPayload: true,
+		enabled:     func(e *Exporter) bool { return e.collectors[jitCollector] },
+		update: func(e *Exporter, ch chan<- prometheus.Metric, payload *Payload) error {
+			if jit := payload.Status.JIT; jit != nil {
+				e.collectJIT(ch, jit)
+			}
+			return nil
+		},
+	})
+}
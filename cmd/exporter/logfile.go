@@ -0,0 +1,81 @@
+package main
+
+import (
+	"io"
+	"os"
+	"os/signal"
+	"sync"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/common/promlog"
+)
+
+// logFile is a log file reopened on demand, so that tools such as logrotate
+// can rotate it.
+type logFile struct {
+	path string
+
+	mutex sync.Mutex
+	file  *os.File
+}
+
+func openLogFile(path string) (*logFile, error) {
+	f := &logFile{path: path}
+	if err := f.reopen(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Write implements io.Writer.
+func (f *logFile) Write(p []byte) (int, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.file.Write(p)
+}
+
+// reopen closes the file and opens it again, creating it if it was moved
+// away.
+func (f *logFile) reopen() error {
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.file != nil {
+		f.file.Close()
+	}
+	f.file = file
+	return nil
+}
+
+// reopenOnSignal reopens the file whenever the exporter receives one of the
+// reopenSignals. It never returns.
+func (f *logFile) reopenOnSignal(logger log.Logger) {
+	if len(reopenSignals) == 0 {
+		return
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, reopenSignals...)
+	for sig := range signals {
+		if err := f.reopen(); err != nil {
+			level.Error(logger).Log("msg", "Error reopening log file", "path", f.path, "err", err)
+			continue
+		}
+		level.Info(logger).Log("msg", "Log file reopened", "path", f.path, "signal", sig)
+	}
+}
+
+// newLogger returns a logger writing to w, with the format and level of the
+// configuration.
+func newLogger(config *promlog.Config, w io.Writer) log.Logger {
+	w = log.NewSyncWriter(w)
+	if config.Format != nil && config.Format.String() == "json" {
+		return promlog.NewWithLogger(log.NewJSONLogger(w), config)
+	}
+	return promlog.NewWithLogger(log.NewLogfmtLogger(w), config)
+}
@@ -0,0 +1,11 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// reopenSignals make the exporter reopen its log file.
+var reopenSignals = []os.Signal{syscall.SIGHUP, syscall.SIGUSR2}
@@ -0,0 +1,7 @@
+package main
+
+import "os"
+
+// reopenSignals make the exporter reopen its log file. Windows has no
+// rotation signal.
+var reopenSignals = []os.Signal{}
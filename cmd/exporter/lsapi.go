@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// LiteSpeed SAPI protocol, as defined in lsapidef.h.
+const (
+	lsapiBeginRequest = 1
+	lsapiRespHeader   = 3
+	lsapiRespStream   = 4
+	lsapiRespEnd      = 5
+	lsapiStderrStream = 6
+	lsapiReqReceived  = 7
+	lsapiConnClose    = 8
+	lsapiInternalErr  = 9
+
+	lsapiEndianLittle = 0
+	lsapiEndianBit    = 1
+
+	lsapiPacketHeaderLen = 8
+	// lsapi_req_header: packet header followed by nine int32.
+	lsapiReqHeaderLen = lsapiPacketHeaderLen + 9*4
+	// lsapi_http_header_index: 25 uint16 lengths, padding, 25 int32 offsets.
+	lsapiHeaderIndexLen = 25*2 + 2 + 25*4
+	lsapiMaxHeaderLen   = 65535
+
+	lsapiTimeout = 10 * time.Second
+)
+
+// fetchLSAPI runs the script on a LiteSpeed SAPI server, with the extra
+// parameters in its environment, and returns its output.
+func fetchLSAPI(ctx context.Context, network, address, scriptPath string, params map[string]string) ([]byte, error) {
+	request, err := lsapiRequest(appendParams([][2]string{
+		{"SCRIPT_FILENAME", scriptPath},
+		{"SCRIPT_NAME", scriptPath},
+		{"QUERY_STRING", ""},
+		{"REQUEST_METHOD", "GET"},
+	}, params))
+	if err != nil {
+		return nil, err
+	}
+
+	deadline := connDeadline(ctx, lsapiTimeout)
+	dialer := net.Dialer{Deadline: deadline}
+	conn, err := dialer.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(deadline)
+
+	if _, err := conn.Write(request); err != nil {
+		return nil, err
+	}
+
+	return lsapiReadResponse(bufio.NewReader(conn))
+}
+
+// lsapiRequest builds a begin request packet carrying the given environment.
+// SCRIPT_FILENAME, SCRIPT_NAME, QUERY_STRING and REQUEST_METHOD must be part
+// of it, since the header references their values.
+func lsapiRequest(env [][2]string) ([]byte, error) {
+	buf := make([]byte, lsapiReqHeaderLen)
+	offsets := map[string]int{}
+
+	// Special environment list, empty.
+	buf = append(buf, 0, 0, 0, 0)
+
+	for _, kv := range env {
+		key, value := kv[0]+"\x00", kv[1]+"\x00"
+		buf = binary.BigEndian.AppendUint16(buf, uint16(len(key)))
+		buf = binary.BigEndian.AppendUint16(buf, uint16(len(value)))
+		buf = append(buf, key...)
+		offsets[kv[0]] = len(buf)
+		buf = append(buf, value...)
+	}
+	buf = append(buf, 0, 0, 0, 0)
+
+	// The HTTP header index is 8-byte aligned, and there is no HTTP header.
+	for len(buf)%8 != 0 {
+		buf = append(buf, 0)
+	}
+	buf = append(buf, make([]byte, lsapiHeaderIndexLen)...)
+
+	if len(buf) > lsapiMaxHeaderLen {
+		return nil, errors.New("lsapi: request too large")
+	}
+
+	header := []int32{
+		0, // HTTP header length
+		0, // request body length
+		int32(offsets["SCRIPT_FILENAME"]),
+		int32(offsets["SCRIPT_NAME"]),
+		int32(offsets["QUERY_STRING"]),
+		int32(offsets["REQUEST_METHOD"]),
+		0, // unknown headers count
+		int32(len(env)),
+		0, // special environment count
+	}
+
+	lsapiPacketHeader(buf, lsapiBeginRequest, len(buf))
+	for i, value := range header {
+		binary.LittleEndian.PutUint32(buf[lsapiPacketHeaderLen+4*i:], uint32(value))
+	}
+
+	return buf, nil
+}
+
+func lsapiPacketHeader(buf []byte, packetType byte, length int) {
+	buf[0] = 'L'
+	buf[1] = 'S'
+	buf[2] = packetType
+	buf[3] = lsapiEndianLittle
+	binary.LittleEndian.PutUint32(buf[4:], uint32(length))
+}
+
+// lsapiReadResponse reads response packets until the end of the response,
+// and returns the response body.
+func lsapiReadResponse(r io.Reader) ([]byte, error) {
+	var body, stderr bytes.Buffer
+	header := make([]byte, lsapiPacketHeaderLen)
+
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			return nil, err
+		}
+		if header[0] != 'L' || header[1] != 'S' {
+			return nil, errors.New("lsapi: invalid packet header")
+		}
+
+		var order binary.ByteOrder = binary.LittleEndian
+		if header[3]&lsapiEndianBit != lsapiEndianLittle {
+			order = binary.BigEndian
+		}
+
+		length := int(int32(order.Uint32(header[4:])))
+		if length < lsapiPacketHeaderLen {
+			return nil, fmt.Errorf("lsapi: invalid packet length %d", length)
+		}
+
+		payload := make([]byte, length-lsapiPacketHeaderLen)
+		if _, err := io.ReadFull(r, payload); err != nil {
+			return nil, err
+		}
+
+		switch header[2] {
+		case lsapiRespStream:
+			body.Write(payload)
+		case lsapiStderrStream:
+			stderr.Write(payload)
+		case lsapiRespEnd:
+			if body.Len() == 0 && stderr.Len() > 0 {
+				return nil, errors.New(stderr.String())
+			}
+			return body.Bytes(), nil
+		case lsapiConnClose, lsapiInternalErr:
+			return nil, fmt.Errorf("lsapi: connection closed by server: %s", stderr.String())
+		case lsapiRespHeader, lsapiReqReceived:
+			// Response headers are not needed to decode the status.
+		}
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"strings"
+	"testing"
+)
+
+// lsapiPacket encodes a response packet, in little or big endian.
+func lsapiPacket(packetType byte, payload string, bigEndian bool) []byte {
+	buf := make([]byte, lsapiPacketHeaderLen, lsapiPacketHeaderLen+len(payload))
+	lsapiPacketHeader(buf, packetType, lsapiPacketHeaderLen+len(payload))
+	if bigEndian {
+		buf[3] = lsapiEndianBit
+		binary.BigEndian.PutUint32(buf[4:], uint32(lsapiPacketHeaderLen+len(payload)))
+	}
+	return append(buf, payload...)
+}
+
+// TestLSAPIRequest checks that the environment of the begin request packet
+// is encoded in its list, and referenced by its header.
+func TestLSAPIRequest(t *testing.T) {
+	env := [][2]string{
+		{"SCRIPT_FILENAME", "/app/status.php"},
+		{"SCRIPT_NAME", "/app/status.php"},
+		{"QUERY_STRING", ""},
+		{"REQUEST_METHOD", "GET"},
+		{"OPCACHE_EXPORTER_TOKEN", strings.Repeat("t", 300)},
+	}
+	buf, err := lsapiRequest(env)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if buf[0] != 'L' || buf[1] != 'S' || buf[2] != lsapiBeginRequest || buf[3] != lsapiEndianLittle {
+		t.Errorf("got packet header %v", buf[:4])
+	}
+	if length := binary.LittleEndian.Uint32(buf[4:]); int(length) != len(buf) {
+		t.Errorf("got packet length %d, want %d", length, len(buf))
+	}
+
+	header := make([]int32, 9)
+	for i := range header {
+		header[i] = int32(binary.LittleEndian.Uint32(buf[lsapiPacketHeaderLen+4*i:]))
+	}
+	value := func(offset int32) string {
+		end := bytes.IndexByte(buf[offset:], 0)
+		if end < 0 {
+			return "unterminated"
+		}
+		return string(buf[offset : int(offset)+end])
+	}
+	for i, name := range []string{"SCRIPT_FILENAME", "SCRIPT_NAME", "QUERY_STRING", "REQUEST_METHOD"} {
+		if got, want := value(header[2+i]), env[i][1]; got != want {
+			t.Errorf("%s referenced by the header: got %q, want %q", name, got, want)
+		}
+	}
+	if header[7] != int32(len(env)) {
+		t.Errorf("got %d variables in the header, want %d", header[7], len(env))
+	}
+
+	// The environment list follows the empty special environment list.
+	list := buf[lsapiReqHeaderLen+4:]
+	for _, kv := range env {
+		keyLen, valueLen := int(binary.BigEndian.Uint16(list)), int(binary.BigEndian.Uint16(list[2:]))
+		list = list[4:]
+		if key := string(list[:keyLen]); key != kv[0]+"\x00" {
+			t.Fatalf("got variable %q, want %q", key, kv[0])
+		}
+		if value := string(list[keyLen : keyLen+valueLen]); value != kv[1]+"\x00" {
+			t.Errorf("%s: got %q, want %q", kv[0], value, kv[1])
+		}
+		list = list[keyLen+valueLen:]
+	}
+	if !bytes.Equal(list[:4], []byte{0, 0, 0, 0}) {
+		t.Errorf("environment list not terminated: %v", list[:4])
+	}
+	if len(list) < 4+lsapiHeaderIndexLen || (len(buf)-lsapiHeaderIndexLen)%8 != 0 {
+		t.Errorf("HTTP header index not aligned at the end of the packet")
+	}
+
+	if _, err := lsapiRequest(append(env, [2]string{"LARGE", strings.Repeat("x", lsapiMaxHeaderLen)})); err == nil {
+		t.Error("no error for a request too large")
+	}
+}
+
+// TestLSAPIReadResponse checks that the body of responses is read from their
+// stream packets, and that failures are reported with their error output.
+func TestLSAPIReadResponse(t *testing.T) {
+	tests := []struct {
+		name    string
+		packets [][]byte
+		body    string
+		err     string
+	}{
+		{
+			name: "stream packets",
+			packets: [][]byte{
+				lsapiPacket(lsapiReqReceived, "", false),
+				lsapiPacket(lsapiRespHeader, "\x00\x00\x00\x00", false),
+				lsapiPacket(lsapiRespStream, `{"status":`, false),
+				lsapiPacket(lsapiStderrStream, "PHP Deprecated", false),
+				lsapiPacket(lsapiRespStream, `{}}`, false),
+				lsapiPacket(lsapiRespEnd, "", false),
+			},
+			body: `{"status":{}}`,
+		},
+		{
+			name: "big endian",
+			packets: [][]byte{
+				lsapiPacket(lsapiRespStream, `{}`, true),
+				lsapiPacket(lsapiRespEnd, "", true),
+			},
+			body: `{}`,
+		},
+		{
+			name: "stderr only",
+			packets: [][]byte{
+				lsapiPacket(lsapiStderrStream, "Primary script unknown", false),
+				lsapiPacket(lsapiRespEnd, "", false),
+			},
+			err: "Primary script unknown",
+		},
+		{
+			name: "connection closed",
+			packets: [][]byte{
+				lsapiPacket(lsapiStderrStream, "out of workers", false),
+				lsapiPacket(lsapiConnClose, "", false),
+			},
+			err: "lsapi: connection closed by server: out of workers",
+		},
+		{
+			name: "internal error",
+			packets: [][]byte{
+				lsapiPacket(lsapiInternalErr, "", false),
+			},
+			err: "lsapi: connection closed by server: ",
+		},
+		{
+			name:    "invalid header",
+			packets: [][]byte{[]byte("HTTP/1.1 400 Bad Request\r\n")},
+			err:     "lsapi: invalid packet header",
+		},
+		{
+			name:    "invalid length",
+			packets: [][]byte{{'L', 'S', lsapiRespStream, lsapiEndianLittle, 4, 0, 0, 0}},
+			err:     "lsapi: invalid packet length 4",
+		},
+		{
+			name:    "truncated packet",
+			packets: [][]byte{lsapiPacket(lsapiRespStream, `{"status":{}}`, false)[:12]},
+			err:     io.ErrUnexpectedEOF.Error(),
+		},
+		{
+			name:    "missing end",
+			packets: [][]byte{lsapiPacket(lsapiRespStream, `{}`, false)},
+			err:     io.EOF.Error(),
+		},
+	}
+	for _, test := range tests {
+		body, err := lsapiReadResponse(bytes.NewReader(bytes.Join(test.packets, nil)))
+		if len(test.err) > 0 {
+			if err == nil || err.Error() != test.err {
+				t.Errorf("%s: got error %v, want %s", test.name, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if string(body) != test.body {
+			t.Errorf("%s: got body %q, want %q", test.name, body, test.body)
+		}
+	}
+}
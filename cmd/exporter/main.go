@@ -1,71 +1,603 @@
 package main
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"regexp"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/alecthomas/kingpin/v2"
 	"github.com/go-kit/log/level"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
 	"github.com/prometheus/client_golang/prometheus/collectors/version"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/prometheus/common/promlog"
 	"github.com/prometheus/common/promlog/flag"
+	"google.golang.org/grpc"
+
+	"opcache_exporter/internal/statuspb"
 )
 
 func main() {
+	var fcgiURIGiven bool
 	var (
+		configFile    = kingpin.Flag("config.file", "Path to configuration file").Default("").String()
+		configDir     = kingpin.Flag("config.dir", "Path to directory of YAML fragments defining additional targets, along with labels added to their metrics").Default("").String()
+		configWatch   = kingpin.Flag("config.watch", "Reload the configuration file automatically when it changes").Default("false").Bool()
+		shardIndex    = kingpin.Flag("cluster.shard-index", "Index of the shard of targets scraped by this instance").Default("0").Int()
+		shardCount    = kingpin.Flag("cluster.shard-count", "Number of exporter instances sharing the targets").Default("1").Int()
 		listenAddress = kingpin.Flag("web.listen-address", "Address to listen on for web interface and telemetry.").Default(":9101").String()
+		fcgiAddress   = kingpin.Flag("web.fcgi-listen-address", "Address to listen on as a FastCGI responder serving the web interface and telemetry, such as unix:///run/opcache-exporter.sock, for front ends such as nginx, disabled if empty").Default("").String()
 		metricsPath   = kingpin.Flag("web.telemetry-path", "Path under which to expose metrics.").Default("/metrics").String()
-		fcgiURI       = kingpin.Flag("opcache.fcgi-uri", "Connection string to FastCGI server(s). Several URI can be provided, separated by semicolon.").Default("tcp://127.0.0.1:9000").String()
+		metricsShards = kingpin.Flag("web.metrics-shards", "Number of shards over which targets are spread, each one served at <telemetry-path>/shards/<index> and collected only when requested, 0 to serve all the targets at the telemetry path").Default("0").Int()
+		shardWorkers  = kingpin.Flag("web.shard-concurrency", "Maximum number of targets of a shard collected in parallel, and of targets requested in parallel by /api/v1/search and deep health checks").Default("16").Int()
+		budgetOn      = kingpin.Flag("web.scrape-budget", "Bound the collection of the targets by the scrape timeout given by Prometheus in the X-Prometheus-Scrape-Timeout-Seconds header").Default("true").Bool()
+		budgetOffset  = kingpin.Flag("web.scrape-timeout-offset", "Duration kept from the scrape timeout given by Prometheus to write the response in time").Default("500ms").Duration()
+		maxSeries     = kingpin.Flag("web.max-series", "Maximum number of series served by a scrape, dropping the series of the largest metric families first, 0 to disable").Default("0").Int()
+		maxRequests   = kingpin.Flag("web.max-requests", "Maximum number of parallel scrape requests, 0 to disable").Default("40").Int()
+		scrapeTimeout = kingpin.Flag("web.metrics-timeout", "Maximum duration of scrape requests, after which they fail with 503 Service Unavailable, 0 to disable").Default("0s").Duration()
+		healthTimeout = kingpin.Flag("web.health-timeout", "Maximum duration of the status requests of deep health checks, served at /-/healthy?deep=true").Default("3s").Duration()
+		apiTimeout    = kingpin.Flag("web.api-timeout", "Maximum duration of the status requests of the API, served under /api/v1/").Default("10s").Duration()
+		readTimeout   = kingpin.Flag("web.read-timeout", "Maximum duration for reading an entire request, 0 for no timeout").Default("30s").Duration()
+		headerTimeout = kingpin.Flag("web.read-header-timeout", "Maximum duration for reading the headers of a request, 0 for --web.read-timeout").Default("10s").Duration()
+		writeTimeout  = kingpin.Flag("web.write-timeout", "Maximum duration for writing a response, which includes scraping the targets, 0 for no timeout").Default("2m").Duration()
+		idleTimeout   = kingpin.Flag("web.idle-timeout", "Maximum duration to wait for the next request on keep-alive connections, 0 for --web.read-timeout").Default("2m").Duration()
+		maxHeader     = kingpin.Flag("web.max-header-bytes", "Maximum size of the headers of a request").Default("1048576").Int()
+		tlsCert       = kingpin.Flag("web.tls-cert-file", "Path to TLS certificate file, enabling HTTPS").Default("").String()
+		tlsKey        = kingpin.Flag("web.tls-key-file", "Path to TLS private key file").Default("").String()
+		adminCA       = kingpin.Flag("web.admin-client-ca-file", "Path to CA certificates file verifying the client certificates required by admin endpoints").Default("").String()
+		quitToken     = kingpin.Flag("web.lifecycle-token", "Bearer token enabling the /-/quit endpoint, which shuts the exporter down gracefully").Default("").String()
+		quitTokenFile = kingpin.Flag("web.lifecycle-token-file", "Path to file containing the bearer token of the /-/quit endpoint, read on every request").Default("").String()
+		agentAddress  = kingpin.Flag("haproxy.agent-address", "Address to listen on for HAProxy agent-check connections, which are answered with the state of the target given by agent-send, disabled if empty").Default("").String()
+		grpcAddress   = kingpin.Flag("grpc.listen-address", "Address to listen on for the gRPC status API, disabled if empty.").Default("").String()
+		fcgiURI       = kingpin.Flag("opcache.fcgi-uri", "Connection string to FastCGI server(s). Several URI can be provided, separated by semicolon or newline, or read from stdin, one per line, with -.").IsSetByUser(&fcgiURIGiven).Default("tcp://127.0.0.1:9000").Envar("OPCACHE_FCGI_URI").String()
 		scriptPath    = kingpin.Flag("opcache.script-path", "Path to PHP script which echoes json-encoded OPcache status").Default("").String()
+		fcgiParams    = kingpin.Flag("opcache.fcgi-param", "Extra KEY=VALUE parameter passed to the targets with all requests, can be repeated").PlaceHolder("KEY=VALUE").StringMap()
+		requestBody   = kingpin.Flag("opcache.request-body", "Body posted to the status script of FastCGI and HTTP targets, which are requested with GET if empty").Default("").String()
+		requestType   = kingpin.Flag("opcache.request-content-type", "Content type of the body posted to the status script").Default("application/json").String()
 		scriptDir     = kingpin.Flag("opcache.script-dir", "Path to directory where temporary PHP file will be created").Default("").String()
+		scriptTmpl    = kingpin.Flag("opcache.script-template", "Path to Go template of the temporary PHP file, replacing the default one").Default("").String()
+		scriptExt     = kingpin.Flag("opcache.script-extension", "Extension of the temporary PHP file, which must be allowed by security.limit_extensions of PHP-FPM pools").Default(".php").String()
+		canaryScript  = kingpin.Flag("opcache.canary-script", "Path on the targets of a script periodically compiled into OPcache, to check that it accepts new entries, disabled if empty").Default("").String()
+		canaryEvery   = kingpin.Flag("opcache.canary-interval", "Interval between compilations of the canary script").Default("1m").Duration()
+		fpmConfig     = kingpin.Flag("opcache.fpm-config", "Glob pattern of PHP-FPM pool configuration files, used to create the temporary PHP file in a directory allowed by the pool of each target").Default("").String()
+		hostnameLabel = kingpin.Flag("metrics.add-hostname-label", "Add an exporter_hostname label with the name of the exporter host to all metrics").Default("false").Bool()
+		counters      = kingpin.Flag("metrics.statistics-counters", "Export the statistics of OPcache which only grow until it restarts, such as hits, misses and restarts, as counters with a _total suffix instead of gauges").Default("false").Bool()
+		resolveNames  = kingpin.Flag("opcache.resolve-hostnames", "Add a target_hostname label resolved from the IP address of TCP targets").Default("false").Bool()
+		poolRegex     = kingpin.Flag("opcache.pool-regex", "Regular expression extracting, with its first group, a pool label from the file name of unix socket targets").Default(`^php[0-9.]*-fpm-(.+)\.sock$`).String()
+		statusOn      = kingpin.Flag("collector.status", "Enable the status collector, exporting the memory usage and statistics of OPcache").Default("true").Bool()
+		jitOn         = kingpin.Flag("collector.jit", "Enable the JIT collector, exporting the state and buffer usage of the JIT compiler of OPcache, on PHP 8 and later").Default("true").Bool()
+		scriptsOn     = kingpin.Flag("collector.scripts", "Enable the scripts collector, exporting metrics aggregated from the cached scripts").Default("true").Bool()
+		configOn      = kingpin.Flag("collector.configuration", "Enable the configuration collector, exporting the directives of OPcache giving its limits, such as its memory consumption and maximum number of cached scripts").Default("true").Bool()
+		fileCacheOn   = kingpin.Flag("collector.file-cache", "Enable the file cache collector, exporting the size, number of entries and age of the oldest entry of the second-level cache directory of opcache.file_cache, when it is set").Default("true").Bool()
+		realpathOn    = kingpin.Flag("collector.realpath-cache", "Enable the realpath cache collector, exporting the memory used and the number of entries of the realpath cache of PHP").Default("true").Bool()
+		executionOn   = kingpin.Flag("collector.execution", "Enable the execution collector, exporting the time taken by PHP to run the status script apart from the rest of the request, such as the network and the wait for a free worker").Default("false").Bool()
+		histograms    = kingpin.Flag("collector.scripts.histograms", "Export histograms of the memory consumption and hits of cached scripts").Default("false").Bool()
+		nativeHistos  = kingpin.Flag("collector.scripts.native-histograms", "Export script histograms as native histograms instead of classic ones").Default("false").Bool()
+		hitsBuckets   = kingpin.Flag("collector.scripts.hits-buckets", "Upper bound of a bucket of the histogram of the hits of cached scripts, can be repeated, from 1 to 1M hits by powers of 10 if omitted").Float64List()
+		unusedAfter   = kingpin.Flag("collector.scripts.unused-threshold", "Duration since their last use from which cached scripts are counted as unused, labeled by threshold in seconds, can be repeated").Default("1h").DurationList()
+		perScript     = kingpin.Flag("collector.scripts.per-script", "Number of the cached scripts consuming the most memory exported with per-script metrics labeled by script, such as their hits, memory consumption and last use, 0 to disable").Default("0").Int()
+		scriptsEvery  = kingpin.Flag("collector.scripts.interval", "Minimum duration between two collections of the cached scripts, whose last values are served in between, 0 to collect them on every scrape").Default("0s").Duration()
+		customEvery   = kingpin.Flag("collector.custom.interval", "Minimum duration between two runs of the custom collectors, whose last values are served in between, 0 to run them on every scrape").Default("0s").Duration()
+		exemplars     = kingpin.Flag("tracing.exemplars", "Attach the trace ID propagated by traced scrapes as exemplars of latency histograms").Default("false").Bool()
+		docroot       = kingpin.Flag("opcache.docroot", "Path to web server document root where a token-protected temporary PHP file is created, to scrape http(s):// targets").Default("").String()
+		webhookURL    = kingpin.Flag("notify.webhook-url", "URL to which detected OPcache events are posted as JSON").Default("").String()
+		webhookFile   = kingpin.Flag("notify.webhook-url-file", "Path to file containing the webhook URL, read on every notification").Default("").String()
+		grafanaURL    = kingpin.Flag("notify.grafana-url", "URL of Grafana instance where detected OPcache events are annotated").Default("").String()
+		grafanaToken  = kingpin.Flag("notify.grafana-token", "Grafana API token used to create annotations").Default("").String()
+		grafanaTkFile = kingpin.Flag("notify.grafana-token-file", "Path to file containing the Grafana API token, read on every annotation").Default("").String()
+		grafanaTags   = kingpin.Flag("notify.grafana-tag", "Tag added to Grafana annotations, can be repeated").Default("opcache").Strings()
+		grafanaEvents = kingpin.Flag("notify.grafana-event", "Event type annotated in Grafana, can be repeated").Default("restart", "reset").Strings()
+		slackURL      = kingpin.Flag("notify.slack-url", "Slack incoming webhook URL to which critical events are posted").Default("").String()
+		slackURLFile  = kingpin.Flag("notify.slack-url-file", "Path to file containing the Slack incoming webhook URL, read on every message").Default("").String()
+		teamsURL      = kingpin.Flag("notify.teams-url", "Microsoft Teams incoming webhook URL to which critical events are posted").Default("").String()
+		teamsURLFile  = kingpin.Flag("notify.teams-url-file", "Path to file containing the Microsoft Teams incoming webhook URL, read on every message").Default("").String()
+		downAfter     = kingpin.Flag("notify.down-after", "Duration after which a down target is reported to Slack/Teams").Default("5m").Duration()
+		oomRestarts   = kingpin.Flag("notify.oom-restarts", "Number of OOM restarts within --notify.oom-window reported to Slack/Teams").Default("3").Int()
+		oomWindow     = kingpin.Flag("notify.oom-window", "Time window in which OOM restarts are counted").Default("1h").Duration()
+		phpCGIBinary  = kingpin.Flag("php-cgi.binary", "Path to php-cgi binary spawned and supervised by the exporter, which scrapes it as a target, for hosts running PHP without FastCGI server").Default("").String()
+		phpCGIAddress = kingpin.Flag("php-cgi.listen-address", "Address on which the spawned php-cgi listens").Default("127.0.0.1:9099").String()
+		phpCGIIni     = kingpin.Flag("php-cgi.ini", "INI setting NAME=VALUE overridden for the spawned php-cgi, can be repeated").PlaceHolder("NAME=VALUE").StringMap()
+		pushURL       = kingpin.Flag("push.url", "WebSocket URL of a central collector, such as wss://collector.example.com/ingest, to which the exporter dials out and pushes snapshots of its metrics, for web servers which cannot be scraped, disabled if empty").Default("").String()
+		pushInterval  = kingpin.Flag("push.interval", "Interval between two snapshots of the metrics pushed to the collector").Default("30s").Duration()
+		pushID        = kingpin.Flag("push.agent-id", "Identifier of the exporter sent to the collector, the host name if empty").Default("").String()
+		pushTokenFile = kingpin.Flag("push.token-file", "Path to file containing the bearer token sent to the collector, read on every connection").Default("").String()
+		pushCAFile    = kingpin.Flag("push.ca-file", "Path to CA certificates file verifying the certificate of the collector, instead of the system ones").Default("").String()
+		eventsSize    = kingpin.Flag("events.size", "Number of events kept in the event log").Default("100").Int()
+		eventsFile    = kingpin.Flag("events.file", "Path to file where the event log is persisted").Default("").String()
+		stateFile     = kingpin.Flag("state.file", "Path to file where the state derived from scrapes, such as observed evictions and watermarks, is persisted across restarts").Default("").String()
+		stateEvery    = kingpin.Flag("state.interval", "Interval between two saves of the state to --state.file").Default("1m").Duration()
+		logPath       = kingpin.Flag("log.file", "Path to file where logs are written in addition to stderr, reopened on SIGHUP or SIGUSR2 for log rotation").Default("").String()
+		hitRateLimit  = kingpin.Flag("events.hit-rate-threshold", "Hit rate percentage under which an event is recorded, 0 to disable").Default("0").Float64()
 	)
 
+	kingpin.Command("serve", "Run the exporter").Default()
+	bundleCmd := kingpin.Command("support-bundle", "Download the support bundle of a running exporter, gathering its version, flags and configuration with secrets redacted, targets with their last raw payloads and recent errors, and events")
+	bundleURL := bundleCmd.Flag("url", "URL of the running exporter").Default("http://localhost:9101").String()
+	bundleToken := bundleCmd.Flag("token-file", "Path to file containing an admin token of the running exporter").Default("").String()
+	bundleOutput := bundleCmd.Flag("output", "Path to the downloaded archive").Default("opcache-exporter-support.tar.gz").String()
+
 	promlogConfig := &promlog.Config{}
 	flag.AddFlags(kingpin.CommandLine, promlogConfig)
 	kingpin.HelpFlag.Short('h')
-	kingpin.Parse()
+	command := kingpin.Parse()
 
 	logger := promlog.New(promlogConfig)
+	if len(*logPath) > 0 {
+		file, err := openLogFile(*logPath)
+		if err != nil {
+			level.Error(logger).Log("msg", "Error opening log file", "err", err)
+			os.Exit(1)
+		}
+		logger = newLogger(promlogConfig, io.MultiWriter(os.Stderr, file))
+		go file.reopenOnSignal(logger)
+	}
+
+	if command == bundleCmd.FullCommand() {
+		if err := downloadSupportBundle(*bundleURL, *bundleToken, *bundleOutput); err != nil {
+			level.Error(logger).Log("msg", "Error downloading support bundle", "err", err)
+			os.Exit(1)
+		}
+		level.Info(logger).Log("msg", "Downloaded support bundle", "path", *bundleOutput)
+		return
+	}
+
+	config, err := LoadConfig(*configFile)
+	if err != nil {
+		level.Error(logger).Log("msg", "Error loading configuration", "err", err)
+		os.Exit(1)
+	}
+
+	var watcher *configWatcher
+	if *configWatch {
+		if watcher, err = newConfigWatcher(*configFile, config, logger); err != nil {
+			level.Error(logger).Log("msg", "Error watching configuration file", "err", err)
+			os.Exit(1)
+		}
+	}
+
+	shard, err := NewShard(*shardIndex, *shardCount, config)
+	if err != nil {
+		level.Error(logger).Log("msg", "Error configuring shard", "err", err)
+		os.Exit(1)
+	}
+
+	pools, err := LoadFPMPools(*fpmConfig)
+	if err != nil {
+		level.Error(logger).Log("msg", "Error loading PHP-FPM pool configuration", "err", err)
+		os.Exit(1)
+	}
+
+	events := NewEventLog(*eventsSize, *eventsFile, *hitRateLimit, logger)
+	if notifier := NewNotifier(newSecret(*webhookURL, *webhookFile), logger); notifier != nil {
+		events.AddSink(notifier)
+	}
+	if annotator := NewGrafanaAnnotator(*grafanaURL, newSecret(*grafanaToken, *grafanaTkFile), *grafanaTags, *grafanaEvents, logger); annotator != nil {
+		events.AddSink(annotator)
+	}
+	for _, chatURL := range []secret{newSecret(*slackURL, *slackURLFile), newSecret(*teamsURL, *teamsURLFile)} {
+		if chat := NewChatNotifier(chatURL, *downAfter, *oomRestarts, *oomWindow, logger); chat != nil {
+			events.AddSink(chat)
+		}
+	}
+
+	opts := ExporterOptions{
+		ScriptPath:         *scriptPath,
+		FCGIParams:         *fcgiParams,
+		RequestBody:        *requestBody,
+		RequestContentType: *requestType,
+		Config:             config,
+		Events:             events,
+		Logger:             logger,
+		ResolveHostnames:   *resolveNames,
+		ScriptHistograms:   *histograms,
+		NativeHistograms:   *nativeHistos,
+		HitsBuckets:        *hitsBuckets,
+		PerScriptLimit:     *perScript,
+		UnusedThresholds:   *unusedAfter,
+		StatisticsCounters: *counters,
+		CanaryScript:       *canaryScript,
+		CanaryInterval:     *canaryEvery,
+		Tracer:             NewScrapeTracer(*exemplars),
+		State:              NewStateStore(*stateFile, *stateEvery, logger),
+		Collectors: map[string]bool{
+			statusCollector:        *statusOn,
+			jitCollector:           *jitOn,
+			scriptsCollector:       *scriptsOn,
+			executionCollector:     *executionOn,
+			configurationCollector: *configOn,
+			fileCacheCollector:     *fileCacheOn,
+			realpathCacheCollector: *realpathOn,
+		},
+		CollectorIntervals: map[string]time.Duration{
+			scriptsCollector: *scriptsEvery,
+			customCollector:  *customEvery,
+		},
+	}
+
+	if err := checkBuckets(*hitsBuckets); err != nil {
+		level.Error(logger).Log("msg", "Invalid hits buckets", "err", err)
+		os.Exit(1)
+	}
+	if err := checkUnusedThresholds(*unusedAfter); err != nil {
+		level.Error(logger).Log("msg", "Invalid unused thresholds", "err", err)
+		os.Exit(1)
+	}
+
+	if len(*poolRegex) > 0 {
+		if opts.PoolRegexp, err = regexp.Compile(*poolRegex); err != nil {
+			level.Error(logger).Log("msg", "Error compiling pool regex", "err", err)
+			os.Exit(1)
+		}
+	}
+
+	scriptTemplate, err := LoadScriptTemplate(*scriptTmpl)
+	if err != nil {
+		level.Error(logger).Log("msg", "Error loading status script template", "err", err)
+		os.Exit(1)
+	}
 
-	if err := run(*listenAddress, *metricsPath, *fcgiURI, *scriptPath, *scriptDir); err != nil {
+	scriptOpts := scriptOptions{
+		Dir:       *scriptDir,
+		Extension: *scriptExt,
+		Docroot:   *docroot,
+		Pools:     pools,
+		Template:  scriptTemplate,
+	}
+
+	web := webOptions{
+		ListenAddress:  *listenAddress,
+		FCGIAddress:    *fcgiAddress,
+		MetricsPath:    *metricsPath,
+		GRPCAddress:    *grpcAddress,
+		AgentAddress:   *agentAddress,
+		LifecycleToken: newSecret(*quitToken, *quitTokenFile),
+
+		ReadTimeout:       *readTimeout,
+		ReadHeaderTimeout: *headerTimeout,
+		WriteTimeout:      *writeTimeout,
+		IdleTimeout:       *idleTimeout,
+		MaxHeaderBytes:    *maxHeader,
+
+		MaxRequests:    *maxRequests,
+		MetricsTimeout: *scrapeTimeout,
+		ScrapeBudget:   NewScrapeBudget(*budgetOn, *budgetOffset),
+		HealthTimeout:  *healthTimeout,
+		APITimeout:     *apiTimeout,
+
+		MetricsShards:    *metricsShards,
+		ShardConcurrency: *shardWorkers,
+		MaxSeries:        *maxSeries,
+
+		PushURL:       *pushURL,
+		PushInterval:  *pushInterval,
+		PushAgentID:   *pushID,
+		PushTokenFile: *pushTokenFile,
+		PushCAFile:    *pushCAFile,
+
+		TLSCert:           newSecret("", *tlsCert),
+		TLSKey:            newSecret("", *tlsKey),
+		AdminClientCAFile: *adminCA,
+
+		ReadTokens:  append(secretValues(config.Web.ReadTokens), secretFiles(config.Web.ReadTokenFiles)...),
+		AdminTokens: append(secretValues(config.Web.AdminTokens), secretFiles(config.Web.AdminTokenFiles)...),
+	}
+
+	if config.Vault != nil {
+		vault, err := newVaultClient(config.Vault, logger)
+		if err != nil {
+			level.Error(logger).Log("msg", "Error fetching secrets from Vault", "err", err)
+			os.Exit(1)
+		}
+		go vault.run()
+
+		for _, ref := range config.Vault.ReadTokens {
+			web.ReadTokens = append(web.ReadTokens, vault.secret(ref))
+		}
+		for _, ref := range config.Vault.AdminTokens {
+			web.AdminTokens = append(web.AdminTokens, vault.secret(ref))
+		}
+		if len(config.Vault.TLSCert) > 0 {
+			web.TLSCert = vault.secret(config.Vault.TLSCert)
+			web.TLSKey = vault.secret(config.Vault.TLSKey)
+		}
+	}
+
+	fragmentTargets, err := loadTargetFragments(*configDir)
+	if err != nil {
+		level.Error(logger).Log("msg", "Error loading target fragments", "err", err)
+		os.Exit(1)
+	}
+	if watcher != nil {
+		watcher.watchFragments(*configDir, fragmentTargets)
+	}
+
+	var phpCGI *phpCGI
+	if len(*phpCGIBinary) > 0 {
+		if phpCGI, err = startPHPCGI(*phpCGIBinary, *phpCGIAddress, *phpCGIIni, logger); err != nil {
+			level.Error(logger).Log("msg", "Error spawning php-cgi", "err", err)
+			os.Exit(1)
+		}
+		fragmentTargets = append(fragmentTargets, phpCGI.Target())
+	}
+
+	// The default FastCGI URI is not scraped when targets are only defined
+	// by fragments or the spawned php-cgi.
+	var targets []string
+	if fcgiURIGiven || len(os.Getenv("OPCACHE_FCGI_URI")) > 0 || len(fragmentTargets) == 0 {
+		if targets, err = parseTargets(*fcgiURI, os.Stdin); err != nil {
+			level.Error(logger).Log("msg", "Error reading targets", "err", err)
+			phpCGI.stop()
+			os.Exit(1)
+		}
+	}
+	targets = append(targets, fragmentTargets...)
+
+	err = run(targets, *hostnameLabel, web, opts, scriptOpts, shard, watcher)
+	phpCGI.stop()
+	if err != nil {
 		level.Error(logger).Log("msg", "Error starting HTTP server", "err", err)
 		os.Exit(1)
 	}
 }
 
-func run(listenAddress, metricsPath, fcgiURI, scriptPath, scriptDir string) error {
-	if len(scriptPath) == 0 {
-		file, err := os.CreateTemp(scriptDir, "opcache.*.php")
+func run(targetURIs []string, addHostnameLabel bool, web webOptions, opts ExporterOptions, scriptOpts scriptOptions, shard *Shard, watcher *configWatcher) error {
+	logger := opts.Logger
+
+	var scripts []string
+	defer func() {
+		for _, script := range scripts {
+			os.Remove(script)
+		}
+	}()
+
+	generated := len(opts.ScriptPath) == 0
+	scriptDir := scriptOpts.Dir
+	if len(scriptOpts.Docroot) > 0 {
+		scriptDir = scriptOpts.Docroot
+	}
+	if generated {
+		// The script runs admin actions, and may be reachable through a
+		// web server, such as scripts deployed in a document root, so it
+		// only answers requests bearing a random token.
+		token := make([]byte, 16)
+		if _, err := rand.Read(token); err != nil {
+			return err
+		}
+		opts.ScriptToken = hex.EncodeToString(token)
+	}
+
+	// The generated script reads the token and the admin actions from
+	// headers over HTTP, and from parameters over the other protocols, so
+	// each variant is written on first use, once per directory: targets with
+	// endpoints of both kinds get both variants.
+	type scriptVariant struct {
+		dir      string
+		overHTTP bool
+	}
+	contents := make(map[bool]string)
+	variants := make(map[scriptVariant]string)
+	generatedScript := func(localDir, dir string, overHTTP bool) (string, error) {
+		variant := scriptVariant{localDir, overHTTP}
+		if script, ok := variants[variant]; ok {
+			return script, nil
+		}
+
+		content, ok := contents[overHTTP]
+		if !ok {
+			var err error
+			if content, err = scriptOpts.Template.Render(opts.ScriptToken, overHTTP, opts.Config.Collectors); err != nil {
+				return "", err
+			}
+			contents[overHTTP] = content
+		}
+
+		script, err := writeScript(localDir, scriptOpts.Extension, content)
+		if err != nil {
+			return "", err
+		}
+		scripts = append(scripts, script)
+		variants[variant] = path.Join(dir, filepath.Base(script))
+		return variants[variant], nil
+	}
+
+	// Pools restricting the directories of their scripts get their own
+	// script, shared by the pools allowing the same directory. It also
+	// requires the token, which matters when the only directory allowed is
+	// the document root of the pool.
+	paramsScript := func(rawUri string) (string, error) {
+		if len(scriptOpts.Docroot) > 0 || len(scriptOpts.Pools) == 0 {
+			return generatedScript(scriptDir, scriptDir, false)
+		}
+
+		rawUri, _ = splitBackup(rawUri)
+		uri, err := url.Parse(normalizeURI(rawUri))
+		if err != nil {
+			return "", err
+		}
+		pool := scriptOpts.Pools.Lookup(uri)
+		if pool == nil {
+			return generatedScript(scriptDir, scriptDir, false)
+		}
+		localDir, dir := pool.ScriptDir()
+		if len(dir) == 0 {
+			level.Warn(logger).Log("msg", "No existing script directory found for pool", "pool", pool.Name)
+			return generatedScript(scriptDir, scriptDir, false)
+		}
+		return generatedScript(localDir, dir, false)
+	}
+
+	var registerer prometheus.Registerer = prometheus.DefaultRegisterer
+	var gatherer prometheus.Gatherer = prometheus.DefaultGatherer
+	var hostnameLabels prometheus.Labels
+	if addHostnameLabel {
+		hostname, err := os.Hostname()
 		if err != nil {
 			return err
 		}
 
-		file.Chmod(0777)
+		// The default registry already holds collectors without the label,
+		// so use a dedicated one.
+		registry := prometheus.NewRegistry()
+		hostnameLabels = prometheus.Labels{"exporter_hostname": hostname}
+		registerer = prometheus.WrapRegistererWith(hostnameLabels, registry)
+		gatherer = registry
+
+		registerer.MustRegister(collectors.NewGoCollector())
+		registerer.MustRegister(collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+	}
+
+	registerer.MustRegister(version.NewCollector("opcache_exporter"))
 
-		payload := "<?php\necho(json_encode(opcache_get_status()));\n"
-		_, err = file.WriteString(payload)
+	handlerOpts := promhttp.HandlerOpts{
+		// Exemplars are only exposed in the OpenMetrics format.
+		EnableOpenMetrics:   opts.Tracer != nil,
+		MaxRequestsInFlight: web.MaxRequests,
+		Timeout:             web.MetricsTimeout,
+	}
+	// Without shards, the targets are all collected in parallel by the
+	// scrapes of the telemetry path, within the budget of each scrape.
+	targets := &targetShard{}
+	gather := func(ctx context.Context) prometheus.Gatherer {
+		return prometheus.Gatherers{gatherer, targets.gatherer(ctx, hostnameLabels)}
+	}
+	var metricsHandler http.Handler = promhttp.InstrumentMetricHandler(registerer, scrapeHandler(func(ctx context.Context) prometheus.Gatherer {
+		return limitSeries(gather(ctx), web.MaxSeries, hostnameLabels)
+	}, web.ScrapeBudget, handlerOpts))
+	if opts.Tracer != nil {
+		registerer.MustRegister(opts.Tracer)
+		metricsHandler = opts.Tracer.Wrap(metricsHandler)
+	}
+
+	// With shards, the telemetry path only serves the metrics of the
+	// exporter itself.
+	shards := newTargetShards(web.MetricsShards, web.ShardConcurrency)
+
+	api := newAPI(web.ShardConcurrency, web.APITimeout)
+	scheduler := newResetScheduler(opts.Config.ResetSchedules, logger)
+	var exporters []*Exporter
+
+	for _, uri := range targetURIs {
+		targetOpts := opts
+		if generated {
+			var err error
+			overHTTP, overParams := scriptTransports(uri)
+			if overParams {
+				if targetOpts.ScriptPath, err = paramsScript(uri); err != nil {
+					return err
+				}
+			}
+			if overHTTP {
+				if targetOpts.HTTPScriptPath, err = generatedScript(scriptDir, scriptDir, true); err != nil {
+					return err
+				}
+			}
+		}
+
+		exporter, err := NewExporter(uri, targetOpts)
 		if err != nil {
 			return err
 		}
 
-		scriptPath = file.Name()
+		if !shard.Owns(exporter.Target()) {
+			continue
+		}
+
+		if shards != nil {
+			shards.add(exporter)
+		} else {
+			targets.targets = append(targets.targets, exporter)
+		}
+		api.addTarget(exporter)
+		scheduler.addTarget(exporter)
+		if len(opts.CanaryScript) > 0 {
+			go exporter.runCanary()
+		}
+		if exporter.entrypoints != nil {
+			go exporter.runEntrypointValidation()
+		}
+		exporters = append(exporters, exporter)
+	}
+
+	if len(opts.Config.ResetSchedules) > 0 || watcher != nil {
+		go scheduler.run()
+	}
+	if opts.State != nil {
+		go opts.State.run(exporters)
+	}
+
+	bundle := newSupportBundle(api, opts.Events, opts.Config)
 
-		defer file.Close()
-		defer os.Remove(file.Name())
+	if watcher != nil {
+		err := watcher.start(func(config *Config) {
+			for _, exporter := range exporters {
+				exporter.applyConfig(config)
+			}
+			bundle.setConfig(config)
+			scheduler.setSchedules(config.ResetSchedules)
+		})
+		if err != nil {
+			return err
+		}
+		registerer.MustRegister(watcher.Collector())
+	}
+
+	registerer.MustRegister(shard.Collector(len(exporters)))
+	if shards != nil {
+		registerer.MustRegister(shards.Collector())
 	}
 
-	prometheus.MustRegister(version.NewCollector("opcache_exporter"))
+	if len(web.PushURL) > 0 {
+		// Snapshots hold all the metrics, including those of the shards.
+		snapshot := func(ctx context.Context) prometheus.Gatherer {
+			gatherers := prometheus.Gatherers{gather(ctx)}
+			if shards != nil {
+				gatherers = append(gatherers, shards.gatherers(ctx, hostnameLabels)...)
+			}
+			return limitSeries(gatherers, web.MaxSeries, hostnameLabels)
+		}
+		agent, err := newPushAgent(web.PushURL, web.PushAgentID, web.PushTokenFile, web.PushCAFile, web.PushInterval, snapshot, web.ScrapeBudget, logger)
+		if err != nil {
+			return err
+		}
+		registerer.MustRegister(agent)
+		go agent.run()
+	}
 
-	for _, uri := range strings.Split(fcgiURI, ";") {
-		exporter, err := NewExporter(uri, scriptPath)
+	if len(web.GRPCAddress) > 0 {
+		listener, err := net.Listen("tcp", web.GRPCAddress)
 		if err != nil {
 			return err
 		}
 
-		prometheus.MustRegister(exporter)
+		server := grpc.NewServer()
+		statuspb.RegisterStatusServiceServer(server, &statusServer{api: api})
+		go func() {
+			if err := server.Serve(listener); err != nil {
+				level.Error(logger).Log("msg", "Error serving gRPC status API", "err", err)
+			}
+		}()
+	}
+
+	agent := newAgentCheck(api, opts.Config.AgentCheck, logger)
+	if len(web.AgentAddress) > 0 {
+		if err := agent.listenAndServe(web.AgentAddress); err != nil {
+			return err
+		}
 	}
 
 	html := strings.Join([]string{
@@ -76,16 +608,107 @@ func run(listenAddress, metricsPath, fcgiURI, scriptPath, scriptDir string) erro
 		`  <body>`,
 		`    <h1>OPcache Exporter</h1>`,
 		`    <p>`,
-		`      <a href="` + metricsPath + `">Metrics</a>`,
+		`      <a href="` + web.MetricsPath + `">Metrics</a>`,
 		`    </p>`,
 		`  </body>`,
 		`</html>`,
 	}, "\n")
 
-	http.Handle(metricsPath, promhttp.Handler())
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+	mux := http.NewServeMux()
+	handlerMetrics := newHandlerMetrics(registerer)
+	audit := newAuditLog(registerer, logger)
+	handle := func(pattern string, handler http.Handler) {
+		mux.Handle(pattern, handlerMetrics.instrument(pattern, handler))
+	}
+
+	handle(web.MetricsPath, web.read(metricsHandler))
+	if shards != nil {
+		var shardsHandler http.Handler = shards.handler(hostnameLabels, handlerOpts, web.MaxSeries, web.ScrapeBudget)
+		if opts.Tracer != nil {
+			shardsHandler = opts.Tracer.Wrap(shardsHandler)
+		}
+		handle(path.Join(web.MetricsPath, "shards")+"/", web.read(shardsHandler))
+	}
+	handle("/api/v1/scripts", web.read(http.HandlerFunc(api.scripts)))
+	handle("/api/v1/scripts/diff", web.read(http.HandlerFunc(api.scriptsDiff)))
+	handle("/api/v1/search", web.fanOut(http.HandlerFunc(api.search)))
+	handle("/events", web.read(opts.Events))
+	handle("/agent-check", web.read(agent))
+	handle("/-/healthy", newHealthHandler(api, web.HealthTimeout, web.fanOut))
+	handle("/api/v1/reset", audit.wrap("reset", web.admin(http.HandlerFunc(api.reset))))
+	handle("/api/v1/support-bundle", audit.wrap("support_bundle", web.admin(bundle)))
+	handle("/api/v1/invalidate", audit.wrap("invalidate", web.admin(http.HandlerFunc(api.invalidate))))
+	handle("/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte(html))
-	})
+	}))
 
-	return http.ListenAndServe(listenAddress, nil)
+	server, err := web.server(chain(mux, recoverPanics(logger), logRequests(logger)))
+	if err != nil {
+		return err
+	}
+	shutdown := make(chan struct{})
+	var quitting sync.Once
+	quit := func() {
+		quitting.Do(func() {
+			go func() {
+				server.Shutdown(context.Background())
+				close(shutdown)
+			}()
+		})
+	}
+
+	if web.LifecycleToken.IsSet() {
+		handle("/-/quit", audit.wrap("quit", web.admin(quitHandler(func() {
+			level.Info(logger).Log("msg", "Received termination request via web service, exiting gracefully...")
+			quit()
+		}), web.LifecycleToken)))
+	}
+
+	if opts.Config.Registration != nil {
+		registrar, err := newRegistrar(opts.Config.Registration, web, logger)
+		if err != nil {
+			return fmt.Errorf("registration: %w", err)
+		}
+
+		// Termination signals shut the exporter down gracefully, so that it
+		// is deregistered.
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		go func() {
+			sig := <-signals
+			level.Info(logger).Log("msg", "Received termination signal, exiting gracefully...", "signal", sig)
+			quit()
+		}()
+
+		deregister := make(chan struct{})
+		deregistered := make(chan struct{})
+		go func() {
+			registrar.run(deregister)
+			close(deregistered)
+		}()
+		defer func() {
+			close(deregister)
+			<-deregistered
+		}()
+	}
+
+	if len(web.FCGIAddress) > 0 {
+		listener, err := listenResponder(web.FCGIAddress)
+		if err != nil {
+			return err
+		}
+		defer listener.Close()
+		go serveResponder(listener, server.Handler, logger)
+	}
+
+	// Without HTTP listener, the exporter is only served as a FastCGI
+	// responder until it is shut down.
+	if len(web.ListenAddress) > 0 {
+		if err := web.listenAndServe(server); err != http.ErrServerClosed {
+			return err
+		}
+	}
+	<-shutdown
+	opts.State.save(exporters)
+	return nil
 }
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// manifest is a list of the files of the application expected to be cached,
+// such as one generated at build time, read again when it changes.
+type manifest struct {
+	path string
+	root string
+
+	mutex   sync.Mutex
+	modTime time.Time
+	size    int64
+	set     map[string]struct{}
+}
+
+var (
+	manifestsMutex sync.Mutex
+	// manifests are shared by the targets, and by the configurations
+	// reloaded with the same settings, indexed by path and root.
+	manifests = map[[2]string]*manifest{}
+)
+
+// sharedManifest returns the manifest of the configuration.
+func sharedManifest(config *ManifestConfig) *manifest {
+	key := [2]string{config.Path, config.Root}
+
+	manifestsMutex.Lock()
+	defer manifestsMutex.Unlock()
+	m, ok := manifests[key]
+	if !ok {
+		m = &manifest{path: config.Path, root: config.Root}
+		manifests[key] = m
+	}
+	return m
+}
+
+// files returns the paths of the files of the manifest, read again if it
+// changed. If it cannot be read, the last files read are returned with the
+// error.
+func (m *manifest) files() (map[string]struct{}, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	info, err := os.Stat(m.path)
+	if err != nil {
+		return m.set, err
+	}
+	if m.set != nil && info.ModTime().Equal(m.modTime) && info.Size() == m.size {
+		return m.set, nil
+	}
+
+	content, err := os.ReadFile(m.path)
+	if err != nil {
+		return m.set, err
+	}
+	m.set = parseManifest(content, m.root)
+	m.modTime = info.ModTime()
+	m.size = info.Size()
+	return m.set, nil
+}
+
+// parseManifest returns the paths listed in a manifest, one per line,
+// ignoring empty lines and lines starting with #. Relative paths are
+// relative to root.
+func parseManifest(content []byte, root string) map[string]struct{} {
+	set := map[string]struct{}{}
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if !path.IsAbs(line) && len(root) > 0 {
+			line = path.Join(root, line)
+		}
+		set[path.Clean(line)] = struct{}{}
+	}
+	return set
+}
+
+func init() {
+	registerCollector(collector{
+		name:        "manifest",
+		fromPayload: true,
+		section:     "scripts",
+		enabled:     func(e *Exporter) bool { return e.manifest != nil && e.collectors[scriptsCollector] },
+		update: func(e *Exporter, ch chan<- prometheus.Metric, payload *Payload) error {
+			a := payload.aggregates
+			if a.manifestErr != nil {
+				return a.manifestErr
+			}
+
+			var ratio float64
+			if len(a.manifest) > 0 {
+				ratio = float64(a.manifestCached) / float64(len(a.manifest))
+			}
+			ch <- prometheus.MustNewConstMetric(e.manifestFilesDesc, prometheus.GaugeValue, float64(len(a.manifest)))
+			ch <- prometheus.MustNewConstMetric(e.manifestCachedDesc, prometheus.GaugeValue, intMetric(a.manifestCached))
+			ch <- prometheus.MustNewConstMetric(e.manifestRatioDesc, prometheus.GaugeValue, ratio)
+			return nil
+		},
+	})
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+)
+
+var notifyClient = &http.Client{Timeout: 10 * time.Second}
+
+// postJSON posts a JSON encoded payload in the background, logging failures.
+func postJSON(url string, headers map[string]string, payload interface{}, logger log.Logger) {
+	go func() {
+		body, err := json.Marshal(payload)
+		if err != nil {
+			level.Error(logger).Log("msg", "Error encoding notification", "url", url, "err", err)
+			return
+		}
+
+		req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+		if err != nil {
+			level.Error(logger).Log("msg", "Error creating notification", "url", url, "err", err)
+			return
+		}
+		req.Header.Set("Content-Type", "application/json")
+		for name, value := range headers {
+			req.Header.Set(name, value)
+		}
+
+		resp, err := notifyClient.Do(req)
+		if err != nil {
+			level.Error(logger).Log("msg", "Error posting notification", "url", url, "err", err)
+			return
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode >= 300 {
+			level.Error(logger).Log("msg", "Notification rejected", "url", url, "status", resp.Status)
+		}
+	}()
+}
+
+// eventText returns a human readable description of an event.
+func eventText(event Event) string {
+	text := fmt.Sprintf("OPcache %s on %s", strings.ReplaceAll(event.Type, "_", " "), event.Target)
+	if event.Principal != "" {
+		text += " by " + event.Principal
+	}
+	if event.Reason != "" {
+		text += ": " + event.Reason
+	}
+	return text
+}
+
+// Notifier posts events to a webhook.
+type Notifier struct {
+	webhookURL secret
+	logger     log.Logger
+}
+
+// NewNotifier returns an initialized Notifier, or nil if no webhook URL is
+// given.
+func NewNotifier(webhookURL secret, logger log.Logger) *Notifier {
+	if !webhookURL.IsSet() {
+		return nil
+	}
+
+	return &Notifier{
+		webhookURL: webhookURL,
+		logger:     logger,
+	}
+}
+
+// Notify posts the event to the webhook in the background.
+func (n *Notifier) Notify(event Event) {
+	webhookURL, err := n.webhookURL.Get()
+	if err != nil {
+		level.Error(n.logger).Log("msg", "Error reading webhook URL", "err", err)
+		return
+	}
+	postJSON(webhookURL, nil, event, n.logger)
+}
+
+// GrafanaAnnotator pushes events to the Grafana annotations API.
+type GrafanaAnnotator struct {
+	url    string
+	token  secret
+	tags   []string
+	types  map[string]bool
+	logger log.Logger
+}
+
+// NewGrafanaAnnotator returns an initialized GrafanaAnnotator annotating the
+// given event types, or nil if no Grafana URL is given.
+func NewGrafanaAnnotator(grafanaURL string, token secret, tags, types []string, logger log.Logger) *GrafanaAnnotator {
+	if grafanaURL == "" {
+		return nil
+	}
+
+	a := &GrafanaAnnotator{
+		url:    strings.TrimSuffix(grafanaURL, "/") + "/api/annotations",
+		token:  token,
+		tags:   tags,
+		types:  map[string]bool{},
+		logger: logger,
+	}
+	for _, t := range types {
+		a.types[t] = true
+	}
+	return a
+}
+
+type grafanaAnnotation struct {
+	Time int64    `json:"time"`
+	Tags []string `json:"tags"`
+	Text string   `json:"text"`
+}
+
+// Notify creates an annotation for the event in the background, if its type
+// is annotated.
+func (a *GrafanaAnnotator) Notify(event Event) {
+	if !a.types[event.Type] {
+		return
+	}
+
+	token, err := a.token.Get()
+	if err != nil {
+		level.Error(a.logger).Log("msg", "Error reading Grafana API token", "err", err)
+		return
+	}
+	headers := map[string]string{}
+	if token != "" {
+		headers["Authorization"] = "Bearer " + token
+	}
+
+	postJSON(a.url, headers, grafanaAnnotation{
+		Time: event.Time.UnixMilli(),
+		Tags: append(append([]string{}, a.tags...), event.Type),
+		Text: eventText(event),
+	}, a.logger)
+}
+
+// ChatNotifier posts messages about critical events to a Slack or Microsoft
+// Teams incoming webhook: targets down for some time, and repeated OOM
+// restarts.
+type ChatNotifier struct {
+	mutex sync.Mutex
+
+	webhookURL  secret
+	downAfter   time.Duration
+	oomRestarts int
+	oomWindow   time.Duration
+	logger      log.Logger
+
+	downTimers  map[string]*time.Timer
+	downAlerted map[string]bool
+	oomTimes    map[string][]time.Time
+}
+
+// NewChatNotifier returns an initialized ChatNotifier, or nil if no webhook
+// URL is given. Slack and Teams incoming webhooks both accept the payload.
+func NewChatNotifier(webhookURL secret, downAfter time.Duration, oomRestarts int, oomWindow time.Duration, logger log.Logger) *ChatNotifier {
+	if !webhookURL.IsSet() {
+		return nil
+	}
+
+	return &ChatNotifier{
+		webhookURL:  webhookURL,
+		downAfter:   downAfter,
+		oomRestarts: oomRestarts,
+		oomWindow:   oomWindow,
+		logger:      logger,
+		downTimers:  map[string]*time.Timer{},
+		downAlerted: map[string]bool{},
+		oomTimes:    map[string][]time.Time{},
+	}
+}
+
+type chatMessage struct {
+	Text string `json:"text"`
+}
+
+func (n *ChatNotifier) send(text string) {
+	webhookURL, err := n.webhookURL.Get()
+	if err != nil {
+		level.Error(n.logger).Log("msg", "Error reading chat webhook URL", "err", err)
+		return
+	}
+	postJSON(webhookURL, nil, chatMessage{Text: text}, n.logger)
+}
+
+// Notify tracks the event, and posts a message when it makes a condition
+// critical.
+func (n *ChatNotifier) Notify(event Event) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	switch event.Type {
+	case "down":
+		if _, ok := n.downTimers[event.Target]; ok {
+			return
+		}
+		n.downTimers[event.Target] = time.AfterFunc(n.downAfter, func() {
+			n.mutex.Lock()
+			defer n.mutex.Unlock()
+
+			if _, ok := n.downTimers[event.Target]; !ok {
+				return
+			}
+			n.downAlerted[event.Target] = true
+			n.send(fmt.Sprintf(":red_circle: OPcache target %s is down for more than %s: %s", event.Target, n.downAfter, event.Reason))
+		})
+
+	case "up":
+		if timer, ok := n.downTimers[event.Target]; ok {
+			timer.Stop()
+			delete(n.downTimers, event.Target)
+		}
+		if n.downAlerted[event.Target] {
+			delete(n.downAlerted, event.Target)
+			n.send(fmt.Sprintf(":large_green_circle: OPcache target %s is up again", event.Target))
+		}
+
+	case "restart":
+		if event.Reason != "oom" {
+			return
+		}
+
+		var recent []time.Time
+		for _, t := range n.oomTimes[event.Target] {
+			if event.Time.Sub(t) < n.oomWindow {
+				recent = append(recent, t)
+			}
+		}
+		recent = append(recent, event.Time)
+
+		if len(recent) >= n.oomRestarts {
+			n.send(fmt.Sprintf(":warning: OPcache on %s restarted %d times because of lack of memory within %s", event.Target, len(recent), n.oomWindow))
+			recent = nil
+		}
+		n.oomTimes[event.Target] = recent
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"container/heap"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// topScripts keeps the scripts consuming the most memory among those added,
+// at most limit of them, as a min-heap on their memory consumption.
+type topScripts struct {
+	limit   int
+	scripts []Script
+}
+
+func newTopScripts(limit int) *topScripts {
+	return &topScripts{limit: limit}
+}
+
+func (t *topScripts) Len() int { return len(t.scripts) }
+func (t *topScripts) Less(i, j int) bool {
+	return t.scripts[i].MemoryConsumption < t.scripts[j].MemoryConsumption
+}
+func (t *topScripts) Swap(i, j int)      { t.scripts[i], t.scripts[j] = t.scripts[j], t.scripts[i] }
+func (t *topScripts) Push(x interface{}) { t.scripts = append(t.scripts, x.(Script)) }
+func (t *topScripts) Pop() interface{} {
+	script := t.scripts[len(t.scripts)-1]
+	t.scripts = t.scripts[:len(t.scripts)-1]
+	return script
+}
+
+// add keeps the script if it is among the ones consuming the most memory.
+func (t *topScripts) add(script Script) {
+	if len(t.scripts) < t.limit {
+		heap.Push(t, script)
+	} else if script.MemoryConsumption > t.scripts[0].MemoryConsumption {
+		t.scripts[0] = script
+		heap.Fix(t, 0)
+	}
+}
+
+// collectTopScripts collects the per-script metrics of the scripts consuming
+// the most memory, labeled by script.
+func (e *Exporter) collectTopScripts(ch chan<- prometheus.Metric, top *topScripts) {
+	for _, script := range top.scripts {
+		ch <- prometheus.MustNewConstMetric(e.scriptHitsDesc, prometheus.GaugeValue, intMetric(script.Hits), script.FullPath)
+		ch <- prometheus.MustNewConstMetric(e.scriptMemoryDesc, prometheus.GaugeValue, intMetric(script.MemoryConsumption), script.FullPath)
+		ch <- prometheus.MustNewConstMetric(e.scriptLastUsedDesc, prometheus.GaugeValue, intMetric(script.LastUsedTimestamp), script.FullPath)
+	}
+}
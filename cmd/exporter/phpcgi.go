@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+)
+
+const (
+	// phpCGIStartTimeout is the time given to php-cgi to listen after it
+	// is spawned.
+	phpCGIStartTimeout = 5 * time.Second
+	// phpCGIMaxBackoff is the longest delay before spawning php-cgi again
+	// after it exited, the delay doubling after each exit from 1s, unless
+	// it ran for longer than this.
+	phpCGIMaxBackoff = time.Minute
+)
+
+// phpCGI supervises a php-cgi child process serving FastCGI requests, for
+// hosts which only run PHP through mod_php or CLI workers.
+type phpCGI struct {
+	binary  string
+	address string
+	ini     map[string]string
+	logger  log.Logger
+
+	mutex   sync.Mutex
+	cmd     *exec.Cmd
+	stopped bool
+}
+
+// startPHPCGI spawns php-cgi listening on address, with the ini settings
+// overridden, and spawns it again whenever it exits.
+func startPHPCGI(binary, address string, ini map[string]string, logger log.Logger) (*phpCGI, error) {
+	p := &phpCGI{binary: binary, address: address, ini: ini, logger: logger}
+
+	cmd, err := p.spawn()
+	if err != nil {
+		return nil, err
+	}
+	go p.supervise(cmd)
+	return p, nil
+}
+
+// Target returns the URI of the php-cgi FastCGI server.
+func (p *phpCGI) Target() string {
+	return "tcp://" + p.address
+}
+
+// spawn starts php-cgi and waits for it to listen.
+func (p *phpCGI) spawn() (*exec.Cmd, error) {
+	args := []string{"-b", p.address}
+	names := make([]string, 0, len(p.ini))
+	for name := range p.ini {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		args = append(args, "-d", name+"="+p.ini[name])
+	}
+
+	cmd := exec.Command(p.binary, args...)
+	// php-cgi exits after 500 requests by default.
+	cmd.Env = append(os.Environ(), "PHP_FCGI_MAX_REQUESTS=0")
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	bindToParent(cmd)
+
+	p.mutex.Lock()
+	if p.stopped {
+		p.mutex.Unlock()
+		return nil, fmt.Errorf("php-cgi stopped")
+	}
+	if err := cmd.Start(); err != nil {
+		p.mutex.Unlock()
+		return nil, err
+	}
+	p.cmd = cmd
+	p.mutex.Unlock()
+	level.Info(p.logger).Log("msg", "Spawned php-cgi", "pid", cmd.Process.Pid, "address", p.address)
+
+	for start := time.Now(); time.Since(start) < phpCGIStartTimeout; time.Sleep(100 * time.Millisecond) {
+		if conn, err := net.DialTimeout("tcp", p.address, time.Second); err == nil {
+			conn.Close()
+			return cmd, nil
+		}
+	}
+	level.Warn(p.logger).Log("msg", "php-cgi not listening yet", "address", p.address, "timeout", phpCGIStartTimeout)
+	return cmd, nil
+}
+
+// supervise waits for php-cgi to exit, and spawns it again after a delay
+// growing with the exits in a row, until it is stopped.
+func (p *phpCGI) supervise(cmd *exec.Cmd) {
+	backoff := time.Second
+	for {
+		start := time.Now()
+		err := cmd.Wait()
+
+		p.mutex.Lock()
+		stopped := p.stopped
+		p.mutex.Unlock()
+		if stopped {
+			return
+		}
+
+		if time.Since(start) > phpCGIMaxBackoff {
+			backoff = time.Second
+		}
+		level.Error(p.logger).Log("msg", "php-cgi exited, spawning it again", "err", err, "delay", backoff)
+		time.Sleep(backoff)
+		backoff = min(2*backoff, phpCGIMaxBackoff)
+
+		for {
+			if cmd, err = p.spawn(); err == nil {
+				break
+			}
+			p.mutex.Lock()
+			stopped := p.stopped
+			p.mutex.Unlock()
+			if stopped {
+				return
+			}
+			level.Error(p.logger).Log("msg", "Error spawning php-cgi", "err", err, "delay", backoff)
+			time.Sleep(backoff)
+			backoff = min(2*backoff, phpCGIMaxBackoff)
+		}
+	}
+}
+
+// stop kills php-cgi. It is safe to call on a nil phpCGI.
+func (p *phpCGI) stop() {
+	if p == nil {
+		return
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.stopped = true
+	if p.cmd != nil && p.cmd.Process != nil {
+		p.cmd.Process.Kill()
+	}
+}
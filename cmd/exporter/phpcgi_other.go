@@ -0,0 +1,9 @@
+//go:build !linux
+
+package main
+
+import "os/exec"
+
+// bindToParent is a no-op on systems without parent death signal: the
+// command is only killed when the exporter shuts down gracefully.
+func bindToParent(cmd *exec.Cmd) {}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/expfmt"
+	"golang.org/x/net/websocket"
+)
+
+// pushMaxBackoff is the longest delay before dialing the collector again,
+// the delay doubling after each failure from 1s.
+const pushMaxBackoff = time.Minute
+
+// pushAgent dials out to a central collector over WebSocket, and streams
+// snapshots of the metrics to it, for web servers which cannot be scraped
+// because they are behind NAT or firewalls.
+type pushAgent struct {
+	url       string
+	id        string
+	tokenFile string
+	interval  time.Duration
+	tlsConfig *tls.Config
+	gather    func(ctx context.Context) prometheus.Gatherer
+	budget    *ScrapeBudget
+	logger    log.Logger
+
+	connected prometheus.Gauge
+	snapshots *prometheus.CounterVec
+}
+
+// newPushAgent returns an agent pushing the metrics of the gatherers returned
+// by gather to the collector at url, identified by id, or by the host name if
+// empty. The snapshots are bounded by the interval with the budget, if not
+// nil.
+func newPushAgent(url, id, tokenFile, caFile string, interval time.Duration, gather func(ctx context.Context) prometheus.Gatherer, budget *ScrapeBudget, logger log.Logger) (*pushAgent, error) {
+	if len(id) == 0 {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return nil, err
+		}
+		id = hostname
+	}
+
+	a := &pushAgent{
+		url:       url,
+		id:        id,
+		tokenFile: tokenFile,
+		interval:  interval,
+		gather:    gather,
+		budget:    budget,
+		logger:    logger,
+		connected: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "opcache_exporter",
+			Name:      "push_connected",
+			Help:      "Whether the exporter is connected to the collector to which it pushes its metrics.",
+		}),
+		snapshots: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "opcache_exporter",
+			Name:      "push_snapshots_total",
+			Help:      "Total number of snapshots of the metrics pushed to the collector, by result.",
+		}, []string{"result"}),
+	}
+
+	if len(caFile) > 0 {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in %s", caFile)
+		}
+		a.tlsConfig = &tls.Config{RootCAs: pool}
+	}
+	return a, nil
+}
+
+// Describe implements prometheus.Collector.
+func (a *pushAgent) Describe(ch chan<- *prometheus.Desc) {
+	a.connected.Describe(ch)
+	a.snapshots.Describe(ch)
+}
+
+// Collect implements prometheus.Collector.
+func (a *pushAgent) Collect(ch chan<- prometheus.Metric) {
+	a.connected.Collect(ch)
+	a.snapshots.Collect(ch)
+}
+
+// run keeps a connection to the collector, dialing it again after a delay
+// growing with the failures in a row. It never returns.
+func (a *pushAgent) run() {
+	backoff := time.Second
+	for {
+		start := time.Now()
+		err := a.push()
+		a.connected.Set(0)
+
+		if time.Since(start) > pushMaxBackoff {
+			backoff = time.Second
+		}
+		level.Error(a.logger).Log("msg", "Error pushing metrics to collector, dialing it again", "url", a.url, "err", err, "delay", backoff)
+		time.Sleep(backoff)
+		backoff = min(2*backoff, pushMaxBackoff)
+	}
+}
+
+// push dials the collector, and sends it a snapshot of the metrics every
+// interval until the connection fails. Snapshots are text messages in the
+// Prometheus text format.
+func (a *pushAgent) push() error {
+	config, err := websocket.NewConfig(a.url, strings.Replace(strings.Replace(a.url, "wss://", "https://", 1), "ws://", "http://", 1))
+	if err != nil {
+		return err
+	}
+	config.TlsConfig = a.tlsConfig
+	config.Header = http.Header{"X-Opcache-Exporter-Agent": {a.id}}
+	if len(a.tokenFile) > 0 {
+		token, err := os.ReadFile(a.tokenFile)
+		if err != nil {
+			return err
+		}
+		config.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	}
+
+	conn, err := websocket.DialConfig(config)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	a.connected.Set(1)
+	level.Info(a.logger).Log("msg", "Connected to collector", "url", a.url, "agent", a.id)
+
+	for {
+		snapshot, err := a.snapshot()
+		if err != nil {
+			a.snapshots.WithLabelValues("failure").Inc()
+			level.Error(a.logger).Log("msg", "Error gathering metrics to push", "err", err)
+		}
+		if len(snapshot) > 0 {
+			if sendErr := websocket.Message.Send(conn, string(snapshot)); sendErr != nil {
+				a.snapshots.WithLabelValues("failure").Inc()
+				return sendErr
+			}
+			if err == nil {
+				a.snapshots.WithLabelValues("success").Inc()
+			}
+		}
+		time.Sleep(a.interval)
+	}
+}
+
+// snapshot gathers the metrics in the Prometheus text format. Like scrapes,
+// it returns the metrics which could be gathered along with the error.
+func (a *pushAgent) snapshot() ([]byte, error) {
+	ctx, cancel := a.budget.withTimeout(context.Background(), a.interval)
+	defer cancel()
+	families, err := a.gather(ctx).Gather()
+
+	var buf bytes.Buffer
+	encoder := expfmt.NewEncoder(&buf, expfmt.NewFormat(expfmt.TypeTextPlain))
+	for _, family := range families {
+		if encodeErr := encoder.Encode(family); encodeErr != nil {
+			return nil, encodeErr
+		}
+	}
+	return buf.Bytes(), err
+}
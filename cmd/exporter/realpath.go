@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// phpNamespace is the namespace of the metrics of PHP itself rather than of
+// OPcache, such as those of its realpath cache.
+const phpNamespace = "php"
+
+func newPHPMetric(metricName, metricDesc string, labels prometheus.Labels) *prometheus.Desc {
+	return prometheus.NewDesc(prometheus.BuildFQName(phpNamespace, "", metricName), metricDesc, nil, labels)
+}
+
+// realpathCacheExpression is the PHP expression evaluated to the usage of
+// the realpath cache of the PHP process running the status script.
+const realpathCacheExpression = "['used' => realpath_cache_size(), 'entries' => count(realpath_cache_get()), 'size' => ini_get('realpath_cache_size')]"
+
+// RealpathCacheUsage contains the usage of the realpath cache of PHP
+type RealpathCacheUsage struct {
+	Used    int64 `json:"used"`
+	Entries int64 `json:"entries"`
+	// Size is the value of realpath_cache_size, such as 4096K.
+	Size string `json:"size"`
+}
+
+// parsePHPSize parses a size given in the shorthand notation of php.ini, such
+// as 4096K, 16M or 1G.
+func parsePHPSize(raw string) (int64, error) {
+	size := strings.TrimSpace(raw)
+	multiplier := int64(1)
+	if len(size) > 0 {
+		switch size[len(size)-1] {
+		case 'k', 'K':
+			multiplier = 1 << 10
+		case 'm', 'M':
+			multiplier = 1 << 20
+		case 'g', 'G':
+			multiplier = 1 << 30
+		}
+		if multiplier > 1 {
+			size = size[:len(size)-1]
+		}
+	}
+
+	value, err := strconv.ParseInt(size, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %q", raw)
+	}
+	return value * multiplier, nil
+}
+
+func init() {
+	registerCollector(collector{
+		name:        realpathCacheCollector,
+		fromPayload: true,
+		section:     "realpath_cache",
+		enabled:     func(e *Exporter) bool { return e.collectors[realpathCacheCollector] },
+		update: func(e *Exporter, ch chan<- prometheus.Metric, payload *Payload) error {
+			// Scripts not generated by the exporter may not report it.
+			usage := payload.RealpathCache
+			if usage == nil {
+				return nil
+			}
+			ch <- prometheus.MustNewConstMetric(e.realpathCacheUsedDesc, prometheus.GaugeValue, intMetric(usage.Used))
+			ch <- prometheus.MustNewConstMetric(e.realpathCacheEntriesDesc, prometheus.GaugeValue, intMetric(usage.Entries))
+			size, err := parsePHPSize(usage.Size)
+			if err != nil {
+				return fmt.Errorf("realpath_cache_size: %w", err)
+			}
+			ch <- prometheus.MustNewConstMetric(e.realpathCacheSizeDesc, prometheus.GaugeValue, intMetric(size))
+			return nil
+		},
+	})
+}
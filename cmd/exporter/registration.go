@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+)
+
+var registrationHTTPClient = &http.Client{Timeout: 10 * time.Second}
+
+// registrar registers the exporter in a service discovery backend, so that
+// Prometheus discovers the instances of dynamic fleets.
+type registrar struct {
+	config *RegistrationConfig
+	logger log.Logger
+	id     string
+	host   string
+	port   int
+	scheme string
+	path   string
+
+	registered bool
+	leaseID    string
+}
+
+// newRegistrar returns a registrar advertising the web interface, at the
+// configured address or else at the host name and the port it listens on.
+func newRegistrar(config *RegistrationConfig, web webOptions, logger log.Logger) (*registrar, error) {
+	address := config.Address
+	if len(address) == 0 {
+		_, port, err := net.SplitHostPort(web.ListenAddress)
+		if err != nil {
+			return nil, err
+		}
+		hostname, err := os.Hostname()
+		if err != nil {
+			return nil, err
+		}
+		address = net.JoinHostPort(hostname, port)
+	}
+
+	host, rawPort, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(rawPort)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port in %q", address)
+	}
+
+	r := &registrar{
+		config: config,
+		logger: logger,
+		id:     config.Service + "-" + address,
+		host:   host,
+		port:   port,
+		scheme: "http",
+		path:   web.MetricsPath,
+	}
+	if web.TLSCert.IsSet() {
+		r.scheme = "https"
+	}
+	return r, nil
+}
+
+// address returns the advertised address of the exporter.
+func (r *registrar) address() string {
+	return net.JoinHostPort(r.host, strconv.Itoa(r.port))
+}
+
+// run registers the exporter, and refreshes its registration three times
+// per TTL, registering it again after the backend lost it, until stop is
+// closed. It then deregisters the exporter.
+func (r *registrar) run(stop <-chan struct{}) {
+	for {
+		if err := r.refresh(); err != nil {
+			level.Error(r.logger).Log("msg", "Error registering exporter", "backend", r.config.Backend, "err", err)
+		}
+
+		select {
+		case <-time.After(r.config.TTL / 3):
+		case <-stop:
+			if err := r.deregister(); err != nil {
+				level.Error(r.logger).Log("msg", "Error deregistering exporter", "backend", r.config.Backend, "err", err)
+			} else {
+				level.Info(r.logger).Log("msg", "Deregistered exporter", "backend", r.config.Backend, "id", r.id)
+			}
+			return
+		}
+	}
+}
+
+// refresh registers the exporter, or keeps the etcd lease of its
+// registration alive.
+func (r *registrar) refresh() error {
+	if r.config.Backend == "etcd" && r.registered {
+		var resp struct {
+			Result struct {
+				TTL string `json:"TTL"`
+			} `json:"result"`
+		}
+		err := r.request(http.MethodPost, "/v3/lease/keepalive", map[string]string{"ID": r.leaseID}, &resp)
+		// An expired lease is kept alive with a TTL of 0 or less.
+		if ttl, _ := strconv.Atoi(resp.Result.TTL); err == nil && ttl > 0 {
+			return nil
+		}
+		r.registered = false
+	}
+
+	if err := r.register(); err != nil {
+		r.registered = false
+		return err
+	}
+	if !r.registered {
+		level.Info(r.logger).Log("msg", "Registered exporter", "backend", r.config.Backend, "id", r.id, "address", r.address())
+		r.registered = true
+	}
+	return nil
+}
+
+func (r *registrar) register() error {
+	labels := map[string]string{}
+	for name, value := range r.config.Labels {
+		labels[name] = value
+	}
+
+	switch r.config.Backend {
+	case "consul":
+		// Consul exposes the metadata as __meta_consul_service_metadata_*
+		// labels, from which the scheme and path are relabeled.
+		labels["metrics_path"] = r.path
+		labels["scheme"] = r.scheme
+		body := map[string]interface{}{
+			"ID":      r.id,
+			"Name":    r.config.Service,
+			"Address": r.host,
+			"Port":    r.port,
+			"Tags":    r.config.Tags,
+			"Meta":    labels,
+			"Check": map[string]interface{}{
+				"HTTP":                           r.scheme + "://" + r.address() + "/",
+				"Interval":                       r.config.TTL.String(),
+				"TLSSkipVerify":                  true,
+				"DeregisterCriticalServiceAfter": (10 * r.config.TTL).String(),
+			},
+		}
+		return r.request(http.MethodPut, "/v1/agent/service/register", body, nil)
+
+	case "etcd":
+		var lease struct {
+			ID string `json:"ID"`
+		}
+		ttl := int(r.config.TTL.Seconds())
+		if err := r.request(http.MethodPost, "/v3/lease/grant", map[string]int{"TTL": ttl}, &lease); err != nil {
+			return fmt.Errorf("granting lease: %w", err)
+		}
+
+		// The value is a target group, as read from the files of file_sd.
+		labels["__metrics_path__"] = r.path
+		labels["__scheme__"] = r.scheme
+		value, err := json.Marshal([]map[string]interface{}{{
+			"targets": []string{r.address()},
+			"labels":  labels,
+		}})
+		if err != nil {
+			return err
+		}
+		body := map[string]string{
+			"key":   base64.StdEncoding.EncodeToString([]byte(r.etcdKey())),
+			"value": base64.StdEncoding.EncodeToString(value),
+			"lease": lease.ID,
+		}
+		if err := r.request(http.MethodPost, "/v3/kv/put", body, nil); err != nil {
+			return fmt.Errorf("putting %s: %w", r.etcdKey(), err)
+		}
+		r.leaseID = lease.ID
+		return nil
+	}
+
+	return fmt.Errorf("unknown backend %q", r.config.Backend)
+}
+
+// deregister removes the exporter from the backend, along with its key for
+// etcd by revoking its lease.
+func (r *registrar) deregister() error {
+	switch r.config.Backend {
+	case "consul":
+		return r.request(http.MethodPut, "/v1/agent/service/deregister/"+r.id, nil, nil)
+	case "etcd":
+		if !r.registered {
+			return nil
+		}
+		return r.request(http.MethodPost, "/v3/lease/revoke", map[string]string{"ID": r.leaseID}, nil)
+	}
+	return nil
+}
+
+func (r *registrar) etcdKey() string {
+	return strings.TrimSuffix(r.config.Prefix, "/") + "/" + r.config.Service + "/" + r.address()
+}
+
+// request calls the API of the backend, encoding the body and decoding the
+// response into resp as JSON if they are not nil.
+func (r *registrar) request(method, path string, body, resp interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		content, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(content)
+	}
+
+	req, err := http.NewRequest(method, strings.TrimSuffix(r.config.Endpoint, "/")+path, reader)
+	if err != nil {
+		return err
+	}
+	if len(r.config.TokenFile) > 0 {
+		token, err := os.ReadFile(r.config.TokenFile)
+		if err != nil {
+			return err
+		}
+		if r.config.Backend == "consul" {
+			req.Header.Set("X-Consul-Token", strings.TrimSpace(string(token)))
+		} else {
+			req.Header.Set("Authorization", strings.TrimSpace(string(token)))
+		}
+	}
+
+	res, err := registrationHTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode >= 300 {
+		message, _ := io.ReadAll(io.LimitReader(res.Body, 512))
+		return fmt.Errorf("unexpected status %s: %s", res.Status, strings.TrimSpace(string(message)))
+	}
+
+	if resp == nil {
+		return nil
+	}
+	return json.NewDecoder(res.Body).Decode(resp)
+}
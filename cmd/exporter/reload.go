@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// configReloadDelay is the delay between the last change of the directory of
+// the configuration file and its reload, as deployment tools often write it
+// in several steps.
+const configReloadDelay = time.Second
+
+// configWatcher reloads the configuration file when it changes.
+type configWatcher struct {
+	path   string
+	logger log.Logger
+
+	mutex   sync.Mutex
+	content []byte
+	config  *Config
+	apply   func(*Config)
+
+	// fragmentsDir is the directory of the target fragments, if any, whose
+	// targets are only scraped on restart, and fragmentTargets are their
+	// last targets.
+	fragmentsDir    string
+	fragmentTargets []string
+
+	success   prometheus.Gauge
+	timestamp prometheus.Gauge
+}
+
+// newConfigWatcher returns a watcher of the configuration file, which was
+// loaded as config.
+func newConfigWatcher(path string, config *Config, logger log.Logger) (*configWatcher, error) {
+	if path == "" {
+		return nil, fmt.Errorf("no configuration file to watch")
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &configWatcher{
+		path:    path,
+		logger:  logger,
+		content: content,
+		config:  config,
+		success: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "opcache_exporter",
+			Name:      "config_last_reload_successful",
+			Help:      "Whether the last reload of the configuration file succeeded.",
+		}),
+		timestamp: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "opcache_exporter",
+			Name:      "config_last_reload_success_timestamp_seconds",
+			Help:      "Timestamp of the last successful reload of the configuration file.",
+		}),
+	}
+	w.success.Set(1)
+	w.timestamp.SetToCurrentTime()
+	return w, nil
+}
+
+// watchFragments watches the directory of the target fragments too, which
+// defined targets when the exporter started.
+func (w *configWatcher) watchFragments(dir string, targets []string) {
+	w.fragmentsDir = dir
+	w.fragmentTargets = targets
+}
+
+// start watches the directory of the configuration file, rather than the
+// file itself, which tools such as Kubernetes replace instead of writing it,
+// and calls apply with the configuration reloaded after its changes.
+func (w *configWatcher) start(apply func(*Config)) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	dirs := []string{filepath.Dir(w.path)}
+	if w.fragmentsDir != "" {
+		dirs = append(dirs, w.fragmentsDir)
+	}
+	for _, dir := range dirs {
+		if err := watcher.Add(dir); err != nil {
+			watcher.Close()
+			return err
+		}
+	}
+	w.apply = apply
+
+	go func() {
+		timer := time.AfterFunc(configReloadDelay, w.reload)
+		timer.Stop()
+		for {
+			select {
+			case _, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				timer.Reset(configReloadDelay)
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				level.Warn(w.logger).Log("msg", "Error watching configuration file", "err", err)
+			}
+		}
+	}()
+	return nil
+}
+
+// reload reloads the configuration file if its content changed, and checks
+// the target fragments.
+func (w *configWatcher) reload() {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	w.reloadConfig()
+	if w.fragmentsDir != "" {
+		w.checkFragments()
+	}
+}
+
+// reloadConfig reloads the configuration file if its content changed.
+func (w *configWatcher) reloadConfig() {
+	content, err := os.ReadFile(w.path)
+	if err == nil && bytes.Equal(content, w.content) {
+		return
+	}
+
+	var config *Config
+	if err == nil {
+		config, err = parseConfig(w.path, content)
+	}
+	if err != nil {
+		level.Error(w.logger).Log("msg", "Error reloading configuration", "err", err)
+		w.success.Set(0)
+		return
+	}
+
+	// The custom collectors are rendered into the status script, and the
+	// other settings are only read at startup.
+	if !reflect.DeepEqual(config.Collectors, w.config.Collectors) ||
+		!reflect.DeepEqual(config.Cluster, w.config.Cluster) ||
+		!reflect.DeepEqual(config.Web, w.config.Web) ||
+		!reflect.DeepEqual(config.Entrypoints, w.config.Entrypoints) {
+		level.Warn(w.logger).Log("msg", "Changes to collectors, cluster, web and entrypoints settings are only applied on restart")
+	}
+	config.Collectors = w.config.Collectors
+
+	w.apply(config)
+	w.content = content
+	w.config = config
+	w.success.Set(1)
+	w.timestamp.SetToCurrentTime()
+	level.Info(w.logger).Log("msg", "Configuration reloaded", "path", w.path)
+}
+
+// checkFragments warns when the targets of the fragments changed, as the
+// targets are only created on startup.
+func (w *configWatcher) checkFragments() {
+	targets, err := loadTargetFragments(w.fragmentsDir)
+	if err != nil {
+		level.Error(w.logger).Log("msg", "Error reloading target fragments", "err", err)
+		return
+	}
+	if reflect.DeepEqual(targets, w.fragmentTargets) {
+		return
+	}
+
+	level.Warn(w.logger).Log("msg", "Changes to the targets of fragments are only applied on restart", "dir", w.fragmentsDir)
+	w.fragmentTargets = targets
+}
+
+// Collector returns a collector exporting the outcome of the last reload.
+func (w *configWatcher) Collector() prometheus.Collector {
+	return collectorGroup{w.success, w.timestamp}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/http"
+	"net/http/fcgi"
+	"net/url"
+	"os"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+)
+
+// listenResponder listens on the address of the FastCGI responder, given as
+// a URI such as unix:///run/opcache-exporter.sock or tcp://127.0.0.1:9102.
+// A unix socket left behind by a previous run is removed.
+func listenResponder(address string) (net.Listener, error) {
+	uri, err := url.Parse(normalizeURI(address))
+	if err != nil {
+		return nil, err
+	}
+
+	switch uri.Scheme {
+	case "tcp":
+		return net.Listen("tcp", uri.Host)
+	case "unix":
+		if err := os.Remove(uri.Path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+		return net.Listen("unix", uri.Path)
+	}
+	return nil, fmt.Errorf("unsupported FastCGI responder scheme %q", uri.Scheme)
+}
+
+// serveResponder serves the handler as a FastCGI responder, so that front
+// ends such as nginx or Apache expose it with their own TLS and
+// authentication. It returns when the listener is closed.
+func serveResponder(listener net.Listener, handler http.Handler, logger log.Logger) {
+	level.Info(logger).Log("msg", "Serving FastCGI responder", "address", listener.Addr())
+	if err := fcgi.Serve(listener, handler); err != nil && !errors.Is(err, net.ErrClosed) {
+		level.Error(logger).Log("msg", "Error serving FastCGI responder", "err", err)
+	}
+}
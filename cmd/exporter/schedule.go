@@ -0,0 +1,141 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// coversTarget tells whether a list of targets includes the target, an
+// empty list including all of them.
+func coversTarget(targets []string, target string) bool {
+	if len(targets) == 0 {
+		return true
+	}
+	for _, t := range targets {
+		if t == target {
+			return true
+		}
+	}
+	return false
+}
+
+// covers tells whether the schedule resets the target.
+func (c ResetScheduleConfig) covers(target string) bool {
+	return coversTarget(c.Targets, target)
+}
+
+// resetScheduler resets the OPcache of targets on schedule.
+type resetScheduler struct {
+	mutex     sync.Mutex
+	schedules []ResetScheduleConfig
+	targets   []*Exporter
+	logger    log.Logger
+}
+
+func newResetScheduler(schedules []ResetScheduleConfig, logger log.Logger) *resetScheduler {
+	return &resetScheduler{schedules: schedules, logger: logger}
+}
+
+// addTarget adds a target to the scheduler, which resets it if any schedule
+// covers it.
+func (s *resetScheduler) addTarget(e *Exporter) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.targets = append(s.targets, e)
+	s.mark(e)
+}
+
+// setSchedules replaces the schedules, when the configuration is reloaded.
+func (s *resetScheduler) setSchedules(schedules []ResetScheduleConfig) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.schedules = schedules
+	for _, e := range s.targets {
+		s.mark(e)
+	}
+}
+
+// mark records on the target whether any schedule resets it, so that it
+// exports the outcome of its scheduled resets.
+func (s *resetScheduler) mark(e *Exporter) {
+	scheduled := false
+	for _, schedule := range s.schedules {
+		if schedule.covers(e.Target()) {
+			scheduled = true
+			break
+		}
+	}
+
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.resetScheduled = scheduled
+}
+
+// run resets the targets at the start of the minutes matching their
+// schedules. It never returns.
+func (s *resetScheduler) run() {
+	for {
+		next := time.Now().Truncate(time.Minute).Add(time.Minute)
+		time.Sleep(time.Until(next))
+		s.fire(next)
+	}
+}
+
+func (s *resetScheduler) fire(t time.Time) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, e := range s.targets {
+		for _, schedule := range s.schedules {
+			if !schedule.covers(e.Target()) || !schedule.schedule.Matches(t) {
+				continue
+			}
+
+			go func(e *Exporter) {
+				if err := e.scheduledReset(); err != nil {
+					level.Error(s.logger).Log("msg", "Error resetting OPcache on schedule", "target", e.Target(), "err", err)
+				} else {
+					level.Info(s.logger).Log("msg", "OPcache reset on schedule", "target", e.Target())
+				}
+			}(e)
+			break
+		}
+	}
+}
+
+// scheduledReset resets the OPcache of the target, and records the outcome.
+func (e *Exporter) scheduledReset() error {
+	err := e.Reset()
+	if err == nil {
+		event := newEvent(e.Target(), "reset", "schedule")
+		event.Principal = "scheduler"
+		e.events.Record(event)
+	}
+
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.lastScheduledReset = time.Now()
+	e.lastScheduledResetSuccess = err == nil
+
+	return err
+}
+
+func init() {
+	registerCollector(collector{
+		name:    "reset_schedule",
+		enabled: func(e *Exporter) bool { return e.resetScheduled },
+		update: func(e *Exporter, ch chan<- prometheus.Metric, payload *Payload) error {
+			if !e.lastScheduledReset.IsZero() {
+				ch <- prometheus.MustNewConstMetric(e.scheduledResetTimeDesc, prometheus.GaugeValue, float64(e.lastScheduledReset.Unix()))
+				ch <- prometheus.MustNewConstMetric(e.scheduledResetSuccessDesc, prometheus.GaugeValue, boolMetric(e.lastScheduledResetSuccess))
+			}
+			return nil
+		},
+	})
+}
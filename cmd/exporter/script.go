@@ -0,0 +1,225 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"text/template"
+)
+
+// payloadSection is a part of the composite document echoed by the generated
+// status script.
+type payloadSection struct {
+	// Key of the section in the document.
+	Key string
+	// PHP expression evaluated to fill the section.
+	Expression string
+}
+
+// payloadSections are evaluated by the generated status script, so that a
+// single request gathers everything the exporter needs. The scripts and the
+// configuration are sections of their own, so that failing to collect them
+// spares the status.
+var payloadSections = []payloadSection{
+	{"status", checked("opcache_get_status(false)")},
+	{"scripts", skipped(scriptsCollector) + " ? null : (object) (" + checked("opcache_get_status(true)") + "['scripts'] ?? [])"},
+	{"script_files", skipped(scriptsCollector) + " ? null : " + scriptFilesExpression},
+	{"configuration", skipped(configurationCollector) + " ? null : " + checked("opcache_get_configuration()")},
+	{"file_cache_usage", skipped(fileCacheCollector) + " ? null : " + fileCacheExpression},
+	{"realpath_cache", skipped(realpathCacheCollector) + " ? null : " + realpathCacheExpression},
+	{"php", "['version' => PHP_VERSION, 'zend' => zend_version(), 'opcache' => phpversion('Zend OPcache') ?: '']"},
+}
+
+// checked returns a PHP expression evaluated to the result of a call, which
+// throws an exception if it returns false, such as the OPcache functions
+// restricted by opcache.restrict_api. The warning of the call is silenced so
+// that it does not corrupt the payload, and reported in the exception.
+func checked(call string) string {
+	return fmt.Sprintf("(function () { if (($result = @%s) === false) { throw new \\RuntimeException('%s failed: ' . (error_get_last()['message'] ?? 'unknown error')); } return $result; })()", call, strings.ReplaceAll(call, "'", "\\'"))
+}
+
+// scriptAction is an admin action run by the generated status script on
+// demand, instead of echoing the payload.
+type scriptAction struct {
+	Name string
+	// PHP expression evaluated to the result of the action, given its
+	// arguments in $args.
+	Expression string
+}
+
+var scriptActions = []scriptAction{
+	{"reset", "opcache_reset()"},
+	{"invalidate", "array_combine($args['scripts'], array_map(function ($script) use ($args) { return opcache_invalidate($script, $args['force']); }, $args['scripts']))"},
+	{"validate", "(function ($scripts) { $valid = []; foreach ($scripts as $script) { try { $valid[$script] = @opcache_compile_file($script) && opcache_is_script_cached($script); } catch (\\Throwable $e) { $valid[$script] = false; } } return $valid; })($args['scripts'])"},
+	{"canary", "(opcache_invalidate($args['script'], true) || true) && @opcache_compile_file($args['script'])"},
+	{"compile", "array_combine($args['scripts'], array_map(function ($script) { return @opcache_compile_file($script); }, $args['scripts']))"},
+}
+
+// actionsTemplate defines the "actions" template, dispatching the requested
+// admin action. As the actions reset and compile scripts, they are only
+// compiled in with a token, which they require even in custom templates.
+const actionsTemplate = `
+{{- define "actions" }}
+{{- if .Token }}
+if (isset($_SERVER['{{ .ActionVar }}'])) {
+  if (!hash_equals('{{ .Token }}', $_SERVER['{{ .TokenVar }}'] ?? '')) {
+    http_response_code(403);
+    exit;
+  }
+  $action = $_SERVER['{{ .ActionVar }}'];
+  $args = json_decode($_SERVER['{{ .ArgsVar }}'] ?? '{}', true);
+  switch ($action) {
+{{- range .Actions }}
+    case '{{ .Name }}':
+      $result = {{ .Expression }};
+      break;
+{{- end }}
+    default:
+      http_response_code(400);
+      exit;
+  }
+  echo(json_encode(['action' => $action, 'result' => $result]));
+  exit;
+}
+{{- end }}
+{{- end }}`
+
+// defaultScriptTemplate is the template of the generated status script. When
+// a token is given, the script only answers requests bearing it, and runs the
+// admin actions.
+const defaultScriptTemplate = `<?php
+{{- if .Token }}
+if (!hash_equals('{{ .Token }}', $_SERVER['{{ .TokenVar }}'] ?? '')) {
+  http_response_code(403);
+  exit;
+}
+{{- end }}
+{{- template "actions" . }}
+$payload = [];
+$errors = [];
+{{- range .Sections }}
+try {
+  $payload['{{ .Key }}'] = {{ .Expression }};
+} catch (\Throwable $e) {
+  $errors['{{ .Key }}'] = $e->getMessage();
+}
+{{- end }}
+$payload['errors'] = (object) $errors;
+$payload['execution_seconds'] = microtime(true) - $_SERVER['REQUEST_TIME_FLOAT'];
+echo(json_encode($payload));
+`
+
+// scriptData are the variables available to status script templates.
+type scriptData struct {
+	// Token expected by the script, if any, in the TokenVar server variable:
+	// an HTTP_* variable for scripts requested over HTTP, or else a parameter
+	// which clients of the web server cannot set, like ActionVar and ArgsVar.
+	Token    string
+	TokenVar string
+	// Sections of the payload, including the custom collectors.
+	Sections []payloadSection
+	// Collectors are the custom collectors of the configuration.
+	Collectors []CustomCollectorConfig
+	// Actions are run instead of echoing the payload when requested by the
+	// ActionVar server variable, with the JSON arguments of ArgsVar.
+	Actions   []scriptAction
+	ActionVar string
+	ArgsVar   string
+}
+
+// ScriptTemplate renders the generated status script.
+type ScriptTemplate struct {
+	template *template.Template
+}
+
+// LoadScriptTemplate returns the status script template read from path, or
+// the default one if path is empty.
+func LoadScriptTemplate(path string) (*ScriptTemplate, error) {
+	text := defaultScriptTemplate
+	if len(path) > 0 {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		text = string(content)
+	}
+
+	// Custom templates may run the admin actions with {{ template "actions" . }}.
+	tmpl, err := template.New("script").Option("missingkey=error").Parse(actionsTemplate)
+	if err != nil {
+		return nil, err
+	}
+	if tmpl, err = tmpl.Parse(text); err != nil {
+		return nil, err
+	}
+
+	return &ScriptTemplate{template: tmpl}, nil
+}
+
+// Render returns the PHP code of the status script, running the snippets of
+// the custom collectors too. Scripts requested over HTTP read the token and
+// the admin actions from headers.
+func (t *ScriptTemplate) Render(token string, overHTTP bool, collectors []CustomCollectorConfig) (string, error) {
+	sections := payloadSections
+	if len(collectors) > 0 {
+		sections = append(sections, customSection(collectors))
+	}
+
+	data := scriptData{
+		Token:      token,
+		TokenVar:   scriptTokenParam,
+		Sections:   sections,
+		Collectors: collectors,
+		Actions:    scriptActions,
+		ActionVar:  scriptActionParam,
+		ArgsVar:    scriptArgsParam,
+	}
+	if overHTTP {
+		data.TokenVar = scriptTokenVar
+		data.ActionVar = scriptActionVar
+		data.ArgsVar = scriptArgsVar
+	}
+
+	var b strings.Builder
+	err := t.template.Execute(&b, data)
+	if err != nil {
+		return "", err
+	}
+
+	return b.String(), nil
+}
+
+// scriptOptions are the settings of the generated status scripts.
+type scriptOptions struct {
+	// Dir is the directory where the script is created.
+	Dir       string
+	Extension string
+	// Docroot, if set, replaces Dir, so that the web servers of http(s)
+	// targets serve the script.
+	Docroot string
+	// Pools are searched for the directories allowed by the pool of each
+	// target.
+	Pools    FPMPools
+	Template *ScriptTemplate
+}
+
+// writeScript creates a status script with the given content as a temporary
+// file in dir, and returns its path.
+func writeScript(dir, ext, content string) (string, error) {
+	file, err := os.CreateTemp(dir, "opcache.*"+ext)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	// The workers of the target, which may run as another user, only need
+	// to read the script, and the directory may be shared.
+	file.Chmod(0644)
+
+	if _, err := file.WriteString(content); err != nil {
+		os.Remove(file.Name())
+		return "", err
+	}
+
+	return file.Name(), nil
+}
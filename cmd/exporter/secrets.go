@@ -0,0 +1,65 @@
+package main
+
+import (
+	"os"
+	"strings"
+)
+
+// secret is a credential given as is, or as the path of a file read whenever
+// it is used, so that secrets mounted by Kubernetes or Docker can be rotated
+// without restarting the exporter, or fetched from Vault.
+type secret struct {
+	value string
+	file  string
+	vault *vaultClient
+	ref   string
+}
+
+// newSecret returns a secret read from the file if its path is given, or
+// else the value.
+func newSecret(value, file string) secret {
+	if len(file) > 0 {
+		return secret{file: file}
+	}
+	return secret{value: value}
+}
+
+// secretFiles returns the secrets read from the files.
+func secretFiles(files []string) []secret {
+	secrets := make([]secret, len(files))
+	for i, file := range files {
+		secrets[i] = secret{file: file}
+	}
+	return secrets
+}
+
+// secretValues returns the secrets of the values.
+func secretValues(values []string) []secret {
+	secrets := make([]secret, len(values))
+	for i, value := range values {
+		secrets[i] = secret{value: value}
+	}
+	return secrets
+}
+
+// IsSet tells whether the secret is given.
+func (s secret) IsSet() bool {
+	return len(s.value) > 0 || len(s.file) > 0 || s.vault != nil
+}
+
+// Get returns the secret, read from its file, without its surrounding
+// whitespace, if it is given as a file, or last fetched from Vault.
+func (s secret) Get() (string, error) {
+	if s.vault != nil {
+		return s.vault.value(s.ref)
+	}
+	if len(s.file) == 0 {
+		return s.value, nil
+	}
+
+	content, err := os.ReadFile(s.file)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(content)), nil
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"sort"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/proto"
+)
+
+// seriesLimiter is a gatherer serving at most limit series per scrape, as a
+// last resort protection of Prometheus against custom collectors or script
+// metrics exploding the number of series.
+type seriesLimiter struct {
+	prometheus.Gatherer
+	limit  int
+	labels []*dto.LabelPair
+}
+
+// limitSeries returns a gatherer serving at most limit series of gatherer
+// per scrape, along with metrics telling whether series were dropped, with
+// the labels, or gatherer itself if limit is 0.
+func limitSeries(gatherer prometheus.Gatherer, limit int, labels prometheus.Labels) prometheus.Gatherer {
+	if limit <= 0 {
+		return gatherer
+	}
+
+	l := &seriesLimiter{Gatherer: gatherer, limit: limit}
+	for name, value := range labels {
+		l.labels = append(l.labels, &dto.LabelPair{Name: proto.String(name), Value: proto.String(value)})
+	}
+	return l
+}
+
+// Gather implements prometheus.Gatherer. The series of the largest metric
+// families are dropped first, so that the many series of dynamic metrics are
+// dropped before the few series of the core ones.
+func (l *seriesLimiter) Gather() ([]*dto.MetricFamily, error) {
+	families, err := l.Gatherer.Gather()
+
+	total := 0
+	largest := 0
+	for _, family := range families {
+		total += len(family.Metric)
+		largest = max(largest, len(family.Metric))
+	}
+
+	dropped := 0
+	if total > l.limit {
+		// The largest number of series kept per family which fits the
+		// limit, the series left being kept from the first families.
+		keptWith := func(n int) int {
+			kept := 0
+			for _, family := range families {
+				kept += min(len(family.Metric), n)
+			}
+			return kept
+		}
+		perFamily := sort.Search(largest+1, func(n int) bool { return keptWith(n) > l.limit }) - 1
+		left := l.limit - keptWith(perFamily)
+
+		kept := families[:0]
+		for _, family := range families {
+			n := perFamily
+			if len(family.Metric) > n && left > 0 {
+				n++
+				left--
+			}
+			if len(family.Metric) > n {
+				dropped += len(family.Metric) - n
+				family.Metric = family.Metric[:n]
+			}
+			if len(family.Metric) > 0 {
+				kept = append(kept, family)
+			}
+		}
+		families = kept
+	}
+
+	families = append(families,
+		l.gauge("opcache_exporter_series_truncated", "Whether series were dropped from the last scrape to keep it under the maximum number of series.", boolMetric(dropped > 0)),
+		l.gauge("opcache_exporter_series_dropped", "Number of series dropped from the last scrape to keep it under the maximum number of series.", float64(dropped)),
+	)
+	sort.Slice(families, func(i, j int) bool { return families[i].GetName() < families[j].GetName() })
+	return families, err
+}
+
+func (l *seriesLimiter) gauge(name, help string, value float64) *dto.MetricFamily {
+	return &dto.MetricFamily{
+		Name: proto.String(name),
+		Help: proto.String(help),
+		Type: dto.MetricType_GAUGE.Enum(),
+		Metric: []*dto.Metric{{
+			Label: l.labels,
+			Gauge: &dto.Gauge{Value: proto.Float64(value)},
+		}},
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"hash/fnv"
+	"net/http"
+	"path"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// targetShards spreads the targets of the exporter over shards served at
+// their own path, so that a scrape only collects the targets of one shard and
+// only holds their metrics in memory.
+type targetShards struct {
+	shards []*targetShard
+}
+
+// targetShard collects its targets with a bounded number of goroutines, or
+// all of them in parallel if workers is 0.
+type targetShard struct {
+	targets []*Exporter
+	workers int
+}
+
+// newTargetShards returns count shards collecting at most workers targets in
+// parallel, or nil if count is 0.
+func newTargetShards(count, workers int) *targetShards {
+	if count < 1 {
+		return nil
+	}
+
+	s := &targetShards{shards: make([]*targetShard, count)}
+	for i := range s.shards {
+		s.shards[i] = &targetShard{workers: max(workers, 1)}
+	}
+	return s
+}
+
+// add assigns the target to a shard by hashing its URI. The low bits of FNV
+// hashes only depend on the low bits of the input, so the high bits of a
+// 64-bit hash are used: the targets of a cluster shard, sharing the low bits
+// of their 32-bit hash, are still spread over all the shards.
+func (s *targetShards) add(e *Exporter) {
+	h := fnv.New64a()
+	h.Write([]byte(e.Target()))
+	shard := s.shards[(h.Sum64()>>32)%uint64(len(s.shards))]
+	shard.targets = append(shard.targets, e)
+}
+
+// handler serves the metrics of the shard whose index ends the path of the
+// request, such as /metrics/shards/3, at most maxSeries of them if not 0,
+// collected within the budget of the scrape.
+func (s *targetShards) handler(labels prometheus.Labels, opts promhttp.HandlerOpts, maxSeries int, budget *ScrapeBudget) http.Handler {
+	handlers := make([]http.Handler, len(s.shards))
+	for i, shard := range s.shards {
+		handlers[i] = scrapeHandler(func(ctx context.Context) prometheus.Gatherer {
+			return limitSeries(shard.gatherer(ctx, labels), maxSeries, labels)
+		}, budget, opts)
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		index, err := strconv.Atoi(path.Base(r.URL.Path))
+		if err != nil || index < 0 || index >= len(handlers) {
+			http.NotFound(w, r)
+			return
+		}
+		handlers[index].ServeHTTP(w, r)
+	})
+}
+
+// gatherers returns the gatherers of the metrics of the shards, collected
+// with ctx.
+func (s *targetShards) gatherers(ctx context.Context, labels prometheus.Labels) []prometheus.Gatherer {
+	gatherers := make([]prometheus.Gatherer, len(s.shards))
+	for i, shard := range s.shards {
+		gatherers[i] = shard.gatherer(ctx, labels)
+	}
+	return gatherers
+}
+
+// Collector returns a collector exporting the number of targets of each
+// shard.
+func (s *targetShards) Collector() prometheus.Collector {
+	targets := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "opcache_exporter",
+		Name:      "metrics_shard_targets",
+		Help:      "Number of targets of each shard of the metrics.",
+	}, []string{"shard"})
+	for i, shard := range s.shards {
+		targets.WithLabelValues(strconv.Itoa(i)).Set(float64(len(shard.targets)))
+	}
+	return targets
+}
+
+// gatherer returns a gatherer of the metrics of the targets of the shard,
+// collected with the context of a scrape.
+func (s *targetShard) gatherer(ctx context.Context, labels prometheus.Labels) prometheus.Gatherer {
+	registry := prometheus.NewRegistry()
+	prometheus.WrapRegistererWith(labels, registry).MustRegister(shardScrape{s, ctx})
+	return registry
+}
+
+// shardScrape collects the targets of a shard for a scrape. It describes no
+// metric, so that every scrape does not describe all the targets again: the
+// registry still checks the consistency of the collected metrics.
+type shardScrape struct {
+	shard *targetShard
+	ctx   context.Context
+}
+
+// Describe implements prometheus.Collector.
+func (s shardScrape) Describe(ch chan<- *prometheus.Desc) {}
+
+// Collect implements prometheus.Collector. The workers collecting several
+// targets in turn give each one an equal share of the time left before the
+// deadline of the scrape.
+func (s shardScrape) Collect(ch chan<- prometheus.Metric) {
+	targets := make(chan *Exporter)
+	workers := len(s.shard.targets)
+	if s.shard.workers > 0 {
+		workers = min(s.shard.workers, workers)
+	}
+	var pending atomic.Int64
+	pending.Store(int64(len(s.shard.targets)))
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for e := range targets {
+				left := int(pending.Add(-1)) + 1
+				ctx, cancel := shareContext(s.ctx, (left+workers-1)/workers)
+				e.collectContext(ctx, ch)
+				cancel()
+			}
+		}()
+	}
+
+	for _, e := range s.shard.targets {
+		targets <- e
+	}
+	close(targets)
+	wg.Wait()
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"maps"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+)
+
+// targetState is the state derived from the scrapes of a target, persisted
+// so that the counters and watermarks exported from it survive restarts of
+// the exporter.
+type targetState struct {
+	Scraped                      bool               `json:"scraped"`
+	LastCacheFull                bool               `json:"last_cache_full"`
+	LastHitRate                  float64            `json:"last_hit_rate"`
+	LastStatistics               OPcacheStatistics  `json:"last_statistics"`
+	ObservedEvictions            float64            `json:"observed_evictions"`
+	ObservedKeyEvictions         float64            `json:"observed_key_evictions"`
+	MaxUsedMemory                int64              `json:"max_used_memory"`
+	MaxWastedPercentage          float64            `json:"max_wasted_percentage"`
+	MinInternedStringsFreeMemory int64              `json:"min_interned_strings_free_memory"`
+	AutoResets                   float64            `json:"auto_resets"`
+	AutoResetsSuppressed         float64            `json:"auto_resets_suppressed"`
+	Panics                       float64            `json:"panics"`
+	DeadlineExceeded             float64            `json:"deadline_exceeded"`
+	ScrapeErrors                 map[string]float64 `json:"scrape_errors"`
+}
+
+// StateStore persists the state of the targets to a file, by target.
+type StateStore struct {
+	path     string
+	interval time.Duration
+	logger   log.Logger
+
+	mutex  sync.Mutex
+	states map[string]targetState
+}
+
+// NewStateStore returns a StateStore saving the state of the targets to path
+// every interval, or nil if path is empty.
+func NewStateStore(path string, interval time.Duration, logger log.Logger) *StateStore {
+	if path == "" {
+		return nil
+	}
+
+	s := &StateStore{
+		path:     path,
+		interval: interval,
+		logger:   logger,
+		states:   map[string]targetState{},
+	}
+
+	content, err := os.ReadFile(path)
+	if err == nil {
+		err = json.Unmarshal(content, &s.states)
+	}
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		level.Error(logger).Log("msg", "Error loading state", "path", path, "err", err)
+	}
+
+	return s
+}
+
+// restore restores the saved state of the target, if any. It is safe to call
+// on a nil StateStore.
+func (s *StateStore) restore(e *Exporter) {
+	if s == nil {
+		return
+	}
+
+	s.mutex.Lock()
+	state, ok := s.states[e.target]
+	s.mutex.Unlock()
+	if !ok {
+		return
+	}
+
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.scraped = state.Scraped
+	e.lastCacheFull = state.LastCacheFull
+	e.lastHitRate = state.LastHitRate
+	e.lastStatistics = state.LastStatistics
+	e.observedEvictions = state.ObservedEvictions
+	e.observedKeyEvictions = state.ObservedKeyEvictions
+	e.maxUsedMemory = state.MaxUsedMemory
+	e.maxWastedPercentage = state.MaxWastedPercentage
+	e.minInternedStringsFreeMemory = state.MinInternedStringsFreeMemory
+	e.autoResets = state.AutoResets
+	e.autoResetsSuppressed = state.AutoResetsSuppressed
+	e.panics = state.Panics
+	e.deadlineExceeded = state.DeadlineExceeded
+	for class, count := range state.ScrapeErrors {
+		e.scrapeErrors[class] = count
+	}
+}
+
+// run saves the state of the targets every interval. It never returns.
+func (s *StateStore) run(exporters []*Exporter) {
+	for {
+		time.Sleep(s.interval)
+		s.save(exporters)
+	}
+}
+
+// save saves the state of the targets, keeping the saved state of the
+// targets collected by other instances or shards. It is safe to call on a nil
+// StateStore.
+func (s *StateStore) save(exporters []*Exporter) {
+	if s == nil {
+		return
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, e := range exporters {
+		e.mutex.RLock()
+		if e.polled {
+			s.states[e.target] = targetState{
+				Scraped:                      e.scraped,
+				LastCacheFull:                e.lastCacheFull,
+				LastHitRate:                  e.lastHitRate,
+				LastStatistics:               e.lastStatistics,
+				ObservedEvictions:            e.observedEvictions,
+				ObservedKeyEvictions:         e.observedKeyEvictions,
+				MaxUsedMemory:                e.maxUsedMemory,
+				MaxWastedPercentage:          e.maxWastedPercentage,
+				MinInternedStringsFreeMemory: e.minInternedStringsFreeMemory,
+				AutoResets:                   e.autoResets,
+				AutoResetsSuppressed:         e.autoResetsSuppressed,
+				Panics:                       e.panics,
+				DeadlineExceeded:             e.deadlineExceeded,
+				ScrapeErrors:                 maps.Clone(e.scrapeErrors),
+			}
+		}
+		e.mutex.RUnlock()
+	}
+
+	if err := s.persist(); err != nil {
+		level.Error(s.logger).Log("msg", "Error persisting state", "path", s.path, "err", err)
+	}
+}
+
+func (s *StateStore) persist() error {
+	content, err := json.Marshal(s.states)
+	if err != nil {
+		return err
+	}
+
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, content, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
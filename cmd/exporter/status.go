@@ -1,14 +1,98 @@
 package main
 
+import (
+	"encoding/json"
+	"sort"
+	"time"
+)
+
+// Payload contains the composite document echoed by the generated status
+// script
+type Payload struct {
+	Status *OPcacheStatus             `json:"status"`
+	Custom map[string]json.RawMessage `json:"custom"`
+	// Scripts are moved to the status once decoded.
+	Scripts       Scripts               `json:"scripts"`
+	ScriptFiles   *ScriptFiles          `json:"script_files"`
+	Configuration *OPcacheConfiguration `json:"configuration"`
+	PHP           *PHPInfo              `json:"php"`
+	FileCache     *FileCacheUsage       `json:"file_cache_usage"`
+	RealpathCache *RealpathCacheUsage   `json:"realpath_cache"`
+	// Errors are the messages of the sections which failed, by key.
+	Errors map[string]string `json:"errors"`
+	// ExecutionSeconds is the time taken by PHP to run the script, as
+	// measured by the script itself.
+	ExecutionSeconds *float64 `json:"execution_seconds"`
+
+	// aggregates are the metrics of the scripts streamed from the payload
+	// of scrapes, instead of Scripts.
+	aggregates *scriptAggregates
+
+	// raw is the document returned by the target, without the scripts
+	// streamed into the aggregates unless JSON mappings need them.
+	raw []byte
+	// fetchDuration is the duration of the request of the payload, and of
+	// the decoding of streamed payloads.
+	fetchDuration time.Duration
+}
+
+// ScriptFiles are found by the status script from the files of the cached
+// scripts, as OPcache only reports their timestamps with
+// opcache.validate_timestamps.
+type ScriptFiles struct {
+	// Oldest and Newest are the modification times of the files, unless none
+	// was found.
+	Oldest *int64 `json:"oldest"`
+	Newest *int64 `json:"newest"`
+	// ModifiedSinceRestart counts the files modified after OPcache last
+	// started or restarted.
+	ModifiedSinceRestart int64 `json:"modified_since_restart"`
+}
+
+// PHPInfo contains the versions of PHP, of its Zend Engine and of the
+// OPcache extension
+type PHPInfo struct {
+	Version string `json:"version"`
+	Zend    string `json:"zend"`
+	OPcache string `json:"opcache"`
+}
+
 // OPcacheStatus contains information about OPcache
 type OPcacheStatus struct {
-	OPcacheEnabled       bool                 `json:"opcache_enabled"`
-	CacheFull            bool                 `json:"cache_full"`
+	OPcacheEnabled bool `json:"opcache_enabled"`
+	CacheFull      bool `json:"cache_full"`
+	// FileCacheOnly is set when scripts are only cached in opcache.file_cache,
+	// the memory usage and statistics being left out.
+	FileCacheOnly        bool                 `json:"file_cache_only"`
 	RestartPending       bool                 `json:"restart_pending"`
 	RestartInProgress    bool                 `json:"restart_in_progress"`
 	MemoryUsage          MemoryUsage          `json:"memory_usage"`
 	InternedStringsUsage InternedStringsUsage `json:"interned_strings_usage"`
 	OPcacheStatistics    OPcacheStatistics    `json:"opcache_statistics"`
+	// JIT is only reported by PHP 8 and later, and PreloadStatistics by
+	// PHP 7.4 and later when opcache.preload is set.
+	JIT               *JITStatus         `json:"jit"`
+	PreloadStatistics *PreloadStatistics `json:"preload_statistics"`
+	Scripts           Scripts            `json:"scripts"`
+}
+
+// PreloadStatistics contains information about the scripts preloaded by
+// opcache.preload
+type PreloadStatistics struct {
+	MemoryConsumption int64    `json:"memory_consumption"`
+	Functions         []string `json:"functions"`
+	Classes           []string `json:"classes"`
+	Scripts           []string `json:"scripts"`
+}
+
+// JITStatus contains information about the JIT compiler of PHP 8
+type JITStatus struct {
+	Enabled    bool  `json:"enabled"`
+	On         bool  `json:"on"`
+	Kind       int64 `json:"kind"`
+	OptLevel   int64 `json:"opt_level"`
+	BufferSize int64 `json:"buffer_size"`
+	BufferFree int64 `json:"buffer_free"`
 }
 
 // MemoryUsage contains information about OPcache memory usage
@@ -43,3 +127,44 @@ type OPcacheStatistics struct {
 	BlacklistMissRatio float64 `json:"blacklist_miss_ratio"`
 	OPcacheHitRate     float64 `json:"opcache_hit_rate"`
 }
+
+// Script contains information about a single cached script
+type Script struct {
+	FullPath          string `json:"full_path"`
+	Hits              int64  `json:"hits"`
+	MemoryConsumption int64  `json:"memory_consumption"`
+	LastUsedTimestamp int64  `json:"last_used_timestamp"`
+	Timestamp         int64  `json:"timestamp"`
+}
+
+// Scripts contains the cached scripts, indexed by their full path
+type Scripts map[string]Script
+
+// UnmarshalJSON decodes the scripts list, which PHP encodes as an empty
+// array instead of an object when no script is cached.
+func (s *Scripts) UnmarshalJSON(data []byte) error {
+	if string(data) == "[]" {
+		*s = Scripts{}
+		return nil
+	}
+
+	scripts := map[string]Script{}
+	if err := json.Unmarshal(data, &scripts); err != nil {
+		return err
+	}
+
+	*s = scripts
+	return nil
+}
+
+// Sorted returns the cached scripts ordered by full path
+func (s Scripts) Sorted() []Script {
+	scripts := make([]Script, 0, len(s))
+	for _, script := range s {
+		scripts = append(scripts, script)
+	}
+	sort.Slice(scripts, func(i, j int) bool {
+		return scripts[i].FullPath < scripts[j].FullPath
+	})
+	return scripts
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// TargetFragment is a YAML file of the --config.dir directory, defining
+// targets, such as the pools of an application shipping its own monitoring
+// snippet.
+type TargetFragment struct {
+	// Targets are the URIs of the targets.
+	Targets []string `yaml:"targets"`
+	// Labels are added to the metrics of the targets, unless they are set
+	// in the fragment of their URI.
+	Labels map[string]string `yaml:"labels"`
+}
+
+// parseTargets returns the URIs of the targets given to --opcache.fcgi-uri,
+// separated by semicolons or newlines, or read from stdin if it is "-", one
+// per line. Empty lines and lines starting with # are ignored, so that
+// inventories generated by provisioning tools can be used as is.
+func parseTargets(fcgiURI string, stdin io.Reader) ([]string, error) {
+	if fcgiURI == "-" {
+		content, err := io.ReadAll(stdin)
+		if err != nil {
+			return nil, err
+		}
+		fcgiURI = string(content)
+	}
+
+	var targets []string
+	scanner := bufio.NewScanner(strings.NewReader(fcgiURI))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		for _, uri := range strings.Split(line, ";") {
+			if uri = strings.TrimSpace(uri); len(uri) > 0 {
+				targets = append(targets, uri)
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(targets) == 0 {
+		return nil, errors.New("no target given")
+	}
+	return targets, nil
+}
+
+// loadTargetFragments returns the targets defined by the .yml and .yaml files
+// of the directory, in the order of their names, with the labels of their
+// file added to the fragment of their URI. An empty path results in no
+// target.
+func loadTargetFragments(dir string) ([]string, error) {
+	if dir == "" {
+		return nil, nil
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var targets []string
+	for _, entry := range entries {
+		if entry.IsDir() || (filepath.Ext(entry.Name()) != ".yml" && filepath.Ext(entry.Name()) != ".yaml") {
+			continue
+		}
+		path := filepath.Join(dir, entry.Name())
+
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		var fragment TargetFragment
+		if err := yaml.Unmarshal(content, &fragment); err != nil {
+			return nil, fmt.Errorf("parsing %s: %w", path, err)
+		}
+
+		for _, target := range fragment.Targets {
+			uri, err := fragment.labeled(target)
+			if err != nil {
+				return nil, fmt.Errorf("validating %s: %w", path, err)
+			}
+			targets = append(targets, uri)
+		}
+	}
+	return targets, nil
+}
+
+// labeled adds the labels of the fragment to the fragment of the URI of the
+// target.
+func (f TargetFragment) labeled(target string) (string, error) {
+	uri, labels, _ := strings.Cut(target, "#")
+
+	set := map[string]bool{}
+	var pairs []string
+	if len(labels) > 0 {
+		pairs = strings.Split(labels, ",")
+		for _, pair := range pairs {
+			name, _, _ := strings.Cut(pair, "=")
+			set[name] = true
+		}
+	}
+
+	names := make([]string, 0, len(f.Labels))
+	for name := range f.Labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		value := f.Labels[name]
+		if strings.ContainsAny(value, ",=") {
+			return "", fmt.Errorf("invalid value %q of label %q", value, name)
+		}
+		if !set[name] {
+			pairs = append(pairs, name+"="+value)
+		}
+	}
+
+	if len(pairs) == 0 {
+		return uri, nil
+	}
+	return uri + "#" + strings.Join(pairs, ","), nil
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// ScrapeTracer attaches the trace ID of traced scrapes, propagated by
+// Prometheus in their W3C traceparent header, as exemplars of the latency
+// histograms.
+type ScrapeTracer struct {
+	duration prometheus.Histogram
+	// current is the trace ID of the last traced scrape. Collectors have no
+	// access to the request they are collected for, so with concurrent
+	// scrapes the exemplars may link to the trace of another one.
+	current atomic.Value
+}
+
+// NewScrapeTracer returns a ScrapeTracer, or nil if exemplars are disabled.
+func NewScrapeTracer(enabled bool) *ScrapeTracer {
+	if !enabled {
+		return nil
+	}
+
+	t := &ScrapeTracer{
+		duration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: "exporter",
+			Name:      "scrape_duration_seconds",
+			Help:      "Histogram of the duration of scrapes of the exporter.",
+		}),
+	}
+	t.current.Store("")
+	return t
+}
+
+// Describe implements prometheus.Collector.
+func (t *ScrapeTracer) Describe(ch chan<- *prometheus.Desc) {
+	t.duration.Describe(ch)
+}
+
+// Collect implements prometheus.Collector.
+func (t *ScrapeTracer) Collect(ch chan<- prometheus.Metric) {
+	t.duration.Collect(ch)
+}
+
+// Wrap returns a handler recording the trace ID and the duration of the
+// scrapes served by next.
+func (t *ScrapeTracer) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := traceID(r)
+		if len(id) > 0 {
+			t.current.Store(id)
+		}
+
+		start := time.Now()
+		next.ServeHTTP(w, r)
+		observeWithTrace(t.duration, time.Since(start).Seconds(), id)
+	})
+}
+
+// TraceID returns the trace ID of the last traced scrape. It is safe to call
+// on a nil ScrapeTracer.
+func (t *ScrapeTracer) TraceID() string {
+	if t == nil {
+		return ""
+	}
+	return t.current.Load().(string)
+}
+
+// traceID returns the trace ID of the traceparent header of a request, or an
+// empty string if it is missing or invalid.
+func traceID(r *http.Request) string {
+	parts := strings.Split(r.Header.Get("traceparent"), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || len(parts[1]) != 32 {
+		return ""
+	}
+
+	id := strings.ToLower(parts[1])
+	if strings.Trim(id, "0") == "" || strings.Trim(id, "0123456789abcdef") != "" {
+		return ""
+	}
+	return id
+}
+
+// observeWithTrace observes a value, with the trace ID as exemplar if any.
+func observeWithTrace(observer prometheus.Observer, value float64, traceID string) {
+	if len(traceID) > 0 {
+		if exemplarObserver, ok := observer.(prometheus.ExemplarObserver); ok {
+			exemplarObserver.ObserveWithExemplar(value, prometheus.Labels{"trace_id": traceID})
+			return
+		}
+	}
+	observer.Observe(value)
+}
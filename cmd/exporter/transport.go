@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// scriptTokenHeader carries the random token expected by the generated
+	// script, which reads it from scriptTokenVar over HTTP, and from
+	// scriptTokenParam over the other protocols.
+	scriptTokenHeader = "X-OPcache-Exporter-Token"
+	scriptTokenVar    = "HTTP_X_OPCACHE_EXPORTER_TOKEN"
+	scriptTokenParam  = "OPCACHE_EXPORTER_TOKEN"
+
+	// scriptActionHeader selects the admin action run by the generated
+	// script, instead of echoing the payload, with the JSON arguments given
+	// by scriptArgsHeader. Like the token, they are passed as parameters
+	// over the protocols without headers.
+	scriptActionHeader = "X-OPcache-Exporter-Action"
+	scriptActionVar    = "HTTP_X_OPCACHE_EXPORTER_ACTION"
+	scriptActionParam  = "OPCACHE_EXPORTER_ACTION"
+	scriptArgsHeader   = "X-OPcache-Exporter-Args"
+	scriptArgsVar      = "HTTP_X_OPCACHE_EXPORTER_ARGS"
+	scriptArgsParam    = "OPCACHE_EXPORTER_ARGS"
+
+	// scriptSkipHeader lists the collectors skipped by the generated script.
+	scriptSkipHeader = "X-OPcache-Exporter-Skip"
+	scriptSkipVar    = "HTTP_X_OPCACHE_EXPORTER_SKIP"
+)
+
+// scriptParams are the parameters passed instead of the HTTP_* server
+// variables of headers over the protocols without headers. Unlike headers,
+// clients of the web server in front of the target cannot set them.
+var scriptParams = map[string]string{
+	scriptTokenHeader:  scriptTokenParam,
+	scriptActionHeader: scriptActionParam,
+	scriptArgsHeader:   scriptArgsParam,
+}
+
+var httpClient = &http.Client{Timeout: 10 * time.Second}
+
+// errorOutputLimit is the length of the output of failed requests read for
+// their error messages.
+const errorOutputLimit = 64 << 10
+
+// fetch runs the status script on the target, falling back to its backup
+// endpoint if it has one, and returns its output.
+func (e *Exporter) fetch(headers map[string]string) ([]byte, error) {
+	content, _, err := e.fetchServed(context.Background(), headers)
+	return content, err
+}
+
+// openFrom runs the status script on an endpoint of the target, using the
+// protocol given by the scheme of its URI, before the deadline of the context
+// if it has one, and returns the reader of its output, which must be closed.
+// The headers are passed to the script as HTTP_* server variables by
+// protocols without headers.
+func (e *Exporter) openFrom(ctx context.Context, ep *endpoint, headers map[string]string) (io.ReadCloser, error) {
+	var content []byte
+	var err error
+	switch ep.uri.Scheme {
+	case "lsapi":
+		content, err = fetchLSAPI(ctx, "tcp", ep.uri.Host, e.scriptPath, e.requestParams(headers))
+	case "lsapi+unix":
+		content, err = fetchLSAPI(ctx, "unix", ep.uri.Path, e.scriptPath, e.requestParams(headers))
+	case "uwsgi":
+		content, err = fetchUWSGI(ctx, "tcp", ep.uri.Host, e.scriptPath, e.requestParams(headers))
+	case "uwsgi+unix":
+		content, err = fetchUWSGI(ctx, "unix", ep.uri.Path, e.scriptPath, e.requestParams(headers))
+	case "http", "https":
+		return e.openHTTP(ctx, ep, headers)
+	case "file":
+		return os.Open(ep.uri.Path)
+	default:
+		return e.openFCGI(ctx, ep, e.requestParams(headers))
+	}
+	if err != nil {
+		return nil, err
+	}
+	return io.NopCloser(bytes.NewReader(content)), nil
+}
+
+// scriptTransports tells whether the endpoints of a target request the
+// script over HTTP, and over the protocols passing parameters instead.
+func scriptTransports(rawUri string) (overHTTP, overParams bool) {
+	primary, backup := splitBackup(rawUri)
+	for _, raw := range []string{primary, backup} {
+		if len(raw) == 0 {
+			continue
+		}
+		// Invalid URIs are reported when the target is created.
+		uri, err := url.Parse(normalizeURI(raw))
+		if err != nil {
+			continue
+		}
+		switch uri.Scheme {
+		case "http", "https":
+			overHTTP = true
+		case "file":
+		default:
+			overParams = true
+		}
+	}
+	return overHTTP, overParams
+}
+
+// requestParams returns the extra parameters of a request, with the token of
+// the script and the headers converted to server variables.
+func (e *Exporter) requestParams(headers map[string]string) map[string]string {
+	if len(headers) == 0 && e.scriptToken == "" {
+		return e.params
+	}
+
+	params := make(map[string]string, len(e.params)+len(headers)+1)
+	for key, value := range e.params {
+		params[key] = value
+	}
+	if e.scriptToken != "" {
+		params[scriptTokenParam] = e.scriptToken
+	}
+	for name, value := range headers {
+		if param, ok := scriptParams[name]; ok {
+			params[param] = value
+			continue
+		}
+		params["HTTP_"+strings.ToUpper(strings.ReplaceAll(name, "-", "_"))] = value
+	}
+	return params
+}
+
+// openFCGI runs the script on a FastCGI server, with the extra parameters in
+// its environment, and returns the reader of its output.
+func (e *Exporter) openFCGI(ctx context.Context, ep *endpoint, params map[string]string) (io.ReadCloser, error) {
+	env := [][2]string{{"SCRIPT_FILENAME", e.scriptPath}}
+
+	var body []byte
+	if len(e.requestBody) > 0 {
+		body = []byte(e.requestBody)
+		env = append(env,
+			[2]string{"REQUEST_METHOD", "POST"},
+			[2]string{"CONTENT_TYPE", e.requestContentType},
+			[2]string{"CONTENT_LENGTH", strconv.Itoa(len(body))},
+		)
+	} else {
+		env = append(env, [2]string{"REQUEST_METHOD", "GET"}, [2]string{"CONTENT_LENGTH", "0"})
+	}
+
+	resp, err := ep.fcgi.Do(ctx, appendParams(env, params), body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Status == http.StatusOK {
+		return resp.Body, nil
+	}
+	defer resp.Body.Close()
+
+	output, err := io.ReadAll(io.LimitReader(resp.Body, errorOutputLimit))
+	if err != nil {
+		return nil, err
+	}
+
+	// PHP-FPM answers "Access denied." to scripts whose extension is not
+	// listed in the security.limit_extensions setting of the pool.
+	if bytes.Equal(bytes.TrimSpace(output), []byte("Access denied.")) {
+		return nil, &limitExtensionsError{scriptPath: e.scriptPath}
+	}
+
+	message := strings.TrimSpace(resp.Body.Stderr())
+	if len(message) == 0 {
+		message = strings.TrimSpace(string(output))
+	}
+	return nil, &statusError{status: strconv.Itoa(resp.Status), message: message}
+}
+
+// openHTTP requests the script from a web server, the target URI being the
+// URL of the directory where it is deployed, and returns the reader of its
+// output.
+func (e *Exporter) openHTTP(ctx context.Context, ep *endpoint, headers map[string]string) (io.ReadCloser, error) {
+	script := e.scriptPath
+	if len(e.httpScript) > 0 {
+		script = e.httpScript
+	}
+	scriptURL := *ep.uri
+	scriptURL.Path = path.Join("/", scriptURL.Path, path.Base(script))
+
+	var req *http.Request
+	var err error
+	if len(e.requestBody) > 0 {
+		req, err = http.NewRequestWithContext(ctx, http.MethodPost, scriptURL.String(), strings.NewReader(e.requestBody))
+		if err == nil {
+			req.Header.Set("Content-Type", e.requestContentType)
+		}
+	} else {
+		req, err = http.NewRequestWithContext(ctx, http.MethodGet, scriptURL.String(), nil)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if e.scriptToken != "" {
+		req.Header.Set(scriptTokenHeader, e.scriptToken)
+	}
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusOK {
+		return resp.Body, nil
+	}
+	defer resp.Body.Close()
+
+	output, err := io.ReadAll(io.LimitReader(resp.Body, errorOutputLimit))
+	if err != nil {
+		return nil, err
+	}
+	return nil, &statusError{status: resp.Status, message: string(output)}
+}
+
+// appendParams appends the extra parameters to an environment, sorted by
+// name, except those it already defines.
+func appendParams(env [][2]string, params map[string]string) [][2]string {
+	defined := make(map[string]bool, len(env))
+	for _, kv := range env {
+		defined[kv[0]] = true
+	}
+
+	keys := make([]string, 0, len(params))
+	for key := range params {
+		if !defined[key] {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		env = append(env, [2]string{key, params[key]})
+	}
+	return env
+}
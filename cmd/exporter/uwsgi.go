@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"path/filepath"
+	"time"
+)
+
+const (
+	// uwsgiModifierPHP routes requests to the uWSGI PHP plugin.
+	uwsgiModifierPHP = 14
+
+	uwsgiTimeout = 10 * time.Second
+)
+
+// fetchUWSGI runs the script on a uWSGI server through its PHP plugin, with
+// the extra parameters in its environment, and returns its output. The plugin
+// resolves scripts relative to the document root, so the script directory is
+// used as such.
+func fetchUWSGI(ctx context.Context, network, address, scriptPath string, params map[string]string) ([]byte, error) {
+	scriptName := "/" + filepath.Base(scriptPath)
+
+	request, err := uwsgiRequest(appendParams([][2]string{
+		{"REQUEST_METHOD", "GET"},
+		{"SERVER_PROTOCOL", "HTTP/1.0"},
+		{"REQUEST_URI", scriptName},
+		{"QUERY_STRING", ""},
+		{"PATH_INFO", scriptName},
+		{"SCRIPT_NAME", scriptName},
+		{"SCRIPT_FILENAME", scriptPath},
+		{"DOCUMENT_ROOT", filepath.Dir(scriptPath)},
+	}, params))
+	if err != nil {
+		return nil, err
+	}
+
+	deadline := connDeadline(ctx, uwsgiTimeout)
+	dialer := net.Dialer{Deadline: deadline}
+	conn, err := dialer.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(deadline)
+
+	if _, err := conn.Write(request); err != nil {
+		return nil, err
+	}
+
+	return uwsgiReadResponse(bufio.NewReader(conn))
+}
+
+// uwsgiReadResponse reads the HTTP response of the PHP plugin, and returns
+// its body.
+func uwsgiReadResponse(r *bufio.Reader) ([]byte, error) {
+	resp, err := http.ReadResponse(r, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("uwsgi: unexpected status %s: %s", resp.Status, body)
+	}
+
+	return body, nil
+}
+
+// uwsgiRequest builds a uwsgi packet carrying the given variables.
+func uwsgiRequest(vars [][2]string) ([]byte, error) {
+	var data []byte
+	for _, kv := range vars {
+		data = binary.LittleEndian.AppendUint16(data, uint16(len(kv[0])))
+		data = append(data, kv[0]...)
+		data = binary.LittleEndian.AppendUint16(data, uint16(len(kv[1])))
+		data = append(data, kv[1]...)
+	}
+
+	if len(data) > 0xffff {
+		return nil, errors.New("uwsgi: request too large")
+	}
+
+	header := []byte{uwsgiModifierPHP, 0, 0, 0}
+	binary.LittleEndian.PutUint16(header[1:], uint16(len(data)))
+
+	return append(header, data...), nil
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"strings"
+	"testing"
+)
+
+// TestUWSGIRequest checks that the variables are encoded in the packet,
+// routed to the PHP plugin.
+func TestUWSGIRequest(t *testing.T) {
+	vars := [][2]string{
+		{"REQUEST_METHOD", "GET"},
+		{"SCRIPT_FILENAME", "/app/status.php"},
+		{"QUERY_STRING", ""},
+		{"OPCACHE_EXPORTER_TOKEN", strings.Repeat("t", 300)},
+	}
+	buf, err := uwsgiRequest(vars)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if buf[0] != uwsgiModifierPHP || buf[3] != 0 {
+		t.Errorf("got modifiers %d and %d, want %d and 0", buf[0], buf[3], uwsgiModifierPHP)
+	}
+	if length := binary.LittleEndian.Uint16(buf[1:]); int(length) != len(buf)-4 {
+		t.Errorf("got packet length %d, want %d", length, len(buf)-4)
+	}
+
+	data := buf[4:]
+	for _, kv := range vars {
+		for _, want := range kv {
+			length := int(binary.LittleEndian.Uint16(data))
+			if got := string(data[2 : 2+length]); got != want {
+				t.Fatalf("got %q, want %q", got, want)
+			}
+			data = data[2+length:]
+		}
+	}
+	if len(data) > 0 {
+		t.Errorf("got %d bytes after the variables", len(data))
+	}
+
+	if _, err := uwsgiRequest(append(vars, [2]string{"LARGE", strings.Repeat("x", 0xffff)})); err == nil {
+		t.Error("no error for a request too large")
+	}
+}
+
+// TestUWSGIReadResponse checks that the body of the responses of the PHP
+// plugin is read however it is delimited, and that failed requests are
+// reported with their body.
+func TestUWSGIReadResponse(t *testing.T) {
+	tests := []struct {
+		name     string
+		response string
+		body     string
+		err      string
+	}{
+		{
+			name:     "body until the end of the connection",
+			response: "HTTP/1.0 200 OK\r\nContent-Type: application/json\r\n\r\n{\"status\":{}}",
+			body:     `{"status":{}}`,
+		},
+		{
+			name:     "content length",
+			response: "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\n{}ignored",
+			body:     `{}`,
+		},
+		{
+			name:     "chunked",
+			response: "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\na\r\n{\"status\":\r\n3\r\n{}}\r\n0\r\n\r\n",
+			body:     `{"status":{}}`,
+		},
+		{
+			name:     "error status",
+			response: "HTTP/1.0 404 Not Found\r\n\r\nFile not found.",
+			err:      "uwsgi: unexpected status 404 Not Found: File not found.",
+		},
+		{
+			name:     "truncated body",
+			response: "HTTP/1.1 200 OK\r\nContent-Length: 20\r\n\r\n{\"status\":",
+			err:      io.ErrUnexpectedEOF.Error(),
+		},
+		{
+			name:     "not HTTP",
+			response: "{\"status\":{}}",
+			err:      `malformed HTTP response "{\"status\":{}}"`,
+		},
+		{
+			name:     "empty",
+			response: "",
+			err:      io.ErrUnexpectedEOF.Error(),
+		},
+	}
+	for _, test := range tests {
+		body, err := uwsgiReadResponse(bufio.NewReader(strings.NewReader(test.response)))
+		if len(test.err) > 0 {
+			if err == nil || err.Error() != test.err {
+				t.Errorf("%s: got error %v, want %s", test.name, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if string(body) != test.body {
+			t.Errorf("%s: got body %q, want %q", test.name, body, test.body)
+		}
+	}
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+)
+
+// vaultKubernetesToken is the service account token used to log in to Vault
+// with the Kubernetes auth method.
+const vaultKubernetesToken = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+
+var vaultHTTPClient = &http.Client{Timeout: 10 * time.Second}
+
+// vaultClient fetches secrets from HashiCorp Vault, and refreshes them
+// periodically along with its token.
+type vaultClient struct {
+	config *VaultConfig
+	logger log.Logger
+
+	mutex  sync.RWMutex
+	token  string
+	values map[string]string
+	refs   []string
+}
+
+// newVaultClient logs in to Vault and fetches the secrets referenced by the
+// configuration.
+func newVaultClient(config *VaultConfig, logger log.Logger) (*vaultClient, error) {
+	c := &vaultClient{
+		config: config,
+		logger: logger,
+		values: map[string]string{},
+		refs:   config.refs(),
+	}
+
+	if err := c.login(); err != nil {
+		return nil, fmt.Errorf("logging in to Vault: %w", err)
+	}
+	for _, ref := range c.refs {
+		if err := c.fetch(ref); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// secret returns the secret referenced as path#key, which must be referenced
+// by the configuration.
+func (c *vaultClient) secret(ref string) secret {
+	return secret{vault: c, ref: ref}
+}
+
+// value returns the last fetched value of the secret.
+func (c *vaultClient) value(ref string) (string, error) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	value, ok := c.values[ref]
+	if !ok {
+		return "", fmt.Errorf("secret %s not fetched from Vault", ref)
+	}
+	return value, nil
+}
+
+// run renews the token and refreshes the secrets periodically, keeping their
+// last values when Vault cannot be reached. It never returns.
+func (c *vaultClient) run() {
+	for {
+		time.Sleep(c.config.RefreshInterval)
+
+		if err := c.renew(); err != nil {
+			level.Warn(c.logger).Log("msg", "Error renewing Vault token, logging in again", "err", err)
+			if err := c.login(); err != nil {
+				level.Error(c.logger).Log("msg", "Error logging in to Vault", "err", err)
+				continue
+			}
+		}
+		for _, ref := range c.refs {
+			if err := c.fetch(ref); err != nil {
+				level.Error(c.logger).Log("msg", "Error refreshing secret from Vault", "secret", ref, "err", err)
+			}
+		}
+	}
+}
+
+// login gets a token with the Kubernetes auth method if a role is
+// configured, or else reads it from the token file, or from the VAULT_TOKEN
+// environment variable.
+func (c *vaultClient) login() error {
+	var token string
+	switch {
+	case len(c.config.KubernetesRole) > 0:
+		jwt, err := os.ReadFile(vaultKubernetesToken)
+		if err != nil {
+			return err
+		}
+		var resp struct {
+			Auth struct {
+				ClientToken string `json:"client_token"`
+			} `json:"auth"`
+		}
+		body := map[string]string{"role": c.config.KubernetesRole, "jwt": strings.TrimSpace(string(jwt))}
+		if err := c.request(http.MethodPost, "auth/"+c.config.KubernetesMount+"/login", "", body, &resp); err != nil {
+			return err
+		}
+		token = resp.Auth.ClientToken
+	case len(c.config.TokenFile) > 0:
+		content, err := os.ReadFile(c.config.TokenFile)
+		if err != nil {
+			return err
+		}
+		token = strings.TrimSpace(string(content))
+	default:
+		token = os.Getenv("VAULT_TOKEN")
+	}
+
+	if len(token) == 0 {
+		return fmt.Errorf("no Vault token")
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.token = token
+	return nil
+}
+
+// renew extends the lease of the token.
+func (c *vaultClient) renew() error {
+	return c.request(http.MethodPost, "auth/token/renew-self", c.currentToken(), map[string]string{}, nil)
+}
+
+// fetch reads the secret referenced as path#key, from either version of the
+// KV secrets engine.
+func (c *vaultClient) fetch(ref string) error {
+	path, key, _ := strings.Cut(ref, "#")
+
+	var resp struct {
+		Data map[string]json.RawMessage `json:"data"`
+	}
+	if err := c.request(http.MethodGet, path, c.currentToken(), nil, &resp); err != nil {
+		return fmt.Errorf("reading %s: %w", path, err)
+	}
+
+	data := resp.Data
+	// Version 2 of the KV secrets engine nests the data with its metadata.
+	if _, ok := data["metadata"]; ok {
+		if err := json.Unmarshal(data["data"], &data); err != nil {
+			return fmt.Errorf("reading %s: %w", path, err)
+		}
+	}
+
+	raw, ok := data[key]
+	if !ok {
+		return fmt.Errorf("reading %s: key %q not found", path, key)
+	}
+	var value string
+	if err := json.Unmarshal(raw, &value); err != nil {
+		return fmt.Errorf("reading %s: key %q is not a string", path, key)
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.values[ref] = value
+	return nil
+}
+
+func (c *vaultClient) currentToken() string {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.token
+}
+
+// request calls the Vault API, encoding the body and decoding the response
+// into resp as JSON if they are not nil.
+func (c *vaultClient) request(method, path, token string, body, resp interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		content, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(content)
+	}
+
+	req, err := http.NewRequest(method, strings.TrimSuffix(c.config.Address, "/")+"/v1/"+path, reader)
+	if err != nil {
+		return err
+	}
+	if len(token) > 0 {
+		req.Header.Set("X-Vault-Token", token)
+	}
+
+	res, err := vaultHTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode >= 300 {
+		var errs struct {
+			Errors []string `json:"errors"`
+		}
+		json.NewDecoder(res.Body).Decode(&errs)
+		return fmt.Errorf("unexpected status %s: %s", res.Status, strings.Join(errs.Errors, ", "))
+	}
+
+	if resp == nil {
+		return nil
+	}
+	return json.NewDecoder(res.Body).Decode(resp)
+}
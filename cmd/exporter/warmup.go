@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var warmupClient = &http.Client{Timeout: 30 * time.Second}
+
+// warmUp compiles the scripts and requests the URLs of the warmup on the
+// target after its OPcache restarted, and records the outcome.
+func (e *Exporter) warmUp(warmup *WarmupConfig) {
+	start := time.Now()
+	err := e.runWarmup(warmup)
+	duration := time.Since(start)
+
+	if err != nil {
+		level.Error(e.logger).Log("msg", "Error warming up OPcache", "target", e.target, "duration", duration, "err", err)
+	} else {
+		level.Info(e.logger).Log("msg", "OPcache warmed up", "target", e.target, "duration", duration)
+	}
+
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.warmingUp = false
+	e.lastWarmup = start
+	e.lastWarmupDuration = duration
+	e.lastWarmupSuccess = err == nil
+}
+
+// runWarmup runs every step of the warmup, and returns the first error.
+func (e *Exporter) runWarmup(warmup *WarmupConfig) error {
+	var firstErr error
+	fail := func(err error) {
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	if len(warmup.Scripts) > 0 {
+		compiled, err := e.Compile(warmup.Scripts)
+		if err != nil {
+			fail(err)
+		}
+		for _, script := range warmup.Scripts {
+			if err == nil && !compiled[script] {
+				fail(fmt.Errorf("compiling %s failed", script))
+			}
+		}
+	}
+
+	// URLs are requested even if compiling failed, to warm up what can be.
+	for _, url := range warmup.URLs {
+		resp, err := warmupClient.Get(url)
+		if err != nil {
+			fail(err)
+			continue
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode >= 400 {
+			fail(fmt.Errorf("requesting %s: unexpected status %s", url, resp.Status))
+		}
+	}
+
+	return firstErr
+}
+
+func init() {
+	registerCollector(collector{
+		name:    "warmup",
+		enabled: func(e *Exporter) bool { return e.warmup != nil },
+		update: func(e *Exporter, ch chan<- prometheus.Metric, payload *Payload) error {
+			if !e.lastWarmup.IsZero() {
+				ch <- prometheus.MustNewConstMetric(e.warmupDurationDesc, prometheus.GaugeValue, e.lastWarmupDuration.Seconds())
+				ch <- prometheus.MustNewConstMetric(e.warmupSuccessDesc, prometheus.GaugeValue, boolMetric(e.lastWarmupSuccess))
+			}
+			return nil
+		},
+	})
+}
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// webOptions are the settings of the web interface.
+type webOptions struct {
+	// ListenAddress is the address of the HTTP server, disabled if empty,
+	// and FCGIAddress the one of the FastCGI responder, disabled if empty.
+	ListenAddress string
+	FCGIAddress   string
+	MetricsPath   string
+	// GRPCAddress is the address of the gRPC status API, disabled if empty.
+	GRPCAddress string
+	// AgentAddress is the address of the HAProxy agent-check listener,
+	// disabled if empty.
+	AgentAddress string
+	// LifecycleToken enables the /-/quit endpoint, for requests bearing it.
+	LifecycleToken secret
+
+	ReadTimeout       time.Duration
+	ReadHeaderTimeout time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+	MaxHeaderBytes    int
+
+	// MaxRequests limits the number of parallel scrapes, and MetricsTimeout
+	// their duration. ScrapeBudget, if set, bounds the collection of the
+	// targets by the timeout of each scrape.
+	MaxRequests    int
+	MetricsTimeout time.Duration
+	ScrapeBudget   *ScrapeBudget
+	// HealthTimeout is the duration of the status requests of deep health
+	// checks, and APITimeout of the API.
+	HealthTimeout time.Duration
+	APITimeout    time.Duration
+
+	// MetricsShards, if not 0, spreads the targets over shards served under
+	// the metrics path, collecting at most ShardConcurrency targets of a
+	// shard in parallel. ShardConcurrency also bounds the targets requested
+	// in parallel by the API and the deep health checks.
+	MetricsShards    int
+	ShardConcurrency int
+
+	// MaxSeries, if not 0, is the maximum number of series served by a
+	// scrape.
+	MaxSeries int
+
+	// PushURL, if set, is the WebSocket URL of a collector to which
+	// snapshots of the metrics are pushed every PushInterval, identified by
+	// PushAgentID, authenticated by the token of PushTokenFile if set, and
+	// verified by the CA certificates of PushCAFile if set.
+	PushURL       string
+	PushInterval  time.Duration
+	PushAgentID   string
+	PushTokenFile string
+	PushCAFile    string
+
+	// TLSCert and TLSKey, the PEM encoded certificate and private key,
+	// enable HTTPS, and are loaded again when they change. AdminClientCAFile,
+	// if set, verifies the client certificates required by admin endpoints.
+	TLSCert           secret
+	TLSKey            secret
+	AdminClientCAFile string
+
+	// ReadTokens, if any, are required by read-only endpoints, which also
+	// accept AdminTokens.
+	ReadTokens  []secret
+	AdminTokens []secret
+}
+
+// server returns the HTTP server of the web interface.
+func (o webOptions) server(handler http.Handler) (*http.Server, error) {
+	tlsConfig, err := o.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	return &http.Server{
+		Addr:              o.ListenAddress,
+		Handler:           handler,
+		ReadTimeout:       o.ReadTimeout,
+		ReadHeaderTimeout: o.ReadHeaderTimeout,
+		WriteTimeout:      o.WriteTimeout,
+		IdleTimeout:       o.IdleTimeout,
+		MaxHeaderBytes:    o.MaxHeaderBytes,
+		TLSConfig:         tlsConfig,
+	}, nil
+}
+
+// tlsConfig returns the TLS configuration of the server, or nil if HTTPS is
+// disabled.
+func (o webOptions) tlsConfig() (*tls.Config, error) {
+	if !o.TLSCert.IsSet() {
+		if len(o.AdminClientCAFile) > 0 {
+			return nil, errors.New("client certificates require a TLS certificate")
+		}
+		return nil, nil
+	}
+
+	certificate := &tlsCertificate{cert: o.TLSCert, key: o.TLSKey}
+	if _, err := certificate.get(nil); err != nil {
+		return nil, err
+	}
+
+	config := &tls.Config{MinVersion: tls.VersionTLS12, GetCertificate: certificate.get}
+	if len(o.AdminClientCAFile) > 0 {
+		pem, err := os.ReadFile(o.AdminClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.ClientCAs = x509.NewCertPool()
+		if !config.ClientCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in %s", o.AdminClientCAFile)
+		}
+		// Only admin endpoints require client certificates.
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+
+	return config, nil
+}
+
+// tlsCertificate is the certificate of the web interface, loaded again when
+// it changes.
+type tlsCertificate struct {
+	cert secret
+	key  secret
+
+	mutex   sync.Mutex
+	certPEM string
+	keyPEM  string
+	loaded  *tls.Certificate
+}
+
+func (c *tlsCertificate) get(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	certPEM, err := c.cert.Get()
+	if err != nil {
+		return nil, err
+	}
+	keyPEM, err := c.key.Get()
+	if err != nil {
+		return nil, err
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.loaded != nil && certPEM == c.certPEM && keyPEM == c.keyPEM {
+		return c.loaded, nil
+	}
+	cert, err := tls.X509KeyPair([]byte(certPEM), []byte(keyPEM))
+	if err != nil {
+		return nil, err
+	}
+	c.certPEM, c.keyPEM, c.loaded = certPEM, keyPEM, &cert
+	return c.loaded, nil
+}
+
+// listenAndServe runs the server, over HTTPS if enabled.
+func (o webOptions) listenAndServe(server *http.Server) error {
+	if server.TLSConfig != nil {
+		return server.ListenAndServeTLS("", "")
+	}
+	return server.ListenAndServe()
+}
+
+// read wraps the handler of a read-only endpoint, which requires a read or
+// admin token if read tokens are configured.
+func (o webOptions) read(handler http.Handler) http.Handler {
+	if len(o.ReadTokens) > 0 {
+		tokens := append(append([]secret{}, o.ReadTokens...), o.AdminTokens...)
+		return requireToken(tokens...)(handler)
+	}
+	return handler
+}
+
+// fanOut wraps the handler of a read-only endpoint requesting the full status
+// of all the targets, which always requires a read or admin token, so that
+// anonymous requests cannot load the whole fleet.
+func (o webOptions) fanOut(handler http.Handler) http.Handler {
+	tokens := append(append([]secret{}, o.ReadTokens...), o.AdminTokens...)
+	return requireToken(tokens...)(handler)
+}
+
+// admin wraps the handler of an admin endpoint, which requires one of the
+// admin tokens or of the extra tokens, and a client certificate if they are
+// verified.
+func (o webOptions) admin(handler http.Handler, tokens ...secret) http.Handler {
+	handler = requireToken(append(tokens, o.AdminTokens...)...)(handler)
+	if len(o.AdminClientCAFile) > 0 {
+		handler = requireClientCert(handler)
+	}
+	return handler
+}
+
+// handlerMetrics instrument the handlers of the web interface.
+type handlerMetrics struct {
+	requests *prometheus.CounterVec
+	duration *prometheus.HistogramVec
+	size     *prometheus.HistogramVec
+	inFlight *prometheus.GaugeVec
+}
+
+func newHandlerMetrics(registerer prometheus.Registerer) *handlerMetrics {
+	m := &handlerMetrics{
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "exporter",
+			Name:      "http_requests_total",
+			Help:      "Total number of HTTP requests served by the exporter, by handler, method and status code.",
+		}, []string{"handler", "method", "code"}),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: "exporter",
+			Name:      "http_request_duration_seconds",
+			Help:      "Histogram of the duration of HTTP requests served by the exporter, by handler.",
+		}, []string{"handler"}),
+		size: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: "exporter",
+			Name:      "http_response_size_bytes",
+			Help:      "Histogram of the size of HTTP responses of the exporter, by handler.",
+			Buckets:   prometheus.ExponentialBuckets(256, 4, 8),
+		}, []string{"handler"}),
+		inFlight: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: "exporter",
+			Name:      "http_requests_in_flight",
+			Help:      "Number of HTTP requests being served by the exporter, by handler.",
+		}, []string{"handler"}),
+	}
+	registerer.MustRegister(m.requests, m.duration, m.size, m.inFlight)
+	return m
+}
+
+// instrument returns the handler instrumented with the given handler label.
+func (m *handlerMetrics) instrument(name string, handler http.Handler) http.Handler {
+	labels := prometheus.Labels{"handler": name}
+	return promhttp.InstrumentHandlerInFlight(m.inFlight.With(labels),
+		promhttp.InstrumentHandlerCounter(m.requests.MustCurryWith(labels),
+			promhttp.InstrumentHandlerDuration(m.duration.MustCurryWith(labels),
+				promhttp.InstrumentHandlerResponseSize(m.size.MustCurryWith(labels), handler))))
+}
+
+// middleware wraps a handler with a cross-cutting behavior.
+type middleware func(http.Handler) http.Handler
+
+// chain wraps a handler with middlewares, the first one being the outermost.
+func chain(handler http.Handler, middlewares ...middleware) http.Handler {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		handler = middlewares[i](handler)
+	}
+	return handler
+}
+
+// statusRecorder records the status code of a response.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// logRequests logs the requests at debug level, with the status code and the
+// duration of their response.
+func logRequests(logger log.Logger) middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+			next.ServeHTTP(recorder, r)
+			level.Debug(logger).Log("msg", "Served request", "method", r.Method, "path", r.URL.Path, "remote", r.RemoteAddr, "status", recorder.status, "duration", time.Since(start))
+		})
+	}
+}
+
+// recoverPanics answers with an internal server error to the requests whose
+// handler panics, instead of dropping their connection.
+func recoverPanics(logger log.Logger) middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			defer func() {
+				if err := recover(); err != nil {
+					if err == http.ErrAbortHandler {
+						panic(err)
+					}
+					level.Error(logger).Log("msg", "Panic serving request", "path", r.URL.Path, "err", err, "stack", string(debug.Stack()))
+					http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+				}
+			}()
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// requireToken only lets requests bearing one of the tokens through. Tokens
+// given as files are read on every request, so that they can be rotated.
+func requireToken(tokens ...secret) middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !ok || !validToken(bearer, tokens) {
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+			addPrincipal(r, tokenPrincipal(bearer))
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// validToken tells whether the bearer token is one of the non-empty tokens.
+// Tokens whose file cannot be read are ignored.
+func validToken(bearer string, tokens []secret) bool {
+	valid := false
+	for _, s := range tokens {
+		token, err := s.Get()
+		if err == nil && len(token) > 0 && subtle.ConstantTimeCompare([]byte(bearer), []byte(token)) == 1 {
+			valid = true
+		}
+	}
+	return valid
+}
+
+// requireClientCert only lets requests bearing a verified client certificate
+// through.
+func requireClientCert(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+			http.Error(w, "Client certificate required", http.StatusForbidden)
+			return
+		}
+		addPrincipal(r, "cn:"+r.TLS.VerifiedChains[0][0].Subject.CommonName)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// quitHandler calls quit on POST or PUT requests, like the lifecycle API of
+// Prometheus.
+func quitHandler(quit func()) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost && r.Method != http.MethodPut {
+			w.Header().Set("Allow", "POST, PUT")
+			http.Error(w, "Only POST or PUT requests allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Write([]byte("Requesting termination... Goodbye!\n"))
+		quit()
+	}
+}